@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// AuditAction identifies the kind of mutation an AuditEntry records
+type AuditAction string
+
+const (
+	AuditCreate  AuditAction = "create"
+	AuditUpdate  AuditAction = "update"
+	AuditDelete  AuditAction = "delete"
+	AuditRestore AuditAction = "restore"
+	AuditPurge   AuditAction = "purge"
+)
+
+// AuditEntry records a single mutation of a user
+type AuditEntry struct {
+	Seq      int         `json:"seq"`
+	UserID   int         `json:"user_id"`
+	Action   AuditAction `json:"action"`
+	Actor    string      `json:"actor"`
+	At       time.Time   `json:"at"`
+	OldName  string      `json:"old_name,omitempty"`
+	NewName  string      `json:"new_name,omitempty"`
+	OldEmail string      `json:"old_email,omitempty"`
+	NewEmail string      `json:"new_email,omitempty"`
+}
+
+// SetActor sets who is recorded in the audit log for subsequent mutations
+func (s *UserService) SetActor(actor string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actor = actor
+}
+
+// record appends an entry to the audit log. The caller must hold s.mu.
+func (s *UserService) record(entry AuditEntry) {
+	entry.Seq = len(s.audit) + 1
+	entry.Actor = s.actor
+	entry.At = s.now()
+	s.audit = append(s.audit, entry)
+}
+
+// RestoreUser undoes a soft delete
+func (s *UserService) RestoreUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return fmt.Errorf("user with id %d not found", id)
+	}
+	if user.DeletedAt == nil {
+		return fmt.Errorf("user with id %d is not deleted", id)
+	}
+	user.DeletedAt = nil
+	s.record(AuditEntry{UserID: id, Action: AuditRestore, NewName: user.Name, NewEmail: user.Email})
+	return nil
+}
+
+// PurgeDeleted permanently removes users that were soft deleted more than
+// retention ago and returns how many were removed
+func (s *UserService) PurgeDeleted(retention time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := s.now().Add(-retention)
+	purged := 0
+	for id, user := range s.users {
+		if user.DeletedAt == nil || user.DeletedAt.After(cutoff) {
+			continue
+		}
+		delete(s.emailIndex, normalizeEmail(user.Email))
+		delete(s.users, id)
+		delete(s.pipelines, id)
+		s.record(AuditEntry{UserID: id, Action: AuditPurge, OldName: user.Name, OldEmail: user.Email})
+		purged++
+	}
+	return purged
+}
+
+// History returns the audit entries for a user, oldest first
+func (s *UserService) History(id int) []AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []AuditEntry
+	for _, entry := range s.audit {
+		if entry.UserID == id {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// auditFilename returns the path of the audit log stored next to a users file
+func auditFilename(filename string) string {
+	return filename + ".audit"
+}
+
+func saveAudit(filename string, audit []AuditEntry) error {
+	data, err := json.Marshal(audit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit log: %w", err)
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace audit log: %w", err)
+	}
+	return nil
+}
+
+// loadAudit reads an audit log; a missing file yields an empty log
+func loadAudit(filename string) ([]AuditEntry, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	var audit []AuditEntry
+	if err := json.Unmarshal(data, &audit); err != nil {
+		return nil, fmt.Errorf("failed to decode audit log: %w", err)
+	}
+	return audit, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSoftDeleteRestoreAndPurge(t *testing.T) {
+	service := NewUserService()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	user, err := service.CreateUser("Test User", "test@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := service.DeleteUser(user.ID); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if _, err := service.GetUser(user.ID); err == nil {
+		t.Error("GetUser should not return a soft-deleted user")
+	}
+	if _, err := service.CreateUser("Other User", "test@example.com"); err == nil {
+		t.Error("Email of a soft-deleted user should stay reserved")
+	}
+
+	if err := service.RestoreUser(user.ID); err != nil {
+		t.Fatalf("RestoreUser failed: %v", err)
+	}
+	if _, err := service.GetUser(user.ID); err != nil {
+		t.Errorf("GetUser failed after restore: %v", err)
+	}
+
+	if err := service.DeleteUser(user.ID); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if n := service.PurgeDeleted(2 * time.Hour); n != 0 {
+		t.Errorf("Expected nothing purged inside retention, got %d", n)
+	}
+	now = now.Add(2 * time.Hour)
+	if n := service.PurgeDeleted(2 * time.Hour); n != 1 {
+		t.Errorf("Expected 1 user purged, got %d", n)
+	}
+	if err := service.RestoreUser(user.ID); err == nil {
+		t.Error("RestoreUser should fail for a purged user")
+	}
+
+	// The purged ID stays taken across a save and load
+	filename := filepath.Join(t.TempDir(), "users.json")
+	if err := service.SaveToFile(filename); err != nil {
+		t.Fatalf("SaveToFile failed: %v", err)
+	}
+	loaded := NewUserService()
+	if err := loaded.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+	next, err := loaded.CreateUser("Next User", "next@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if next.ID == user.ID || len(loaded.History(next.ID)) != 1 {
+		t.Errorf("Purged ID %d was reused: %+v", user.ID, loaded.History(next.ID))
+	}
+}
+
+func TestAuditHistory(t *testing.T) {
+	service := NewUserService()
+	service.SetActor("alice")
+	user, err := service.CreateUser("Test User", "test@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	service.SetActor("bob")
+	if err := service.UpdateUser(user.ID, "Renamed", "renamed@example.com"); err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	if err := service.DeleteUser(user.ID); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+
+	history := service.History(user.ID)
+	want := []AuditAction{AuditCreate, AuditUpdate, AuditDelete}
+	if len(history) != len(want) {
+		t.Fatalf("Expected %d audit entries, got %d", len(want), len(history))
+	}
+	for i, action := range want {
+		if history[i].Action != action {
+			t.Errorf("Entry %d: expected action %s, got %s", i, action, history[i].Action)
+		}
+	}
+	update := history[1]
+	if update.Actor != "bob" || update.OldName != "Test User" || update.NewEmail != "renamed@example.com" {
+		t.Errorf("Unexpected update entry: %+v", update)
+	}
+
+	filename := filepath.Join(t.TempDir(), "users.json")
+	if err := service.SaveToFile(filename); err != nil {
+		t.Fatalf("SaveToFile failed: %v", err)
+	}
+	loaded := NewUserService()
+	if err := loaded.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+	if got := len(loaded.History(user.ID)); got != len(want) {
+		t.Errorf("Expected %d audit entries after load, got %d", len(want), got)
+	}
+	if _, err := loaded.GetUser(user.ID); err == nil {
+		t.Error("Soft delete should survive a save and load")
+	}
+}
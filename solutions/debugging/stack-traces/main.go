@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,19 +20,59 @@ type User struct {
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
 	Data      []byte    `json:"data"`
+	// DeletedAt is set when the user has been soft deleted
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // UserService handles user-related operations
 type UserService struct {
+	mu    sync.RWMutex
 	users map[int]*User
+	// emailIndex maps a normalized email address to the owning user ID.
+	// Soft-deleted users keep their entry until they are purged.
+	emailIndex map[string]int
+	// lastID is the highest user ID created, loaded or named in the audit
+	// log, so IDs of purged users are never reused
+	lastID     int
+	audit      []AuditEntry
+	actor      string
+	now        func() time.Time
+	transforms *TransformRegistry
+	// pipelines holds per-user stage names; users without one use DefaultPipeline
+	pipelines  map[int][]string
+	migrations *MigrationRegistry
 }
 
 func NewUserService() *UserService {
 	return &UserService{
-		users: make(map[int]*User),
+		users:      make(map[int]*User),
+		emailIndex: make(map[string]int),
+		actor:      "system",
+		now:        time.Now,
+		transforms: NewTransformRegistry(),
+		pipelines:  make(map[int][]string),
+		migrations: DefaultMigrations(),
 	}
 }
 
+// activeUser returns the user with the given ID unless it is missing or soft deleted.
+// The caller must hold s.mu.
+func (s *UserService) activeUser(id int) (*User, error) {
+	user, ok := s.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, fmt.Errorf("user with id %d not found", id)
+	}
+	return user, nil
+}
+
+// normalizeEmail returns the key used for the email index
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// CreateUser adds a user under the next free ID. Email addresses are
+// compared case-insensitively, and one that another user already has is
+// rejected; soft-deleted users keep theirs until they are purged.
 func (s *UserService) CreateUser(name, email string) (*User, error) {
 	if strings.TrimSpace(name) == "" {
 		return nil, errors.New("name cannot be empty")
@@ -37,29 +80,49 @@ func (s *UserService) CreateUser(name, email string) (*User, error) {
 	if !strings.Contains(email, "@") {
 		return nil, errors.New("invalid email format")
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := normalizeEmail(email)
+	if _, taken := s.emailIndex[key]; taken {
+		return nil, fmt.Errorf("email %s is already in use", email)
+	}
+	s.lastID++
 	user := &User{
-		ID:        int(time.Now().UnixNano()),
+		ID:        s.lastID,
 		Name:      name,
 		Email:     email,
-		CreatedAt: time.Now(),
+		CreatedAt: s.now(),
 		Data:      make([]byte, 1000),
 	}
 	s.users[user.ID] = user
+	s.emailIndex[key] = user.ID
+	s.record(AuditEntry{UserID: user.ID, Action: AuditCreate, NewName: name, NewEmail: email})
 	return user, nil
 }
 
 func (s *UserService) GetUser(id int) (*User, error) {
-	user, ok := s.users[id]
-	if !ok {
-		return nil, fmt.Errorf("user with id %d not found", id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeUser(id)
+}
+
+// GetUserByEmail looks a user up through the email index
+func (s *UserService) GetUserByEmail(email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.emailIndex[normalizeEmail(email)]
+	if !ok || s.users[id].DeletedAt != nil {
+		return nil, fmt.Errorf("user with email %s not found", email)
 	}
-	return user, nil
+	return s.users[id], nil
 }
 
 func (s *UserService) UpdateUser(id int, name, email string) error {
-	user, ok := s.users[id]
-	if !ok {
-		return fmt.Errorf("user with id %d not found", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, err := s.activeUser(id)
+	if err != nil {
+		return err
 	}
 	if strings.TrimSpace(name) == "" {
 		return errors.New("name cannot be empty")
@@ -67,64 +130,204 @@ func (s *UserService) UpdateUser(id int, name, email string) error {
 	if !strings.Contains(email, "@") {
 		return errors.New("invalid email format")
 	}
+	oldKey, newKey := normalizeEmail(user.Email), normalizeEmail(email)
+	if owner, taken := s.emailIndex[newKey]; taken && owner != id {
+		return fmt.Errorf("email %s is already in use", email)
+	}
+	delete(s.emailIndex, oldKey)
+	s.emailIndex[newKey] = id
+	s.record(AuditEntry{
+		UserID:   id,
+		Action:   AuditUpdate,
+		OldName:  user.Name,
+		NewName:  name,
+		OldEmail: user.Email,
+		NewEmail: email,
+	})
 	user.Name = name
 	user.Email = email
 	return nil
 }
 
+// DeleteUser soft deletes a user; see RestoreUser and PurgeDeleted
 func (s *UserService) DeleteUser(id int) error {
-	if _, ok := s.users[id]; !ok {
-		return fmt.Errorf("user with id %d not found", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, err := s.activeUser(id)
+	if err != nil {
+		return err
 	}
-	delete(s.users, id)
+	deletedAt := s.now()
+	user.DeletedAt = &deletedAt
+	s.record(AuditEntry{UserID: id, Action: AuditDelete, OldName: user.Name, OldEmail: user.Email})
 	return nil
 }
 
+// SaveToFile writes all users to a versioned users file, one user at a
+// time, and the audit log next to it. Both are taken under one read lock, so
+// they agree with each other, and the users file is replaced only once it
+// has been written in full.
 func (s *UserService) SaveToFile(filename string) error {
-	file, err := os.Create(filename)
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
-	defer file.Close()
-	data, err := json.Marshal(s.users)
-	if err != nil {
-		return fmt.Errorf("failed to marshal users: %w", err)
+	s.mu.RLock()
+	err = writeUsersFile(file, CurrentSchemaVersion, s.users)
+	audit := append([]AuditEntry(nil), s.audit...)
+	s.mu.RUnlock()
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write to file: %w", closeErr)
+	}
+	if err == nil {
+		err = saveAudit(auditFilename(filename), audit)
 	}
-	_, err = file.Write(data)
 	if err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
 	}
 	return nil
 }
 
+// LoadFromFile loads users from a file. Files at the current schema version
+// are decoded one user at a time; older ones are migrated in memory first.
 func (s *UserService) LoadFromFile(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
-	var users map[int]*User
-	if err := json.NewDecoder(file).Decode(&users); err != nil {
+	users, err := readUsersFile(file, s.migrations.Latest())
+	if errors.Is(err, errNeedsMigration) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		users, err = s.migrateUsers(file)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
 		return fmt.Errorf("failed to decode users: %w", err)
 	}
+	ids := make([]int, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	index := make(map[string]int, len(users))
+	lastID := 0
+	for _, id := range ids {
+		key := normalizeEmail(users[id].Email)
+		if owner, taken := index[key]; taken {
+			return fmt.Errorf("failed to load users: users %d and %d share email %s", owner, id, users[id].Email)
+		}
+		index[key] = id
+		lastID = id
+	}
+	audit, err := loadAudit(auditFilename(filename))
+	if err != nil {
+		return err
+	}
+	// A purged user is gone from the file but not from the audit log
+	for _, entry := range audit {
+		lastID = max(lastID, entry.UserID)
+	}
+	s.mu.Lock()
 	s.users = users
+	s.emailIndex = index
+	s.lastID = lastID
+	s.audit = audit
+	s.mu.Unlock()
 	return nil
 }
 
+// migrateUsers decodes a users file that needs migrating, applying the
+// pending schema migrations to it in memory
+func (s *UserService) migrateUsers(r io.Reader) (map[int]*User, error) {
+	doc, err := decodeDocument(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	doc, _, err = s.migrations.Migrate(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate users: %w", err)
+	}
+	return documentUsers(doc)
+}
+
+// documentUsers decodes the users of a migrated document
+func documentUsers(doc Document) (map[int]*User, error) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-encode users: %w", err)
+	}
+	var decoded usersFile
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	if decoded.Users == nil {
+		return make(map[int]*User), nil
+	}
+	return decoded.Users, nil
+}
+
+// ProcessUserData runs the user's data pipeline
 func (s *UserService) ProcessUserData(id int) error {
-	user, ok := s.users[id]
+	return s.ProcessUserDataWithProgress(id, nil)
+}
+
+// ProcessUserDataWithProgress runs the user's data pipeline, calling progress
+// after every stage. The pipeline runs without holding the service lock, so
+// progress may call back into the service. If the user is deleted or their
+// data replaced meanwhile, the result is discarded with an error.
+func (s *UserService) ProcessUserDataWithProgress(id int, progress ProgressFunc) error {
+	s.mu.RLock()
+	user, err := s.activeUser(id)
+	if err != nil {
+		s.mu.RUnlock()
+		return err
+	}
+	original := user.Data
+	stages, ok := s.pipelines[id]
 	if !ok {
-		return fmt.Errorf("user with id %d not found", id)
+		stages = DefaultPipeline
 	}
-	if user.Data == nil {
+	pipeline, err := s.transforms.Pipeline(stages...)
+	s.mu.RUnlock()
+	if original == nil {
 		return errors.New("user data is nil")
 	}
-	for i := 0; i < len(user.Data); i++ {
-		user.Data[i] = byte(i % 256)
+	if err != nil {
+		return fmt.Errorf("failed to build pipeline for user %d: %w", id, err)
 	}
+
+	// Run on a copy so a failing stage leaves the stored data untouched
+	data, err := pipeline.Run(append([]byte(nil), original...), progress)
+	if err != nil {
+		return fmt.Errorf("failed to process data for user %d: %w", id, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, err = s.activeUser(id); err != nil {
+		return err
+	}
+	if !sameSlice(user.Data, original) {
+		return fmt.Errorf("data for user %d changed while it was processed", id)
+	}
+	user.Data = data
 	return nil
 }
 
+// sameSlice reports whether a and b are the same slice, not just equal bytes
+func sameSlice(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
 // recoverWithStack recovers from panics and prints a stack trace
 func recoverWithStack() {
 	if r := recover(); r != nil {
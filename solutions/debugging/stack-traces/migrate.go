@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CurrentSchemaVersion is the version SaveToFile writes
+const CurrentSchemaVersion = 1
+
+// usersFile is the on-disk layout of a versioned users file
+type usersFile struct {
+	Version int           `json:"version"`
+	Users   map[int]*User `json:"users"`
+}
+
+// Document is a users file decoded without reference to the User struct.
+// Numbers are kept as json.Number so large IDs survive a round trip.
+type Document map[string]any
+
+// Migration upgrades a Document from version From to From+1
+type Migration struct {
+	From        int
+	Description string
+	Apply       func(doc Document) (Document, error)
+}
+
+// MigrationRegistry holds one migration per source version
+type MigrationRegistry struct {
+	migrations map[int]Migration
+	latest     int
+}
+
+// NewMigrationRegistry returns an empty registry
+func NewMigrationRegistry() *MigrationRegistry {
+	return &MigrationRegistry{migrations: make(map[int]Migration)}
+}
+
+// DefaultMigrations returns the migrations for every schema version this build knows about
+func DefaultMigrations() *MigrationRegistry {
+	r := NewMigrationRegistry()
+	r.Register(Migration{
+		From:        0,
+		Description: "wrap unversioned user map in a versioned envelope",
+		Apply: func(doc Document) (Document, error) {
+			return Document{"users": map[string]any(doc)}, nil
+		},
+	})
+	return r
+}
+
+// Register adds a migration; registering two migrations from the same version panics
+func (r *MigrationRegistry) Register(m Migration) {
+	if _, exists := r.migrations[m.From]; exists {
+		panic(fmt.Sprintf("migration from version %d registered twice", m.From))
+	}
+	r.migrations[m.From] = m
+	if m.From+1 > r.latest {
+		r.latest = m.From + 1
+	}
+}
+
+// Latest returns the version a document ends up at after all migrations
+func (r *MigrationRegistry) Latest() int {
+	return r.latest
+}
+
+// MigrationStep reports one migration applied to a document
+type MigrationStep struct {
+	From        int
+	To          int
+	Description string
+	Changes     []string
+}
+
+// MigrationReport describes the migrations applied, or that would be applied, to a file
+type MigrationReport struct {
+	FromVersion int
+	ToVersion   int
+	Steps       []MigrationStep
+}
+
+// documentVersion returns the version recorded in doc. Files written before
+// versioning have no "version" key and are version 0.
+func documentVersion(doc Document) (int, error) {
+	raw, ok := doc["version"]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("version has type %T, want number", raw)
+	}
+	v, err := n.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q: %w", n, err)
+	}
+	return int(v), nil
+}
+
+func decodeDocument(r io.Reader) (Document, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var doc Document
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = Document{}
+	}
+	return doc, nil
+}
+
+// Migrate upgrades doc to the latest version and reports each step taken
+func (r *MigrationRegistry) Migrate(doc Document) (Document, *MigrationReport, error) {
+	version, err := documentVersion(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version > r.latest {
+		return nil, nil, fmt.Errorf("file version %d is newer than supported version %d", version, r.latest)
+	}
+	report := &MigrationReport{FromVersion: version, ToVersion: version}
+	doc = cloneDocument(doc)
+	delete(doc, "version")
+	for version < r.latest {
+		m, ok := r.migrations[version]
+		if !ok {
+			return nil, nil, fmt.Errorf("no migration from version %d", version)
+		}
+		next, err := m.Apply(cloneDocument(doc))
+		if err != nil {
+			return nil, nil, fmt.Errorf("migration %d->%d failed: %w", version, version+1, err)
+		}
+		delete(next, "version")
+		report.Steps = append(report.Steps, MigrationStep{
+			From:        version,
+			To:          version + 1,
+			Description: m.Description,
+			Changes:     diffValues("", map[string]any(doc), map[string]any(next)),
+		})
+		version++
+		doc = next
+	}
+	doc["version"] = json.Number(fmt.Sprint(version))
+	report.ToVersion = version
+	return doc, report, nil
+}
+
+// cloneDocument deep-copies doc so a migration cannot alter its input
+func cloneDocument(doc Document) Document {
+	return Document(cloneValue(map[string]any(doc)).(map[string]any))
+}
+
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = cloneValue(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = cloneValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// diffValues lists the paths that differ between two decoded JSON values
+func diffValues(path string, before, after any) []string {
+	b, bok := before.(map[string]any)
+	a, aok := after.(map[string]any)
+	if !bok || !aok {
+		if reflect.DeepEqual(before, after) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: changed", displayPath(path))}
+	}
+	keys := make(map[string]bool)
+	for k := range b {
+		keys[k] = true
+	}
+	for k := range a {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, k := range sorted {
+		child := strings.TrimPrefix(path+"."+k, ".")
+		bv, inBefore := b[k]
+		av, inAfter := a[k]
+		switch {
+		case !inBefore:
+			changes = append(changes, child+": added")
+		case !inAfter:
+			changes = append(changes, child+": removed")
+		default:
+			changes = append(changes, diffValues(child, bv, av)...)
+		}
+	}
+	return changes
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "<root>"
+	}
+	return path
+}
+
+// MigrateFile upgrades a users file to the latest schema version in place.
+// With dryRun set it only reports what would change.
+func (s *UserService) MigrateFile(filename string, dryRun bool) (*MigrationReport, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	doc, err := decodeDocument(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	doc, report, err := s.migrations.Migrate(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate users: %w", err)
+	}
+	if dryRun || len(report.Steps) == 0 {
+		return report, nil
+	}
+	// Write the version first, as SaveToFile does, so the migrated file
+	// still loads through readUsersFile
+	users, err := documentUsers(doc)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	err = writeUsersFile(file, report.ToVersion, users)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write to file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return nil, fmt.Errorf("failed to replace file: %w", err)
+	}
+	return report, nil
+}
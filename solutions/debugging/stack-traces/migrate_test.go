@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const legacyUsers = `{"1712345678901234567":{"id":1712345678901234567,"name":"Legacy User","email":"legacy@example.com","created_at":"2024-01-01T00:00:00Z","data":null}}`
+
+func TestDefaultMigrationsReachCurrentVersion(t *testing.T) {
+	if got := DefaultMigrations().Latest(); got != CurrentSchemaVersion {
+		t.Errorf("Migrations end at version %d, but SaveToFile writes %d", got, CurrentSchemaVersion)
+	}
+}
+
+func TestLoadLegacyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(filename, []byte(legacyUsers), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewUserService()
+	if err := service.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+	user, err := service.GetUser(1712345678901234567)
+	if err != nil {
+		t.Fatalf("GetUser failed after migration: %v", err)
+	}
+	if user.Name != "Legacy User" {
+		t.Errorf("Expected name 'Legacy User', got '%s'", user.Name)
+	}
+}
+
+func TestLoadRejectsDuplicateEmails(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.json")
+	users := `{"version":1,"users":{"1":{"id":1,"name":"One","email":"same@example.com"},"2":{"id":2,"name":"Two","email":"SAME@example.com"}}}`
+	if err := os.WriteFile(filename, []byte(users), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service := NewUserService()
+	if err := service.LoadFromFile(filename); err == nil || !strings.Contains(err.Error(), "users 1 and 2 share email") {
+		t.Errorf("Expected the duplicate email to be rejected, got %v", err)
+	}
+
+	// A legacy file loads, and new users are numbered after it
+	if err := os.WriteFile(filename, []byte(legacyUsers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+	if user, err := service.CreateUser("New User", "new@example.com"); err != nil || user.ID != 1712345678901234568 {
+		t.Errorf("Expected the next ID after the loaded users, got %v (err %v)", user, err)
+	}
+}
+
+func TestMigrateFileDryRun(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(filename, []byte(legacyUsers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service := NewUserService()
+
+	report, err := service.MigrateFile(filename, true)
+	if err != nil {
+		t.Fatalf("MigrateFile failed: %v", err)
+	}
+	if report.FromVersion != 0 || report.ToVersion != 1 || len(report.Steps) != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if len(report.Steps[0].Changes) == 0 {
+		t.Error("Expected the dry run to list changes")
+	}
+	data, _ := os.ReadFile(filename)
+	if string(data) != legacyUsers {
+		t.Error("Dry run must not modify the file")
+	}
+
+	if _, err := service.MigrateFile(filename, false); err != nil {
+		t.Fatalf("MigrateFile failed: %v", err)
+	}
+	report, err = service.MigrateFile(filename, true)
+	if err != nil {
+		t.Fatalf("MigrateFile failed: %v", err)
+	}
+	if report.FromVersion != CurrentSchemaVersion || len(report.Steps) != 0 {
+		t.Errorf("Expected file to be at the current version, got %+v", report)
+	}
+	// The migrated file loads through the streaming path
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	users, err := readUsersFile(file, CurrentSchemaVersion)
+	if err != nil {
+		t.Fatalf("readUsersFile failed: %v", err)
+	}
+	if len(users) == 0 {
+		t.Error("Expected the migrated users to load")
+	}
+}
+
+func TestMigrationChain(t *testing.T) {
+	registry := DefaultMigrations()
+	registry.Register(Migration{
+		From:        1,
+		Description: "rename data to payload",
+		Apply: func(doc Document) (Document, error) {
+			users, _ := doc["users"].(map[string]any)
+			for _, u := range users {
+				user := u.(map[string]any)
+				user["payload"] = user["data"]
+				delete(user, "data")
+			}
+			return doc, nil
+		},
+	})
+
+	var doc Document
+	if err := json.Unmarshal([]byte(legacyUsers), &doc); err != nil {
+		t.Fatal(err)
+	}
+	migrated, report, err := registry.Migrate(doc)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if report.ToVersion != 2 || len(report.Steps) != 2 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	want := []string{
+		"users.1712345678901234567.data: removed",
+		"users.1712345678901234567.payload: added",
+	}
+	if got := report.Steps[1].Changes; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected changes %v, got %v", want, got)
+	}
+	user := migrated["users"].(map[string]any)["1712345678901234567"].(map[string]any)
+	if _, ok := user["payload"]; !ok {
+		t.Error("Expected payload field after migration")
+	}
+
+	if _, _, err := DefaultMigrations().Migrate(migrated); err == nil {
+		t.Error("Migrate should reject documents newer than the registry")
+	}
+}
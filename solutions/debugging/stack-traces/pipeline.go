@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DataTransform is a named stage that rewrites a user's Data
+type DataTransform interface {
+	Name() string
+	Apply(data []byte) ([]byte, error)
+}
+
+// DataError lets a transform report where in its input it failed
+type DataError struct {
+	Offset int
+	Err    error
+}
+
+func (e *DataError) Error() string {
+	return fmt.Sprintf("at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *DataError) Unwrap() error {
+	return e.Err
+}
+
+// StageError identifies the pipeline stage that failed and, when known, the
+// offset into that stage's input. Offset is -1 if the stage did not report one.
+type StageError struct {
+	Stage  string
+	Index  int
+	Offset int
+	Err    error
+}
+
+func (e *StageError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("stage %d (%s) failed: %v", e.Index, e.Stage, e.Err)
+	}
+	return fmt.Sprintf("stage %d (%s) failed at offset %d: %v", e.Index, e.Stage, e.Offset, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Progress describes a pipeline stage that has just completed
+type Progress struct {
+	Stage string
+	Index int // zero-based index of the completed stage
+	Total int // number of stages in the pipeline
+	Bytes int // size of the data after the stage
+}
+
+// ProgressFunc receives a Progress report after every stage
+type ProgressFunc func(Progress)
+
+// TransformRegistry holds the transforms that pipelines can refer to by name
+type TransformRegistry struct {
+	mu         sync.RWMutex
+	transforms map[string]DataTransform
+}
+
+// NewTransformRegistry returns a registry holding the built-in transforms
+func NewTransformRegistry() *TransformRegistry {
+	r := &TransformRegistry{transforms: make(map[string]DataTransform)}
+	for _, t := range []DataTransform{
+		FillPattern{},
+		Compress{},
+		Decompress{},
+		AppendChecksum{},
+		VerifyChecksum{},
+	} {
+		r.transforms[t.Name()] = t
+	}
+	return r
+}
+
+// Register adds a transform under its name
+func (r *TransformRegistry) Register(t DataTransform) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.transforms[t.Name()]; exists {
+		return fmt.Errorf("transform %q is already registered", t.Name())
+	}
+	r.transforms[t.Name()] = t
+	return nil
+}
+
+// Names returns the registered transform names in sorted order
+func (r *TransformRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.transforms))
+	for name := range r.transforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline composes the named transforms, in order
+func (r *TransformRegistry) Pipeline(names ...string) (Pipeline, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p := make(Pipeline, 0, len(names))
+	for _, name := range names {
+		t, ok := r.transforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		p = append(p, t)
+	}
+	return p, nil
+}
+
+// Pipeline is an ordered list of transforms
+type Pipeline []DataTransform
+
+// Run feeds data through every stage, reporting progress after each one
+func (p Pipeline) Run(data []byte, progress ProgressFunc) ([]byte, error) {
+	for i, t := range p {
+		out, err := t.Apply(data)
+		if err != nil {
+			stageErr := &StageError{Stage: t.Name(), Index: i, Offset: -1, Err: err}
+			var dataErr *DataError
+			if errors.As(err, &dataErr) {
+				stageErr.Offset = dataErr.Offset
+			}
+			return nil, stageErr
+		}
+		data = out
+		if progress != nil {
+			progress(Progress{Stage: t.Name(), Index: i, Total: len(p), Bytes: len(data)})
+		}
+	}
+	return data, nil
+}
+
+// DefaultPipeline is run for users without a pipeline of their own
+var DefaultPipeline = []string{"fill"}
+
+// RegisterTransform makes a transform available to user pipelines
+func (s *UserService) RegisterTransform(t DataTransform) error {
+	return s.transforms.Register(t)
+}
+
+// SetPipeline configures the stages ProcessUserData runs for a user
+func (s *UserService) SetPipeline(id int, stages ...string) error {
+	if _, err := s.transforms.Pipeline(stages...); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.activeUser(id); err != nil {
+		return err
+	}
+	s.pipelines[id] = append([]string(nil), stages...)
+	return nil
+}
+
+// FillPattern overwrites every byte with its index modulo 256
+type FillPattern struct{}
+
+func (FillPattern) Name() string { return "fill" }
+
+func (FillPattern) Apply(data []byte) ([]byte, error) {
+	for i := 0; i < len(data); i++ {
+		data[i] = byte(i % 256)
+	}
+	return data, nil
+}
+
+// Compress gzips the data
+type Compress struct{}
+
+func (Compress) Name() string { return "compress" }
+
+func (Compress) Apply(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress reverses Compress
+type Decompress struct{}
+
+func (Decompress) Name() string { return "decompress" }
+
+func (Decompress) Apply(data []byte) ([]byte, error) {
+	src := bytes.NewReader(data)
+	r, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, &DataError{Offset: len(data) - src.Len(), Err: err}
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &DataError{Offset: len(data) - src.Len(), Err: err}
+	}
+	return out, nil
+}
+
+// AppendChecksum appends a big-endian CRC-32 of the data
+type AppendChecksum struct{}
+
+func (AppendChecksum) Name() string { return "checksum" }
+
+func (AppendChecksum) Apply(data []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data)), nil
+}
+
+// VerifyChecksum checks and strips the trailer written by AppendChecksum
+type VerifyChecksum struct{}
+
+func (VerifyChecksum) Name() string { return "verify-checksum" }
+
+func (VerifyChecksum) Apply(data []byte) ([]byte, error) {
+	if len(data) < crc32.Size {
+		return nil, &DataError{Offset: 0, Err: errors.New("data too short for checksum")}
+	}
+	body, trailer := data[:len(data)-crc32.Size], data[len(data)-crc32.Size:]
+	if binary.BigEndian.Uint32(trailer) != crc32.ChecksumIEEE(body) {
+		return nil, &DataError{Offset: len(body), Err: errors.New("checksum mismatch")}
+	}
+	return body, nil
+}
+
+// LoadKeyFile reads a hex-encoded AES key (16, 24 or 32 bytes) from a local file
+func LoadKeyFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key file: %w", err)
+	}
+	return key, nil
+}
+
+// NewAESGCM returns an "encrypt" and a "decrypt" transform sharing key.
+// Encrypted data is the random nonce followed by the sealed payload.
+func NewAESGCM(key []byte) (encrypt, decrypt DataTransform, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcmEncrypt{aead}, gcmDecrypt{aead}, nil
+}
+
+type gcmEncrypt struct{ aead cipher.AEAD }
+
+func (gcmEncrypt) Name() string { return "encrypt" }
+
+func (t gcmEncrypt) Apply(data []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize(), t.aead.NonceSize()+len(data)+t.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return t.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+type gcmDecrypt struct{ aead cipher.AEAD }
+
+func (gcmDecrypt) Name() string { return "decrypt" }
+
+func (t gcmDecrypt) Apply(data []byte) ([]byte, error) {
+	n := t.aead.NonceSize()
+	if len(data) < n+t.aead.Overhead() {
+		return nil, &DataError{Offset: 0, Err: errors.New("ciphertext too short")}
+	}
+	out, err := t.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, &DataError{Offset: n, Err: err}
+	}
+	return out, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPipelineRoundTrip(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key.hex")
+	if err := os.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	encrypt, decrypt, err := NewAESGCM(key)
+	if err != nil {
+		t.Fatalf("NewAESGCM failed: %v", err)
+	}
+
+	service := NewUserService()
+	for _, tr := range []DataTransform{encrypt, decrypt} {
+		if err := service.RegisterTransform(tr); err != nil {
+			t.Fatalf("RegisterTransform failed: %v", err)
+		}
+	}
+	user, err := service.CreateUser("Test User", "test@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := service.SetPipeline(user.ID, "fill", "compress", "encrypt", "checksum"); err != nil {
+		t.Fatalf("SetPipeline failed: %v", err)
+	}
+
+	var reports []Progress
+	err = service.ProcessUserDataWithProgress(user.ID, func(p Progress) { reports = append(reports, p) })
+	if err != nil {
+		t.Fatalf("ProcessUserData failed: %v", err)
+	}
+	if len(reports) != 4 || reports[3].Stage != "checksum" || reports[3].Total != 4 {
+		t.Errorf("Unexpected progress reports: %+v", reports)
+	}
+
+	if err := service.SetPipeline(user.ID, "verify-checksum", "decrypt", "decompress"); err != nil {
+		t.Fatalf("SetPipeline failed: %v", err)
+	}
+	if err := service.ProcessUserData(user.ID); err != nil {
+		t.Fatalf("ProcessUserData failed: %v", err)
+	}
+	expected, _ := FillPattern{}.Apply(make([]byte, 1000))
+	if !bytes.Equal(user.Data, expected) {
+		t.Error("Data did not survive the encode/decode round trip")
+	}
+}
+
+func TestPipelineProgressCanUseService(t *testing.T) {
+	service := NewUserService()
+	user, err := service.CreateUser("Test User", "test@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	// The callback runs outside the lock, so it can read the service
+	err = service.ProcessUserDataWithProgress(user.ID, func(p Progress) {
+		if _, err := service.GetUser(user.ID); err != nil {
+			t.Errorf("GetUser from progress failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("ProcessUserDataWithProgress failed: %v", err)
+	}
+
+	// A user deleted mid-pipeline keeps their data
+	original := user.Data
+	err = service.ProcessUserDataWithProgress(user.ID, func(p Progress) {
+		if p.Index == 0 {
+			service.DeleteUser(user.ID)
+		}
+	})
+	if err == nil || !sameSlice(user.Data, original) {
+		t.Errorf("Expected the result to be discarded, got %v", err)
+	}
+}
+
+func TestPipelineStageError(t *testing.T) {
+	service := NewUserService()
+	user, err := service.CreateUser("Test User", "test@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if err := service.SetPipeline(user.ID, "missing"); err == nil {
+		t.Error("SetPipeline should reject unknown transforms")
+	}
+	if err := service.SetPipeline(user.ID, "fill", "checksum", "verify-checksum", "verify-checksum"); err != nil {
+		t.Fatalf("SetPipeline failed: %v", err)
+	}
+
+	original := append([]byte(nil), user.Data...)
+	err = service.ProcessUserData(user.ID)
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) {
+		t.Fatalf("Expected StageError, got %v", err)
+	}
+	if stageErr.Index != 3 || stageErr.Stage != "verify-checksum" || stageErr.Offset != 996 {
+		t.Errorf("Unexpected stage error: %+v", stageErr)
+	}
+	if !bytes.Equal(user.Data, original) {
+		t.Error("Failed pipeline should leave user data untouched")
+	}
+}
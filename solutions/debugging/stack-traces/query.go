@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SortField names a User field that ListUsers can order by
+type SortField string
+
+const (
+	SortByID        SortField = "id"
+	SortByName      SortField = "name"
+	SortByEmail     SortField = "email"
+	SortByCreatedAt SortField = "created_at"
+)
+
+// DefaultPageSize is used when a UserQuery does not set a Limit
+const DefaultPageSize = 50
+
+// ErrInvalidCursor is returned when a cursor cannot be decoded or belongs to a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// UserQuery describes which users ListUsers returns and in what order
+type UserQuery struct {
+	NamePrefix     string    // case-insensitive prefix of Name
+	EmailDomain    string    // case-insensitive domain after the @ in Email
+	CreatedAfter   time.Time // inclusive lower bound on CreatedAt, ignored if zero
+	CreatedBefore  time.Time // exclusive upper bound on CreatedAt, ignored if zero
+	IncludeDeleted bool      // also return soft-deleted users
+	SortBy         SortField
+	Descending     bool
+	Limit          int
+	Cursor         string // NextCursor of the previous page, empty for the first page
+}
+
+// UserPage is one page of ListUsers results
+type UserPage struct {
+	Users      []*User
+	NextCursor string // empty when there are no more results
+}
+
+// pageCursor records the sort key of the last user on a page. Because the
+// next page starts strictly after this key (ties broken by ID), users inserted
+// between requests never cause duplicates or skips among existing results.
+type pageCursor struct {
+	SortBy     SortField `json:"s"`
+	Descending bool      `json:"d"`
+	ID         int       `json:"i"`
+	Name       string    `json:"n,omitempty"`
+	Email      string    `json:"e,omitempty"`
+	CreatedAt  time.Time `json:"c,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return c, nil
+}
+
+// compareUsers orders two users by field, breaking ties by ID
+func compareUsers(a, b *User, field SortField) int {
+	var c int
+	switch field {
+	case SortByName:
+		c = strings.Compare(a.Name, b.Name)
+	case SortByEmail:
+		c = strings.Compare(a.Email, b.Email)
+	case SortByCreatedAt:
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if c != 0 {
+		return c
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// matches reports whether a user satisfies the query's filters
+func (q *UserQuery) matches(u *User) bool {
+	if u.DeletedAt != nil && !q.IncludeDeleted {
+		return false
+	}
+	if q.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(u.Name), strings.ToLower(q.NamePrefix)) {
+		return false
+	}
+	if q.EmailDomain != "" {
+		at := strings.LastIndex(u.Email, "@")
+		if at < 0 || !strings.EqualFold(u.Email[at+1:], q.EmailDomain) {
+			return false
+		}
+	}
+	if !q.CreatedAfter.IsZero() && u.CreatedAt.Before(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !u.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// ListUsers returns the page of users matching q
+func (s *UserService) ListUsers(q UserQuery) (*UserPage, error) {
+	switch q.SortBy {
+	case "":
+		q.SortBy = SortByID
+	case SortByID, SortByName, SortByEmail, SortByCreatedAt:
+	default:
+		return nil, fmt.Errorf("unknown sort field %q", q.SortBy)
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+
+	var after *User
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.SortBy != q.SortBy || c.Descending != q.Descending {
+			return nil, fmt.Errorf("%w: cursor was issued for a different sort order", ErrInvalidCursor)
+		}
+		after = &User{ID: c.ID, Name: c.Name, Email: c.Email, CreatedAt: c.CreatedAt}
+	}
+
+	less := func(a, b *User) bool {
+		if q.Descending {
+			return compareUsers(a, b, q.SortBy) > 0
+		}
+		return compareUsers(a, b, q.SortBy) < 0
+	}
+
+	s.mu.RLock()
+	matched := make([]*User, 0)
+	for _, u := range s.users {
+		if q.matches(u) && (after == nil || less(after, u)) {
+			matched = append(matched, u)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	page := &UserPage{Users: matched}
+	if len(matched) > q.Limit {
+		page.Users = matched[:q.Limit]
+		last := page.Users[len(page.Users)-1]
+		page.NextCursor = pageCursor{
+			SortBy:     q.SortBy,
+			Descending: q.Descending,
+			ID:         last.ID,
+			Name:       last.Name,
+			Email:      last.Email,
+			CreatedAt:  last.CreatedAt,
+		}.encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T, n int) *UserService {
+	t.Helper()
+	service := NewUserService()
+	for i := 0; i < n; i++ {
+		domain := "example.com"
+		if i%2 == 1 {
+			domain = "corp.io"
+		}
+		if _, err := service.CreateUser(fmt.Sprintf("User %02d", i), fmt.Sprintf("user%d@%s", i, domain)); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+	}
+	return service
+}
+
+func TestListUsersFilters(t *testing.T) {
+	service := newTestService(t, 10)
+
+	page, err := service.ListUsers(UserQuery{EmailDomain: "CORP.io"})
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if len(page.Users) != 5 {
+		t.Errorf("Expected 5 users in corp.io, got %d", len(page.Users))
+	}
+
+	page, err = service.ListUsers(UserQuery{NamePrefix: "user 0"})
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if len(page.Users) != 10 {
+		t.Errorf("Expected 10 users with prefix 'user 0', got %d", len(page.Users))
+	}
+
+	future := time.Now().Add(time.Hour)
+	page, err = service.ListUsers(UserQuery{CreatedAfter: future})
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	if len(page.Users) != 0 {
+		t.Errorf("Expected no users created after %v, got %d", future, len(page.Users))
+	}
+}
+
+func TestListUsersPaginationStableUnderInserts(t *testing.T) {
+	service := newTestService(t, 10)
+	q := UserQuery{SortBy: SortByName, Descending: true, Limit: 4}
+
+	seen := make(map[int]bool)
+	var names []string
+	for {
+		page, err := service.ListUsers(q)
+		if err != nil {
+			t.Fatalf("ListUsers failed: %v", err)
+		}
+		for _, u := range page.Users {
+			if seen[u.ID] {
+				t.Fatalf("User %d returned twice", u.ID)
+			}
+			seen[u.ID] = true
+			names = append(names, u.Name)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		// An insert that sorts before the cursor must not shift later pages
+		if _, err := service.CreateUser("User 99", fmt.Sprintf("late%d@example.com", len(seen))); err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		q.Cursor = page.NextCursor
+	}
+
+	if len(names) != 10 {
+		t.Fatalf("Expected 10 users across pages, got %d", len(names))
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] < names[i] {
+			t.Errorf("Results not sorted descending: %q before %q", names[i-1], names[i])
+		}
+	}
+}
+
+func TestListUsersRejectsForeignCursor(t *testing.T) {
+	service := newTestService(t, 3)
+	page, err := service.ListUsers(UserQuery{SortBy: SortByEmail, Limit: 1})
+	if err != nil {
+		t.Fatalf("ListUsers failed: %v", err)
+	}
+	_, err = service.ListUsers(UserQuery{SortBy: SortByName, Cursor: page.NextCursor})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestCreateUserIDs(t *testing.T) {
+	service := NewUserService()
+	fixed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return fixed }
+	first, err := service.CreateUser("First", "first@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	second, err := service.CreateUser("Second", "second@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if second.ID <= first.ID || !first.CreatedAt.Equal(fixed) {
+		t.Errorf("Expected increasing IDs from the injected clock, got %d and %d", first.ID, second.ID)
+	}
+
+	// IDs carry on after the highest one imported
+	if _, err := service.ImportJSONL(strings.NewReader(`{"id":500,"name":"Imported","email":"imported@example.com"}`), ImportOptions{}); err != nil {
+		t.Fatalf("ImportJSONL failed: %v", err)
+	}
+	if third, err := service.CreateUser("Third", "third@example.com"); err != nil || third.ID != 501 {
+		t.Errorf("Expected ID 501 after the import, got %v (err %v)", third, err)
+	}
+}
+
+func TestEmailIndex(t *testing.T) {
+	service := NewUserService()
+	user, err := service.CreateUser("Test User", "test@example.com")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	if _, err := service.CreateUser("Other User", "TEST@example.com"); err == nil {
+		t.Error("CreateUser should reject an email that is already in use")
+	}
+
+	if err := service.UpdateUser(user.ID, "Test User", "new@example.com"); err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	if _, err := service.GetUserByEmail("test@example.com"); err == nil {
+		t.Error("Old email should no longer resolve after update")
+	}
+	found, err := service.GetUserByEmail("New@Example.com")
+	if err != nil || found.ID != user.ID {
+		t.Errorf("Expected user %d by new email, got %v (err %v)", user.ID, found, err)
+	}
+
+	if err := service.DeleteUser(user.ID); err != nil {
+		t.Fatalf("DeleteUser failed: %v", err)
+	}
+	if _, err := service.GetUserByEmail("new@example.com"); err == nil {
+		t.Error("Deleted user should not resolve by email")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorPolicy decides what ImportJSONL does with a bad record
+type ErrorPolicy int
+
+const (
+	// SkipInvalid records the error and continues with the next line
+	SkipInvalid ErrorPolicy = iota
+	// AbortOnError stops at the first bad line. Lines before it stay imported.
+	AbortOnError
+)
+
+// ImportOptions configures ImportJSONL
+type ImportOptions struct {
+	OnError ErrorPolicy
+	// MaxLineBytes bounds the memory used per record (default 1 MiB)
+	MaxLineBytes int
+	// MaxErrors bounds how many LineErrors are kept in the report (default 100).
+	// Further failures are still counted in Failed.
+	MaxErrors int
+}
+
+// LineError reports a record that could not be imported
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ImportReport summarizes an ImportJSONL run
+type ImportReport struct {
+	Lines    int
+	Imported int
+	Failed   int
+	Errors   []*LineError
+}
+
+// eachUser calls fn with every user, soft-deleted ones included, sorted by
+// ID. The read lock is held only while fn handles one user, so fn must not
+// call back into s.
+func (s *UserService) eachUser(fn func(*User) error) error {
+	s.mu.RLock()
+	ids := make([]int, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		s.mu.RLock()
+		user, ok := s.users[id]
+		var err error
+		if ok {
+			err = fn(user)
+		}
+		s.mu.RUnlock()
+		if err != nil {
+			return fmt.Errorf("failed to encode user %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// ExportJSONL writes one user per line, sorted by ID. Only a single user is
+// encoded in memory at a time.
+func (s *UserService) ExportJSONL(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := s.eachUser(func(user *User) error { return enc.Encode(user) }); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write users: %w", err)
+	}
+	return nil
+}
+
+// writeUsersFile writes a versioned users file, sorted by ID and with the
+// version first so readUsersFile can stream it back. Only a single user is
+// encoded in memory at a time.
+func writeUsersFile(w io.Writer, version int, users map[int]*User) error {
+	ids := make([]int, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	fmt.Fprintf(bw, `{"version":%d,"users":{`, version)
+	for i, id := range ids {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		fmt.Fprintf(bw, `"%d":`, id)
+		if err := enc.Encode(users[id]); err != nil {
+			return fmt.Errorf("failed to encode user %d: %w", id, err)
+		}
+	}
+	bw.WriteString("}}\n")
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+	return nil
+}
+
+// errNeedsMigration is returned by readUsersFile for files it cannot stream
+var errNeedsMigration = errors.New("users file needs migrating")
+
+// readUsersFile decodes a users file written by writeUsersFile at version,
+// one user at a time. Files at another version or laid out differently,
+// such as those written before versioning, return errNeedsMigration.
+func readUsersFile(r io.Reader, version int) (map[int]*User, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	next := func(want json.Token) bool {
+		tok, err := dec.Token()
+		return err == nil && tok == want
+	}
+	if !next(json.Delim('{')) || !next("version") || !next(json.Number(strconv.Itoa(version))) ||
+		!next("users") || !next(json.Delim('{')) {
+		return nil, errNeedsMigration
+	}
+	users := make(map[int]*User)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id %q", key)
+		}
+		var user User
+		if err := dec.Decode(&user); err != nil {
+			return nil, fmt.Errorf("user %d: %w", id, err)
+		}
+		users[id] = &user
+	}
+	if !next(json.Delim('}')) || !next(json.Delim('}')) {
+		return nil, errNeedsMigration
+	}
+	return users, nil
+}
+
+// ImportJSONL reads one user per line and upserts each by ID. Blank lines are
+// ignored. With AbortOnError the returned error is the first *LineError.
+func (s *UserService) ImportJSONL(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	if opts.MaxLineBytes <= 0 {
+		opts.MaxLineBytes = 1 << 20
+	}
+	if opts.MaxErrors <= 0 {
+		opts.MaxErrors = 100
+	}
+
+	report := &ImportReport{}
+	br := bufio.NewReader(r)
+	for {
+		line, err := readLine(br, opts.MaxLineBytes)
+		if err == io.EOF {
+			return report, nil
+		}
+		report.Lines++
+		if err == nil {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			err = s.importRecord(line)
+		}
+		if err != nil {
+			if errors.Is(err, errReadFailed) {
+				return report, err
+			}
+			lineErr := &LineError{Line: report.Lines, Err: err}
+			report.Failed++
+			if len(report.Errors) < opts.MaxErrors {
+				report.Errors = append(report.Errors, lineErr)
+			}
+			if opts.OnError == AbortOnError {
+				return report, lineErr
+			}
+			continue
+		}
+		report.Imported++
+	}
+}
+
+var errReadFailed = errors.New("failed to read users")
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine returns the next line without its terminator. A line longer than
+// max is consumed and reported as errLineTooLong.
+func readLine(br *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			if line == nil && !tooLong {
+				return nil, io.EOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errReadFailed, err)
+		}
+		if !tooLong {
+			if len(line)+len(chunk) > max {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if tooLong {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", errLineTooLong, max)
+	}
+	if line == nil {
+		line = []byte{}
+	}
+	return line, nil
+}
+
+// importRecord validates a single JSON record and upserts it
+func (s *UserService) importRecord(line []byte) error {
+	var user User
+	if err := json.Unmarshal(line, &user); err != nil {
+		return fmt.Errorf("failed to decode user: %w", err)
+	}
+	if user.ID == 0 {
+		return errors.New("missing user id")
+	}
+	if user.ID < 0 {
+		return fmt.Errorf("invalid user id %d", user.ID)
+	}
+	if strings.TrimSpace(user.Name) == "" {
+		return errors.New("name cannot be empty")
+	}
+	if !strings.Contains(user.Email, "@") {
+		return errors.New("invalid email format")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := normalizeEmail(user.Email)
+	if owner, taken := s.emailIndex[key]; taken && owner != user.ID {
+		return fmt.Errorf("email %s is already in use", user.Email)
+	}
+	if existing, ok := s.users[user.ID]; ok {
+		delete(s.emailIndex, normalizeEmail(existing.Email))
+		s.record(AuditEntry{
+			UserID:   user.ID,
+			Action:   AuditUpdate,
+			OldName:  existing.Name,
+			NewName:  user.Name,
+			OldEmail: existing.Email,
+			NewEmail: user.Email,
+		})
+	} else {
+		s.record(AuditEntry{UserID: user.ID, Action: AuditCreate, NewName: user.Name, NewEmail: user.Email})
+	}
+	s.users[user.ID] = &user
+	s.emailIndex[key] = user.ID
+	s.lastID = max(s.lastID, user.ID)
+	return nil
+}
+
+// ExportJSONLFile streams all users to a JSON Lines file
+func (s *UserService) ExportJSONLFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if err := s.ExportJSONL(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ImportJSONLFile streams users from a JSON Lines file
+func (s *UserService) ImportJSONLFile(filename string, opts ImportOptions) (*ImportReport, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	return s.ImportJSONL(file, opts)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONLRoundTrip(t *testing.T) {
+	service := newTestService(t, 5)
+	var buf bytes.Buffer
+	if err := service.ExportJSONL(&buf); err != nil {
+		t.Fatalf("ExportJSONL failed: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 5 {
+		t.Errorf("Expected 5 lines, got %d", lines)
+	}
+
+	imported := NewUserService()
+	report, err := imported.ImportJSONL(&buf, ImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportJSONL failed: %v", err)
+	}
+	if report.Imported != 5 || report.Failed != 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if _, err := imported.GetUserByEmail("user3@corp.io"); err != nil {
+		t.Errorf("Imported user not indexed by email: %v", err)
+	}
+}
+
+const badJSONL = `{"id":1,"name":"One","email":"one@example.com"}
+not json
+
+{"id":2,"name":"","email":"two@example.com"}
+{"id":3,"name":"Three","email":"three@example.com"}
+{"id":4,"name":"Four","email":"ONE@example.com"}
+{"id":-5,"name":"Five","email":"five@example.com"}
+`
+
+func TestImportJSONLSkipsBadRecords(t *testing.T) {
+	service := NewUserService()
+	report, err := service.ImportJSONL(strings.NewReader(badJSONL), ImportOptions{OnError: SkipInvalid})
+	if err != nil {
+		t.Fatalf("ImportJSONL failed: %v", err)
+	}
+	if report.Imported != 2 || report.Failed != 4 {
+		t.Errorf("Expected 2 imported and 4 failed, got %+v", report)
+	}
+	var lines []int
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if len(lines) != 4 || lines[0] != 2 || lines[1] != 4 || lines[2] != 6 || lines[3] != 7 {
+		t.Errorf("Expected failures on lines [2 4 6 7], got %v", lines)
+	}
+	if user, err := service.CreateUser("Next", "next@example.com"); err != nil || user.ID != 4 {
+		t.Errorf("Expected the next ID to be 4, got %+v (%v)", user, err)
+	}
+}
+
+func TestImportJSONLAbort(t *testing.T) {
+	service := NewUserService()
+	report, err := service.ImportJSONL(strings.NewReader(badJSONL), ImportOptions{OnError: AbortOnError})
+	var lineErr *LineError
+	if !errors.As(err, &lineErr) || lineErr.Line != 2 {
+		t.Fatalf("Expected abort on line 2, got %v", err)
+	}
+	if report.Imported != 1 {
+		t.Errorf("Expected 1 user imported before abort, got %d", report.Imported)
+	}
+}
+
+func TestImportJSONLLineTooLong(t *testing.T) {
+	input := `{"id":1,"name":"` + strings.Repeat("x", 200) + `","email":"a@example.com"}` + "\n" +
+		`{"id":2,"name":"Two","email":"two@example.com"}`
+	service := NewUserService()
+	report, err := service.ImportJSONL(strings.NewReader(input), ImportOptions{MaxLineBytes: 100})
+	if err != nil {
+		t.Fatalf("ImportJSONL failed: %v", err)
+	}
+	if report.Imported != 1 || report.Failed != 1 || !errors.Is(report.Errors[0], errLineTooLong) {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+func TestUsersFileStreams(t *testing.T) {
+	service := newTestService(t, 3)
+	page, err := service.ListUsers(UserQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := page.Users
+	if err := service.DeleteUser(users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeUsersFile(&buf, CurrentSchemaVersion, service.users); err != nil {
+		t.Fatalf("writeUsersFile failed: %v", err)
+	}
+
+	// The file is the versioned document migrations expect
+	doc, err := decodeDocument(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeDocument failed: %v", err)
+	}
+	if _, report, err := DefaultMigrations().Migrate(doc); err != nil || len(report.Steps) != 0 {
+		t.Errorf("Expected a current file, got %+v (%v)", report, err)
+	}
+
+	loaded, err := readUsersFile(&buf, CurrentSchemaVersion)
+	if err != nil {
+		t.Fatalf("readUsersFile failed: %v", err)
+	}
+	if len(loaded) != 3 || loaded[users[0].ID].DeletedAt == nil || loaded[users[1].ID].Email != users[1].Email {
+		t.Errorf("Unexpected users %+v", loaded)
+	}
+	if _, err := readUsersFile(strings.NewReader(`{"1":{"id":1}}`), CurrentSchemaVersion); !errors.Is(err, errNeedsMigration) {
+		t.Errorf("Expected an unversioned file to need migrating, got %v", err)
+	}
+}
+
+func TestSaveToFileIsConsistent(t *testing.T) {
+	service := newTestService(t, 200)
+	first, last := 1, 200
+	a, _ := service.GetUser(first)
+	b, _ := service.GetUser(last)
+	emails := []string{a.Email, b.Email}
+
+	// Swap two emails back and forth through a spare address, so a save
+	// that reads the users at different moments sees one email twice
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			service.UpdateUser(last, "User", "spare@example.com")
+			service.UpdateUser(first, "User", emails[(i+1)%2])
+			service.UpdateUser(last, "User", emails[i%2])
+		}
+	}()
+
+	filename := filepath.Join(t.TempDir(), "users.json")
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if err := service.SaveToFile(filename); err != nil {
+			t.Fatalf("SaveToFile failed: %v", err)
+		}
+		if err := NewUserService().LoadFromFile(filename); err != nil {
+			t.Fatalf("LoadFromFile failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Account errors
+var (
+	ErrAccountExists   = errors.New("account already exists")
+	ErrAccountFrozen   = errors.New("account is frozen")
+	ErrAccountClosed   = errors.New("account is closed")
+	ErrAccountNotEmpty = errors.New("account has a balance or held funds")
+)
+
+// AccountStatus is the state of an account
+type AccountStatus string
+
+const (
+	AccountActive AccountStatus = "active"
+	// AccountFrozen accounts can neither send nor receive funds until unfrozen
+	AccountFrozen AccountStatus = "frozen"
+	// AccountClosed is final
+	AccountClosed AccountStatus = "closed"
+)
+
+// Account describes an account. OpenAccount fills in Status, Balance, Held
+// and OpenedAt.
+type Account struct {
+	ID       string
+	Owner    string
+	Currency string
+	Status   AccountStatus
+	// OverdraftLimit is how far below zero the balance may go
+	OverdraftLimit Money
+	Balance        Money
+	Held           Money
+	OpenedAt       time.Time
+}
+
+// account holds the balance of a single account. The ID, owner, currency,
+// overdraft limit and opening time never change after creation and may be
+// read without holding mu.
+type account struct {
+	id        string
+	owner     string
+	currency  string
+	overdraft Money
+	openedAt  time.Time
+	mu        sync.Mutex
+	status    AccountStatus
+	balance   Money
+	held      Money // funds reserved by authorized but uncaptured transactions
+}
+
+// snapshot describes the account. The caller must hold a.mu.
+func (a *account) snapshot() *Account {
+	return &Account{
+		ID:             a.id,
+		Owner:          a.owner,
+		Currency:       a.currency,
+		Status:         a.status,
+		OverdraftLimit: a.overdraft,
+		Balance:        a.balance,
+		Held:           a.held,
+		OpenedAt:       a.openedAt,
+	}
+}
+
+// account returns the named account if it exists
+func (p *PaymentProcessor) account(id string) (*account, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	acct, ok := p.accounts[id]
+	return acct, ok
+}
+
+// accountOrCreate returns the named account, creating it with a zero balance in currency if needed
+func (p *PaymentProcessor) accountOrCreate(id, currency string) *account {
+	if acct, ok := p.account(id); ok {
+		return acct
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if acct, ok := p.accounts[id]; ok {
+		return acct
+	}
+	acct := newAccount(id, currency)
+	p.accounts[id] = acct
+	return acct
+}
+
+func newAccount(id, currency string) *account {
+	zero := Money{Currency: currency}
+	return &account{id: id, currency: currency, overdraft: zero, status: AccountActive, balance: zero, held: zero}
+}
+
+// lockAccounts locks each distinct non-nil account in ID order, so that any
+// two transfers touching the same accounts acquire them in the same order and
+// cannot deadlock. It returns a function releasing the locks.
+func lockAccounts(accounts ...*account) func() {
+	seen := make(map[*account]bool, len(accounts))
+	ordered := make([]*account, 0, len(accounts))
+	for _, acct := range accounts {
+		if acct != nil && !seen[acct] {
+			seen[acct] = true
+			ordered = append(ordered, acct)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].id < ordered[j].id })
+	for _, acct := range ordered {
+		acct.mu.Lock()
+	}
+	return func() {
+		for i := len(ordered) - 1; i >= 0; i-- {
+			ordered[i].mu.Unlock()
+		}
+	}
+}
+
+// Deposit adds funds from outside the system to an open account. The amount
+// must be positive and in the account's currency.
+func (p *PaymentProcessor) Deposit(accountID string, amount Money) error {
+	return p.observe(p.deposit(accountID, amount))
+}
+
+func (p *PaymentProcessor) deposit(accountID string, amount Money) error {
+	if _, err := MinorUnits(amount.Currency); err != nil {
+		return &TransactionError{Err: ErrUnsupportedCurrency, Amount: amount, To: accountID, Context: "deposit failed"}
+	}
+	if !amount.IsPositive() {
+		return &TransactionError{Err: ErrInvalidAmount, Amount: amount, To: accountID, Context: "deposit failed"}
+	}
+	acct, exists := p.account(accountID)
+	if !exists {
+		return &TransactionError{Err: ErrAccountNotFound, Amount: amount, To: accountID, Context: "deposit failed"}
+	}
+	if acct.currency != amount.Currency {
+		return &TransactionError{Err: ErrCurrencyMismatch, Amount: amount, To: accountID, Context: "deposit failed"}
+	}
+	external := p.accountOrCreate(ExternalAccount(amount.Currency), amount.Currency)
+	unlock := lockAccounts(acct, external)
+	defer unlock()
+	if err := acct.checkActive(); err != nil {
+		return &TransactionError{Err: err, Amount: amount, To: accountID, Context: "deposit failed"}
+	}
+	err := p.post("deposit:"+accountID, []posting{
+		{acct: external, side: Debit, amount: amount},
+		{acct: acct, side: Credit, amount: amount},
+	}, &event{Type: eventDeposit})
+	if err != nil {
+		return &TransactionError{Err: err, Amount: amount, To: accountID, Context: "deposit failed"}
+	}
+	return nil
+}
+
+// checkActive returns ErrAccountFrozen or ErrAccountClosed unless the
+// account is active. The caller must hold a.mu.
+func (a *account) checkActive() error {
+	switch a.status {
+	case AccountFrozen:
+		return ErrAccountFrozen
+	case AccountClosed:
+		return ErrAccountClosed
+	}
+	return nil
+}
+
+// checkAccounts returns a TransactionError if the source or destination of
+// tx is frozen or closed. The caller must hold both accounts' locks.
+func checkAccounts(tx *Transaction, from, to *account) error {
+	if err := from.checkActive(); err != nil {
+		return newTransactionError(tx, err, "source account unavailable")
+	}
+	if err := to.checkActive(); err != nil {
+		return newTransactionError(tx, err, "destination account unavailable")
+	}
+	return nil
+}
+
+// OpenAccount creates an active account. IDs containing a colon are
+// reserved for the system's own accounts.
+func (p *PaymentProcessor) OpenAccount(acct *Account) error {
+	return p.observe(p.openAccount(acct))
+}
+
+func (p *PaymentProcessor) openAccount(acct *Account) error {
+	fail := func(err error) error {
+		return &TransactionError{Err: err, From: acct.ID, Context: "account open failed"}
+	}
+	if acct.ID == "" || strings.Contains(acct.ID, ":") {
+		return fail(ErrInvalidAccount)
+	}
+	if _, err := MinorUnits(acct.Currency); err != nil {
+		return fail(ErrUnsupportedCurrency)
+	}
+	overdraft := acct.OverdraftLimit
+	if overdraft.Currency == "" && overdraft.IsZero() {
+		overdraft.Currency = acct.Currency
+	}
+	if overdraft.Currency != acct.Currency {
+		return fail(ErrCurrencyMismatch)
+	}
+	if overdraft.IsNegative() {
+		return fail(ErrInvalidAmount)
+	}
+
+	opened := newAccount(acct.ID, acct.Currency)
+	opened.owner, opened.overdraft, opened.openedAt = acct.Owner, overdraft, p.now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.accounts[acct.ID]; exists {
+		return fail(ErrAccountExists)
+	}
+	// p.mu orders account creation in the log before any use of the account
+	if err := p.logEvent(&event{Type: eventAccount, Account: opened.record()}); err != nil {
+		return fail(err)
+	}
+	p.accounts[acct.ID] = opened
+	*acct = *opened.snapshot()
+	return nil
+}
+
+// GetAccount returns a snapshot of an account
+func (p *PaymentProcessor) GetAccount(id string) (*Account, error) {
+	acct, exists := p.account(id)
+	if !exists {
+		return nil, p.observe(&TransactionError{Err: ErrAccountNotFound, From: id, Context: "account lookup failed"})
+	}
+	acct.mu.Lock()
+	defer acct.mu.Unlock()
+	return acct.snapshot(), nil
+}
+
+// FreezeAccount stops an account from sending or receiving funds.
+// Authorized transactions can still be voided but not captured.
+func (p *PaymentProcessor) FreezeAccount(id string) error {
+	return p.observe(p.setAccountStatus(id, AccountFrozen, "account freeze failed"))
+}
+
+// UnfreezeAccount makes a frozen account active again
+func (p *PaymentProcessor) UnfreezeAccount(id string) error {
+	return p.observe(p.setAccountStatus(id, AccountActive, "account unfreeze failed"))
+}
+
+// CloseAccount closes an account for good. It must have a zero balance and
+// no held funds.
+func (p *PaymentProcessor) CloseAccount(id string) error {
+	return p.observe(p.setAccountStatus(id, AccountClosed, "account close failed"))
+}
+
+func (p *PaymentProcessor) setAccountStatus(id string, status AccountStatus, context string) error {
+	acct, exists := p.account(id)
+	if !exists || strings.Contains(id, ":") {
+		return &TransactionError{Err: ErrAccountNotFound, From: id, Context: context}
+	}
+	acct.mu.Lock()
+	defer acct.mu.Unlock()
+	if acct.status == AccountClosed {
+		return &TransactionError{Err: ErrAccountClosed, From: id, Context: context}
+	}
+	if status == AccountClosed && (!acct.balance.IsZero() || !acct.held.IsZero()) {
+		return &TransactionError{Err: ErrAccountNotEmpty, Amount: acct.balance, From: id, Context: context}
+	}
+	record := acct.record()
+	record.Status = status
+	if err := p.logEvent(&event{Type: eventAccount, Account: record}); err != nil {
+		return &TransactionError{Err: err, From: id, Context: context}
+	}
+	acct.status = status
+	return nil
+}
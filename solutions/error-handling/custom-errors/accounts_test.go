@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// openAccounts opens empty accounts in currency
+func openAccounts(t *testing.T, p *PaymentProcessor, currency string, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := p.OpenAccount(&Account{ID: id, Currency: currency}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenAccount(t *testing.T) {
+	processor := NewPaymentProcessor()
+	acct := &Account{ID: "alice", Owner: "Alice", Currency: "USD"}
+	if err := processor.OpenAccount(acct); err != nil {
+		t.Fatal(err)
+	}
+	if acct.Status != AccountActive || acct.OpenedAt.IsZero() || acct.OverdraftLimit != MustParseMoney("0.00", "USD") {
+		t.Errorf("Unexpected account %+v", acct)
+	}
+
+	tests := []struct {
+		acct *Account
+		want error
+	}{
+		{&Account{ID: "alice", Currency: "USD"}, ErrAccountExists},
+		{&Account{ID: "", Currency: "USD"}, ErrInvalidAccount},
+		{&Account{ID: "fees:USD", Currency: "USD"}, ErrInvalidAccount},
+		{&Account{ID: "bob", Currency: "XXX"}, ErrUnsupportedCurrency},
+		{&Account{ID: "bob", Currency: "USD", OverdraftLimit: MustParseMoney("5.00", "EUR")}, ErrCurrencyMismatch},
+		{&Account{ID: "bob", Currency: "USD", OverdraftLimit: MustParseMoney("-5.00", "USD")}, ErrInvalidAmount},
+	}
+	for _, tt := range tests {
+		if err := processor.OpenAccount(tt.acct); !errors.Is(err, tt.want) {
+			t.Errorf("Opening %q: expected %v, got %v", tt.acct.ID, tt.want, err)
+		}
+	}
+}
+
+func TestDeposit(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		account string
+		amount  Money
+		want    error
+	}{
+		{"nobody", MustParseMoney("10.00", "USD"), ErrAccountNotFound},
+		{"a", MustParseMoney("0.00", "USD"), ErrInvalidAmount},
+		{"a", MustParseMoney("-1.00", "USD"), ErrInvalidAmount},
+		{"a", MustParseMoney("1.00", "EUR"), ErrCurrencyMismatch},
+	}
+	for _, tt := range tests {
+		if err := processor.Deposit(tt.account, tt.amount); !errors.Is(err, tt.want) {
+			t.Errorf("Depositing %s to %q: expected %v, got %v", tt.amount, tt.account, tt.want, err)
+		}
+	}
+	if _, err := processor.GetAccount("nobody"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("A failed deposit must not open the account, got %v", err)
+	}
+	if balance, _ := processor.GetBalance("a"); balance != MustParseMoney("10.00", "USD") {
+		t.Errorf("Expected 10.00 USD, got %s", balance)
+	}
+}
+
+func TestFrozenAndClosedAccounts(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	pay := func(id, from, to string) error {
+		return processor.ProcessTransaction(&Transaction{ID: id, Amount: MustParseMoney("1.00", "USD"), From: from, To: to})
+	}
+
+	if err := pay("tx1", "a", "nobody"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Expected an unknown destination to be rejected, got %v", err)
+	}
+	if _, err := processor.GetAccount("nobody"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("The destination should not have been created, got %v", err)
+	}
+
+	if err := processor.Authorize(&Transaction{ID: "held", Amount: MustParseMoney("2.00", "USD"), From: "a", To: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := processor.FreezeAccount("b"); err != nil {
+		t.Fatal(err)
+	}
+	var txErr *TransactionError
+	if err := pay("tx2", "a", "b"); !errors.As(err, &txErr) || !errors.Is(err, ErrAccountFrozen) || txErr.Context != "destination account unavailable" {
+		t.Errorf("Expected the frozen destination to be rejected, got %v", err)
+	}
+	if err := pay("tx3", "b", "a"); !errors.As(err, &txErr) || !errors.Is(err, ErrAccountFrozen) || txErr.Context != "source account unavailable" {
+		t.Errorf("Expected the frozen source to be rejected, got %v", err)
+	}
+	if err := processor.Capture("held"); !errors.Is(err, ErrAccountFrozen) {
+		t.Errorf("Expected a freeze to stop an earlier authorization, got %v", err)
+	}
+	if err := processor.Deposit("b", MustParseMoney("1.00", "USD")); !errors.Is(err, ErrAccountFrozen) {
+		t.Errorf("Expected deposits to a frozen account to fail, got %v", err)
+	}
+
+	if err := processor.UnfreezeAccount("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processor.Capture("held"); err != nil {
+		t.Fatalf("Capture after unfreezing failed: %v", err)
+	}
+	if err := processor.CloseAccount("b"); !errors.Is(err, ErrAccountNotEmpty) {
+		t.Errorf("Expected closing a funded account to fail, got %v", err)
+	}
+	if err := pay("tx4", "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pay("tx5", "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := processor.CloseAccount("b"); err != nil {
+		t.Fatalf("Closing an empty account failed: %v", err)
+	}
+	if err := pay("tx6", "a", "b"); !errors.Is(err, ErrAccountClosed) {
+		t.Errorf("Expected the closed destination to be rejected, got %v", err)
+	}
+	if err := processor.UnfreezeAccount("b"); !errors.Is(err, ErrAccountClosed) {
+		t.Errorf("Expected closing to be final, got %v", err)
+	}
+}
+
+func TestOverdraftLimit(t *testing.T) {
+	processor := NewPaymentProcessor()
+	if err := processor.OpenAccount(&Account{ID: "a", Currency: "USD", OverdraftLimit: MustParseMoney("50.00", "USD")}); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, processor, "USD", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processor.ProcessTransaction(&Transaction{ID: "tx1", Amount: MustParseMoney("60.00", "USD"), From: "a", To: "b"}); err != nil {
+		t.Fatalf("Expected the overdraft to cover the payment, got %v", err)
+	}
+	if balance, _ := processor.GetBalance("a"); balance != MustParseMoney("-50.00", "USD") {
+		t.Errorf("Expected -50.00, got %s", balance)
+	}
+	if err := processor.ProcessTransaction(&Transaction{ID: "tx2", Amount: MustParseMoney("0.01", "USD"), From: "a", To: "b"}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Expected the overdraft limit to be enforced, got %v", err)
+	}
+	if _, err := processor.TrialBalance(); err != nil {
+		t.Errorf("Ledger unbalanced: %v", err)
+	}
+}
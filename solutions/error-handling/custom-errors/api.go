@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidRequest is the cause of malformed or incomplete request bodies
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrRouteNotFound is returned for paths the API does not serve
+	ErrRouteNotFound = errors.New("route not found")
+	// ErrMethodNotAllowed is returned for methods a path does not support
+	ErrMethodNotAllowed = errors.New("method not allowed")
+)
+
+// maxRequestBody caps the size of API request bodies
+const maxRequestBody = 1 << 20
+
+// problem is an RFC 9457 problem details body. Code and the fields after
+// it are extensions carrying the TransactionError.
+type problem struct {
+	Type     string           `json:"type"`
+	Title    string           `json:"title"`
+	Status   int              `json:"status"`
+	Detail   string           `json:"detail"`
+	Instance string           `json:"instance,omitempty"`
+	Code     string           `json:"code"`
+	Context  string           `json:"context,omitempty"`
+	TxID     string           `json:"tx_id,omitempty"`
+	RuleID   string           `json:"rule_id,omitempty"`
+	Fields   []fieldErrorJSON `json:"fields,omitempty"`
+}
+
+// writeProblem reports err as problem details with the status of the
+// sentinel it wraps
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	status := HTTPStatus(err)
+	code := ErrorCode(err)
+	p := problem{
+		Type:     "urn:payments:error:" + code,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   err.Error(),
+		Instance: r.URL.Path,
+		Code:     code,
+	}
+	if sentinel := sentinelForCode(code); sentinel != nil {
+		p.Title = sentinel.Error()
+	}
+	var txErr *TransactionError
+	if errors.As(err, &txErr) {
+		p.Context, p.TxID, p.RuleID = txErr.Context, txErr.TxID, txErr.RuleID
+	}
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		for _, fe := range validation.Errors {
+			p.Fields = append(p.Fields, fieldErrorJSON{Field: fe.Field, Code: ErrorCode(fe.Err), Message: fe.Err.Error()})
+		}
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// API serves a PaymentProcessor over HTTP with JSON bodies:
+//
+//	POST /transactions                 process a transaction
+//	GET  /transactions                 search transactions
+//	GET  /transactions/{id}            get a transaction
+//	GET  /accounts/{id}/balance        get an account's balance
+//
+// Errors are problem details (RFC 9457) with the stable error code. POST
+// /transactions honours the Idempotency-Key header.
+type API struct {
+	processor *PaymentProcessor
+	mux       *http.ServeMux
+}
+
+// NewAPI creates an API for p
+func NewAPI(p *PaymentProcessor) *API {
+	api := &API{processor: p, mux: http.NewServeMux()}
+	api.mux.HandleFunc("POST /transactions", api.createTransaction)
+	api.mux.HandleFunc("GET /transactions", api.listTransactions)
+	api.mux.HandleFunc("GET /transactions/{id}", api.getTransaction)
+	api.mux.HandleFunc("GET /accounts/{id}/balance", api.getBalance)
+	return api
+}
+
+// ServeHTTP routes r. Requests no route matches get the mux's own answer, a
+// 404 or a 405 with an Allow header, with its body replaced by a problem.
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := api.mux.Handler(r); pattern != "" {
+		api.mux.ServeHTTP(w, r)
+		return
+	}
+	rec := &routeRecorder{ResponseWriter: w}
+	api.mux.ServeHTTP(rec, r)
+	err := fmt.Errorf("%w: %s", ErrRouteNotFound, r.URL.Path)
+	if rec.status == http.StatusMethodNotAllowed {
+		err = fmt.Errorf("%w: %s %s", ErrMethodNotAllowed, r.Method, r.URL.Path)
+	}
+	writeProblem(w, r, &TransactionError{Err: err, Context: "request routing failed"})
+}
+
+// routeRecorder captures the status the mux gives an unrouted request. Its
+// headers, such as Allow, go to the response; its plain-text body does not.
+type routeRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *routeRecorder) WriteHeader(status int) { r.status = status }
+
+func (r *routeRecorder) Write(b []byte) (int, error) { return len(b), nil }
+
+// transactionRequest is the body of POST /transactions
+type transactionRequest struct {
+	ID     string    `json:"id"`
+	Amount moneyJSON `json:"amount"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+}
+
+// parseAmount decodes a wire amount, recording problems in v under field
+func parseAmount(m moneyJSON, field string, v *ValidationError) (Money, bool) {
+	if _, err := MinorUnits(m.Currency); err != nil {
+		v.add(field+".currency", ErrUnsupportedCurrency)
+		return Money{}, false
+	}
+	amount, err := ParseMoney(m.Amount, m.Currency)
+	if err != nil {
+		v.add(field+".amount", ErrInvalidAmount)
+		return Money{}, false
+	}
+	return amount, true
+}
+
+// decodeTransaction reads and validates a transaction request, reporting
+// every invalid field at once. The body must be a single JSON object.
+func decodeTransaction(w http.ResponseWriter, r *http.Request) (*Transaction, error) {
+	var req transactionRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, &TransactionError{Err: fmt.Errorf("%w: %v", ErrInvalidRequest, err), Context: "request decoding failed"}
+	}
+	var extra json.RawMessage
+	if err := dec.Decode(&extra); err != io.EOF {
+		return nil, &TransactionError{Err: fmt.Errorf("%w: unexpected data after the body", ErrInvalidRequest), Context: "request decoding failed"}
+	}
+	tx := &Transaction{ID: req.ID, From: req.From, To: req.To, IdempotencyKey: r.Header.Get("Idempotency-Key")}
+
+	v := &ValidationError{}
+	if req.ID == "" {
+		v.add("id", ErrInvalidRequest)
+	}
+	amount, parsed := parseAmount(req.Amount, "amount", v)
+	tx.Amount = amount
+	var rest *ValidationError
+	if errors.As(tx.Validate(), &rest) {
+		for _, fe := range rest.Errors {
+			if parsed || !strings.HasPrefix(fe.Field, "amount.") {
+				v.Errors = append(v.Errors, fe)
+			}
+		}
+	}
+	if err := v.errOrNil(); err != nil {
+		return nil, newTransactionError(tx, err, "transaction validation failed")
+	}
+	return tx, nil
+}
+
+func (api *API) createTransaction(w http.ResponseWriter, r *http.Request) {
+	tx, err := decodeTransaction(w, r)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	err = api.processor.ProcessTransactionContext(r.Context(), tx)
+	status := http.StatusCreated
+	switch {
+	case errors.Is(err, ErrReviewRequired):
+		// Held, not refused: the transaction exists and awaits review
+		status = http.StatusAccepted
+	case err != nil:
+		writeProblem(w, r, err)
+		return
+	}
+	// Reply with the stored transaction, which an idempotent replay does
+	// not copy into tx in full
+	if stored, err := api.processor.GetTransaction(tx.ID); err == nil {
+		tx = stored
+	}
+	w.Header().Set("Location", "/transactions/"+url.PathEscape(tx.ID))
+	writeJSON(w, status, newTransactionJSON(*tx))
+}
+
+func (api *API) getTransaction(w http.ResponseWriter, r *http.Request) {
+	tx, err := api.processor.GetTransaction(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTransactionJSON(*tx))
+}
+
+// balanceJSON is the body of GET /accounts/{id}/balance
+type balanceJSON struct {
+	Account string        `json:"account"`
+	Status  AccountStatus `json:"status"`
+	Balance Money         `json:"balance"`
+	Held    Money         `json:"held"`
+}
+
+func (api *API) getBalance(w http.ResponseWriter, r *http.Request) {
+	acct, err := api.processor.GetAccount(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, balanceJSON{Account: acct.ID, Status: acct.Status, Balance: acct.Balance, Held: acct.Held})
+}
+
+// pageJSON is the body of GET /transactions
+type pageJSON struct {
+	Transactions []transactionJSON `json:"transactions"`
+	Total        int               `json:"total"`
+	NextOffset   int               `json:"next_offset,omitempty"`
+}
+
+// parseQuery reads a TransactionQuery from URL parameters: account, since
+// and until (RFC 3339), status (comma-separated), currency, min_amount and
+// max_amount (in currency), sort, order (asc or desc), offset and limit
+func parseQuery(values url.Values) (TransactionQuery, error) {
+	q := TransactionQuery{
+		Account:  values.Get("account"),
+		Currency: values.Get("currency"),
+		SortBy:   SortField(values.Get("sort")),
+	}
+	v := &ValidationError{}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if s := values.Get(bound.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				v.add(bound.name, ErrInvalidQuery)
+			}
+			*bound.t = t
+		}
+	}
+	if s := values.Get("status"); s != "" {
+		for _, status := range strings.Split(s, ",") {
+			q.Statuses = append(q.Statuses, TransactionStatus(status))
+		}
+	}
+	for _, bound := range []struct {
+		name string
+		m    *Money
+	}{{"min_amount", &q.MinAmount}, {"max_amount", &q.MaxAmount}} {
+		if s := values.Get(bound.name); s != "" {
+			if q.Currency == "" {
+				v.add(bound.name, ErrCurrencyMismatch)
+				continue
+			}
+			*bound.m, _ = parseAmount(moneyJSON{Amount: s, Currency: q.Currency}, bound.name, v)
+		}
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		v.add("order", ErrInvalidQuery)
+	}
+	for _, n := range []struct {
+		name string
+		i    *int
+	}{{"offset", &q.Offset}, {"limit", &q.Limit}} {
+		if s := values.Get(n.name); s != "" {
+			i, err := strconv.Atoi(s)
+			if err != nil {
+				v.add(n.name, ErrInvalidQuery)
+			}
+			*n.i = i
+		}
+	}
+	return q, v.errOrNil()
+}
+
+func (api *API) listTransactions(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, &TransactionError{Err: err, From: q.Account, Context: "transaction search failed"})
+		return
+	}
+	page, err := api.processor.SearchTransactions(q)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+	body := pageJSON{Transactions: make([]transactionJSON, len(page.Transactions)), Total: page.Total, NextOffset: page.NextOffset}
+	for i, tx := range page.Transactions {
+		body.Transactions[i] = newTransactionJSON(tx)
+	}
+	writeJSON(w, http.StatusOK, body)
+}
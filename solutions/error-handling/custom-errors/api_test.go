@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAPIServer(t *testing.T, p *PaymentProcessor) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(NewAPI(p))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// do sends a request and decodes the JSON response into out, returning the
+// response with its body consumed
+func do(t *testing.T, method, url, body string, header map[string]string, out any) *http.Response {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, url, err)
+		}
+	}
+	return resp
+}
+
+func transferBody(id, amount, from, to string) string {
+	return `{"id": "` + id + `", "amount": {"amount": "` + amount + `", "currency": "USD"}, "from": "` + from + `", "to": "` + to + `"}`
+}
+
+func expectProblem(t *testing.T, resp *http.Response, prob problem, status int, code string) {
+	t.Helper()
+	if resp.StatusCode != status || prob.Status != status || prob.Code != code {
+		t.Errorf("Expected %d %s, got %d %+v", status, code, resp.StatusCode, prob)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Expected a problem content type, got %q", ct)
+	}
+	if prob.Type != "urn:payments:error:"+code || prob.Title == "" || prob.Detail == "" {
+		t.Errorf("Incomplete problem %+v", prob)
+	}
+}
+
+func TestAPICreateAndGetTransaction(t *testing.T) {
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "a", "b")
+	if err := p.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	srv := newAPIServer(t, p)
+
+	var created transactionJSON
+	resp := do(t, "POST", srv.URL+"/transactions", transferBody("tx1", "40.00", "a", "b"), nil, &created)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/transactions/tx1" {
+		t.Fatalf("Expected 201 with a location, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if created.ID != "tx1" || created.Status != StatusCaptured || created.Amount != MustParseMoney("40.00", "USD") {
+		t.Errorf("Unexpected transaction %+v", created)
+	}
+
+	var got transactionJSON
+	if resp := do(t, "GET", srv.URL+"/transactions/tx1", "", nil, &got); resp.StatusCode != http.StatusOK || got.ID != "tx1" || got.Status != StatusCaptured {
+		t.Errorf("Expected the transaction back, got %d %+v", resp.StatusCode, got)
+	}
+
+	var prob problem
+	resp = do(t, "GET", srv.URL+"/transactions/nope", "", nil, &prob)
+	expectProblem(t, resp, prob, http.StatusNotFound, "PAY_TRANSACTION_NOT_FOUND")
+	if prob.Instance != "/transactions/nope" {
+		t.Errorf("Expected the path as instance, got %q", prob.Instance)
+	}
+
+	var balance balanceJSON
+	resp = do(t, "GET", srv.URL+"/accounts/b/balance", "", nil, &balance)
+	if resp.StatusCode != http.StatusOK || balance.Account != "b" || balance.Balance != MustParseMoney("40.00", "USD") || balance.Status != AccountActive {
+		t.Errorf("Unexpected balance %d %+v", resp.StatusCode, balance)
+	}
+	prob = problem{}
+	resp = do(t, "GET", srv.URL+"/accounts/nobody/balance", "", nil, &prob)
+	expectProblem(t, resp, prob, http.StatusNotFound, "PAY_ACCOUNT_NOT_FOUND")
+}
+
+func TestAPIErrorMapping(t *testing.T) {
+	p, _ := newRulesProcessor(t)
+	openAccounts(t, p, "USD", "empty")
+	if err := p.FreezeAccount("b"); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, p, "USD", "c", "shut")
+	if err := p.CloseAccount("shut"); err != nil {
+		t.Fatal(err)
+	}
+	srv := newAPIServer(t, p)
+	if resp := do(t, "POST", srv.URL+"/transactions", transferBody("ok", "1.00", "a", "c"), nil, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+		ruleID string
+	}{
+		{"insufficient funds", transferBody("poor", "1.00", "empty", "c"), 422, "PAY_INSUFFICIENT_FUNDS", ""},
+		{"duplicate", transferBody("ok", "1.00", "a", "c"), 409, "PAY_DUPLICATE_TRANSACTION", ""},
+		{"frozen", transferBody("cold", "1.00", "a", "b"), 403, "PAY_ACCOUNT_FROZEN", ""},
+		{"closed", transferBody("gone", "1.00", "a", "shut"), 403, "PAY_ACCOUNT_CLOSED", ""},
+		{"unknown account", transferBody("lost", "1.00", "a", "nobody"), 404, "PAY_ACCOUNT_NOT_FOUND", ""},
+		{"denied", transferBody("big", "1000.01", "a", "c"), 403, "PAY_TRANSACTION_DENIED", "max-single"},
+		{"malformed", `{"id": "x",`, 400, "PAY_INVALID_REQUEST", ""},
+		{"unknown field", `{"id": "x", "memo": "hi"}`, 400, "PAY_INVALID_REQUEST", ""},
+		{"trailing data", transferBody("twice", "1.00", "a", "c") + `{"id": "again"}`, 400, "PAY_INVALID_REQUEST", ""},
+		{"too large", `{"id": "` + strings.Repeat("x", maxRequestBody) + `"}`, 400, "PAY_INVALID_REQUEST", ""},
+	}
+	for _, tt := range tests {
+		var prob problem
+		resp := do(t, "POST", srv.URL+"/transactions", tt.body, nil, &prob)
+		expectProblem(t, resp, prob, tt.status, tt.code)
+		if prob.RuleID != tt.ruleID || prob.Context == "" {
+			t.Errorf("%s: expected rule %q and a context, got %+v", tt.name, tt.ruleID, prob)
+		}
+	}
+
+	if _, err := p.GetTransaction("twice"); !errors.Is(err, ErrTransactionNotFound) {
+		t.Errorf("A body with trailing data must not be processed, got %v", err)
+	}
+
+	var prob problem
+	resp := do(t, "DELETE", srv.URL+"/transactions/ok", "", nil, &prob)
+	expectProblem(t, resp, prob, http.StatusMethodNotAllowed, "PAY_METHOD_NOT_ALLOWED")
+	if allow := resp.Header.Get("Allow"); !strings.Contains(allow, "GET") {
+		t.Errorf("Expected an Allow header listing GET, got %q", allow)
+	}
+	prob = problem{}
+	resp = do(t, "GET", srv.URL+"/nowhere", "", nil, &prob)
+	expectProblem(t, resp, prob, http.StatusNotFound, "PAY_ROUTE_NOT_FOUND")
+}
+
+func TestAPIValidationProblem(t *testing.T) {
+	srv := newAPIServer(t, NewPaymentProcessor())
+	var prob problem
+	resp := do(t, "POST", srv.URL+"/transactions", `{"amount": {"amount": "-1.00", "currency": "USD"}, "from": "a"}`, nil, &prob)
+	expectProblem(t, resp, prob, http.StatusBadRequest, "PAY_INVALID_AMOUNT")
+	want := map[string]string{"id": "PAY_INVALID_REQUEST", "amount.amount": "PAY_INVALID_AMOUNT", "to": "PAY_INVALID_ACCOUNT"}
+	if len(prob.Fields) != len(want) {
+		t.Fatalf("Expected %d field errors, got %+v", len(want), prob.Fields)
+	}
+	for _, f := range prob.Fields {
+		if want[f.Field] != f.Code || f.Message == "" {
+			t.Errorf("Unexpected field error %+v", f)
+		}
+	}
+
+	prob = problem{}
+	resp = do(t, "POST", srv.URL+"/transactions", `{"id": "x", "amount": {"amount": "1.001", "currency": "XXX"}, "from": "a", "to": "b"}`, nil, &prob)
+	expectProblem(t, resp, prob, http.StatusBadRequest, "PAY_UNSUPPORTED_CURRENCY")
+	if len(prob.Fields) != 1 || prob.Fields[0].Field != "amount.currency" {
+		t.Errorf("Expected only the currency to be reported, got %+v", prob.Fields)
+	}
+}
+
+func TestAPIIdempotencyKey(t *testing.T) {
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "a", "b")
+	if err := p.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	srv := newAPIServer(t, p)
+	key := map[string]string{"Idempotency-Key": "k1"}
+
+	for i := 0; i < 2; i++ {
+		var created transactionJSON
+		resp := do(t, "POST", srv.URL+"/transactions", transferBody("tx1", "10.00", "a", "b"), key, &created)
+		if resp.StatusCode != http.StatusCreated || created.Status != StatusCaptured {
+			t.Fatalf("Attempt %d: expected 201, got %d %+v", i+1, resp.StatusCode, created)
+		}
+	}
+	if balance, _ := p.GetBalance("a"); balance != MustParseMoney("90.00", "USD") {
+		t.Errorf("Expected a single debit, got balance %s", balance)
+	}
+
+	var prob problem
+	resp := do(t, "POST", srv.URL+"/transactions", transferBody("tx2", "20.00", "a", "b"), key, &prob)
+	expectProblem(t, resp, prob, http.StatusUnprocessableEntity, "PAY_IDEMPOTENCY_KEY_REUSED")
+}
+
+func TestAPIReviewAccepted(t *testing.T) {
+	p, _ := newRulesProcessor(t)
+	srv := newAPIServer(t, p)
+	for i, amount := range []string{"10.00", "10.00", "40.00"} {
+		var tx transactionJSON
+		resp := do(t, "POST", srv.URL+"/transactions", transferBody("tx"+string(rune('1'+i)), amount, "a", "b"), nil, &tx)
+		if i < 2 {
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("Expected 201, got %d", resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusAccepted || tx.Status != StatusAuthorized || tx.ReviewRule != "unusual" {
+			t.Errorf("Expected the transaction to be held, got %d %+v", resp.StatusCode, tx)
+		}
+	}
+}
+
+func TestAPIListTransactions(t *testing.T) {
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "a", "b", "c")
+	if err := p.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	srv := newAPIServer(t, p)
+	for i, to := range []string{"b", "c", "b"} {
+		body := transferBody("tx"+string(rune('1'+i)), "1"+string(rune('0'+i))+".00", "a", to)
+		if resp := do(t, "POST", srv.URL+"/transactions", body, nil, nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d", resp.StatusCode)
+		}
+	}
+
+	var page pageJSON
+	resp := do(t, "GET", srv.URL+"/transactions?account=b&sort=amount&order=desc&limit=1", "", nil, &page)
+	if resp.StatusCode != http.StatusOK || page.Total != 2 || page.NextOffset != 1 || len(page.Transactions) != 1 || page.Transactions[0].ID != "tx3" {
+		t.Fatalf("Unexpected first page %d %+v", resp.StatusCode, page)
+	}
+	page = pageJSON{}
+	do(t, "GET", srv.URL+"/transactions?account=b&sort=amount&order=desc&limit=1&offset=1", "", nil, &page)
+	if page.NextOffset != 0 || len(page.Transactions) != 1 || page.Transactions[0].ID != "tx1" {
+		t.Errorf("Unexpected last page %+v", page)
+	}
+	page = pageJSON{}
+	do(t, "GET", srv.URL+"/transactions?currency=USD&min_amount=11&status=captured,refunded", "", nil, &page)
+	if page.Total != 2 {
+		t.Errorf("Expected 2 transactions of at least 11.00, got %+v", page)
+	}
+
+	var prob problem
+	resp = do(t, "GET", srv.URL+"/transactions?limit=x&order=up&sort=color", "", nil, &prob)
+	expectProblem(t, resp, prob, http.StatusBadRequest, "PAY_INVALID_QUERY")
+	if len(prob.Fields) != 2 {
+		t.Errorf("Expected the malformed parameters to be reported, got %+v", prob.Fields)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrBatchRolledBack marks transactions undone because another transaction
+// in the same atomic batch failed
+var ErrBatchRolledBack = errors.New("batch rolled back")
+
+// BatchMode selects how ProcessBatch handles failures
+type BatchMode int
+
+const (
+	// BatchBestEffort processes every transaction on its own
+	BatchBestEffort BatchMode = iota
+	// BatchAtomic processes all transactions or none of them
+	BatchAtomic
+)
+
+func (m BatchMode) String() string {
+	if m == BatchAtomic {
+		return "atomic"
+	}
+	return "best-effort"
+}
+
+// BatchItem is the outcome of one transaction in a batch
+type BatchItem struct {
+	Index  int
+	TxID   string
+	Status TransactionStatus
+	Err    error
+}
+
+// BatchResult summarizes a batch. Totals sums the amounts of the
+// transactions that went through and FailedTotals those that did not, by
+// transaction currency.
+type BatchResult struct {
+	Mode         BatchMode
+	Items        []BatchItem
+	Succeeded    int
+	Failed       int
+	RolledBack   bool
+	Totals       map[string]Money
+	FailedTotals map[string]Money
+}
+
+// BatchError is returned when any transaction in a batch failed. errors.Is
+// matches the errors of the failed items, and ErrBatchRolledBack when an
+// atomic batch was undone.
+type BatchError struct {
+	Mode       BatchMode
+	Failed     int
+	Total      int
+	RolledBack bool
+	Errs       []error
+}
+
+func (e *BatchError) Error() string {
+	if e.RolledBack {
+		return fmt.Sprintf("%s batch rolled back: %d of %d transactions failed", e.Mode, e.Failed, e.Total)
+	}
+	return fmt.Sprintf("%s batch: %d of %d transactions failed", e.Mode, e.Failed, e.Total)
+}
+
+func (e *BatchError) Unwrap() []error {
+	if e.RolledBack {
+		return append([]error{ErrBatchRolledBack}, e.Errs...)
+	}
+	return e.Errs
+}
+
+// ProcessBatch processes txs in order. In best-effort mode each transaction
+// is processed like ProcessTransactionContext and the others are unaffected
+// by its failure. In atomic mode every transaction is authorized first and
+// none is captured unless all of them are authorized and accepted by the
+// payment network; otherwise each is voided. If moving the funds fails after
+// that, the transactions already captured are refunded in full, so the
+// ledger shows both. The transactions of a rolled-back batch end up
+// StatusRolledBack and keep their IDs, so a corrected batch needs new ones.
+// Atomic batches ignore idempotency keys and treat a transaction held for
+// review as failed.
+//
+// The result is always returned; the error is a *BatchError if any
+// transaction failed.
+func (p *PaymentProcessor) ProcessBatch(ctx context.Context, txs []*Transaction, mode BatchMode) (*BatchResult, error) {
+	errs := make([]error, len(txs))
+	rolledBack := false
+	if mode == BatchAtomic {
+		rolledBack = p.processAtomic(ctx, txs, errs)
+	} else {
+		for i, tx := range txs {
+			if err := ctx.Err(); err != nil {
+				errs[i] = p.observe(newTransactionError(tx, err, "batch cancelled"))
+				continue
+			}
+			errs[i] = p.ProcessTransactionContext(ctx, tx)
+		}
+	}
+
+	result := &BatchResult{
+		Mode:         mode,
+		Items:        make([]BatchItem, len(txs)),
+		RolledBack:   rolledBack,
+		Totals:       make(map[string]Money),
+		FailedTotals: make(map[string]Money),
+	}
+	var failures []error
+	for i, tx := range txs {
+		result.Items[i] = BatchItem{Index: i, TxID: tx.ID, Status: tx.Status, Err: errs[i]}
+		if errs[i] == nil {
+			result.Succeeded++
+			addTotal(result.Totals, tx.Amount)
+			continue
+		}
+		result.Failed++
+		addTotal(result.FailedTotals, tx.Amount)
+		if !errors.Is(errs[i], ErrBatchRolledBack) {
+			failures = append(failures, errs[i])
+		}
+	}
+	if result.Failed > 0 {
+		return result, &BatchError{Mode: mode, Failed: result.Failed, Total: len(txs), RolledBack: rolledBack, Errs: failures}
+	}
+	return result, nil
+}
+
+// addTotal adds amount to its currency's total, leaving the total unchanged
+// on overflow
+func addTotal(totals map[string]Money, amount Money) {
+	total, ok := totals[amount.Currency]
+	if !ok {
+		total = Money{Currency: amount.Currency}
+	}
+	if sum, err := total.Add(amount); err == nil {
+		totals[amount.Currency] = sum
+	}
+}
+
+// processAtomic authorizes and captures txs as a unit, recording the error
+// of each failed transaction in errs. It reports whether the batch was
+// rolled back.
+func (p *PaymentProcessor) processAtomic(ctx context.Context, txs []*Transaction, errs []error) bool {
+	authorized := make([]bool, len(txs))
+	failed := false
+	for i, tx := range txs {
+		// Keep going after a failure so every problem in the batch is reported
+		if err := ctx.Err(); err != nil {
+			errs[i] = newTransactionError(tx, err, "batch cancelled")
+		} else if err := p.authorize(tx); err != nil {
+			errs[i] = err
+		} else {
+			authorized[i] = true
+			if tx.ReviewRule != "" {
+				reviewErr := newTransactionError(tx, ErrReviewRequired, "transaction held for review")
+				reviewErr.RuleID = tx.ReviewRule
+				errs[i] = reviewErr
+			}
+		}
+		if errs[i] != nil {
+			p.observe(errs[i])
+			failed = true
+		}
+	}
+	if !failed && p.captureAll(ctx, txs, errs) {
+		return false
+	}
+
+	for i, tx := range txs {
+		if !authorized[i] {
+			continue
+		}
+		var undo error
+		if tx.Status == StatusCaptured {
+			if undo = p.refund(tx.ID, tx.Amount); undo == nil {
+				tx.Status, tx.Refunded = StatusRefunded, tx.Amount
+			}
+		} else {
+			undo = p.transition(tx.ID, StatusCancelled, tx)
+		}
+		if undo == nil {
+			undo = p.retire(tx)
+		}
+		if errs[i] == nil {
+			errs[i] = newTransactionError(tx, ErrBatchRolledBack, "batch rolled back")
+		}
+		if undo != nil {
+			errs[i] = errors.Join(errs[i], p.observe(undo))
+		}
+	}
+	return true
+}
+
+// retire marks an undone transaction as rolled back. Its ID is never
+// released: postings it made stay in the ledger under that ID next to their
+// reversal, and a new transaction must not share them.
+func (p *PaymentProcessor) retire(tx *Transaction) error {
+	state, err := p.lookupState(tx.ID)
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	record := state.record()
+	record.Transaction.Status = StatusRolledBack
+	if err := p.logEvent(&event{Type: eventStatus, Tx: record}); err != nil {
+		return newTransactionError(tx, err, "event log write failed")
+	}
+	setStatus(state, StatusRolledBack, tx)
+	return nil
+}
+
+// captureAll submits every transaction of an authorized batch to the payment
+// network before moving any funds. It reports whether all of them were
+// captured, recording the error of the one that failed in errs otherwise.
+func (p *PaymentProcessor) captureAll(ctx context.Context, txs []*Transaction, errs []error) bool {
+	states := make([]*txState, 0, len(txs))
+	defer func() {
+		for _, state := range states {
+			state.mu.Lock()
+			endCapture(state)
+			state.mu.Unlock()
+		}
+	}()
+	// As in capture, each transaction is marked in flight while the network
+	// is called without its lock held
+	for i, tx := range txs {
+		state, err := p.lookupState(tx.ID)
+		if err == nil {
+			if err = beginCapture(state); err == nil {
+				states = append(states, state)
+				err = p.submit(ctx, state)
+			}
+		}
+		if err != nil {
+			errs[i] = p.observe(err)
+			return false
+		}
+	}
+	for i, state := range states {
+		state.mu.Lock()
+		endCapture(state)
+		err := p.postCapture(state, txs[i])
+		state.mu.Unlock()
+		if err != nil {
+			errs[i] = p.observe(err)
+			states = states[i+1:]
+			return false
+		}
+	}
+	states = nil
+	return true
+}
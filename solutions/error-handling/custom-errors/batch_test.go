@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func payroll(amounts ...string) []*Transaction {
+	return payrollRun("pay", amounts...)
+}
+
+// payrollRun is payroll with IDs starting with prefix
+func payrollRun(prefix string, amounts ...string) []*Transaction {
+	txs := make([]*Transaction, len(amounts))
+	for i, amount := range amounts {
+		txs[i] = &Transaction{
+			ID:     prefix + "-" + string(rune('a'+i)),
+			Amount: MustParseMoney(amount, "USD"),
+			From:   "employer",
+			To:     "employee-" + string(rune('a'+i)),
+		}
+	}
+	return txs
+}
+
+func TestBatchBestEffort(t *testing.T) {
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "employer", "employee-a", "employee-b", "employee-c")
+	if err := p.Deposit("employer", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := p.ProcessBatch(context.Background(), payroll("40.00", "70.00", "50.00"), BatchBestEffort)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || !errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("Expected a BatchError wrapping ErrInsufficientFunds, got %v", err)
+	}
+	if result.Succeeded != 2 || result.Failed != 1 || result.RolledBack {
+		t.Errorf("Expected 2 succeeded and 1 failed, got %+v", result)
+	}
+	if item := result.Items[1]; item.TxID != "pay-b" || item.Status != StatusFailed || !errors.Is(item.Err, ErrInsufficientFunds) {
+		t.Errorf("Unexpected item %+v", item)
+	}
+	if result.Totals["USD"] != MustParseMoney("90.00", "USD") || result.FailedTotals["USD"] != MustParseMoney("70.00", "USD") {
+		t.Errorf("Unexpected totals %v and %v", result.Totals, result.FailedTotals)
+	}
+	if balance, _ := p.GetBalance("employer"); balance != MustParseMoney("10.00", "USD") {
+		t.Errorf("Expected 10.00 left, got %s", balance)
+	}
+}
+
+func TestBatchAtomicRollsBack(t *testing.T) {
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "employer", "employee-a", "employee-b", "employee-c")
+	if err := p.Deposit("employer", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := payroll("40.00", "70.00", "0.00")
+	result, err := p.ProcessBatch(context.Background(), txs, BatchAtomic)
+	if !errors.Is(err, ErrBatchRolledBack) || !errors.Is(err, ErrInsufficientFunds) || !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("Expected a rolled back batch reporting both failures, got %v", err)
+	}
+	if result.Succeeded != 0 || result.Failed != 3 || !result.RolledBack {
+		t.Errorf("Expected every item to fail, got %+v", result)
+	}
+	if item := result.Items[0]; item.Status != StatusRolledBack || !errors.Is(item.Err, ErrBatchRolledBack) {
+		t.Errorf("Expected the first item to be rolled back, got %+v", item)
+	}
+	if balance, _ := p.GetBalance("employer"); balance != MustParseMoney("100.00", "USD") {
+		t.Errorf("A rolled back batch must not move money, got %s", balance)
+	}
+
+	// Rolled back IDs stay taken; the corrected batch uses new ones
+	if tx, err := p.GetTransaction("pay-a"); err != nil || tx.Status != StatusRolledBack {
+		t.Errorf("Expected the rolled back transaction to be kept, got %+v (%v)", tx, err)
+	}
+	if _, err = p.ProcessBatch(context.Background(), payroll("40.00", "60.00"), BatchAtomic); !errors.Is(err, ErrDuplicateTransaction) {
+		t.Errorf("Expected ErrDuplicateTransaction reusing rolled back IDs, got %v", err)
+	}
+	if result, err = p.ProcessBatch(context.Background(), payrollRun("retry", "40.00", "60.00"), BatchAtomic); err != nil || result.Succeeded != 2 {
+		t.Fatalf("Expected the batch to succeed, got %v", err)
+	}
+	if balance, _ := p.GetBalance("employer"); !balance.IsZero() {
+		t.Errorf("Expected the employer to be paid out, got %s", balance)
+	}
+}
+
+func TestBatchAtomicNetworkFailure(t *testing.T) {
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "employer", "employee-a", "employee-b", "employee-c")
+	if err := p.Deposit("employer", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	p.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	p.SetGateway(func(context.Context) error {
+		if calls++; calls == 3 {
+			return ErrNetworkError
+		}
+		return nil
+	})
+
+	result, err := p.ProcessBatch(context.Background(), payroll("10.00", "20.00", "30.00"), BatchAtomic)
+	if !errors.Is(err, ErrBatchRolledBack) || !errors.Is(err, ErrNetworkError) {
+		t.Fatalf("Expected the network failure to roll back the batch, got %v", err)
+	}
+	for _, item := range result.Items {
+		if item.Status != StatusRolledBack {
+			t.Errorf("Expected %s to be rolled back before any money moved, got %q", item.TxID, item.Status)
+		}
+	}
+	if balance, _ := p.GetBalance("employer"); balance != MustParseMoney("100.00", "USD") {
+		t.Errorf("Expected no money to move, got %s", balance)
+	}
+
+	p.SetGateway(func(context.Context) error { return nil })
+	if result, err := p.ProcessBatch(context.Background(), payrollRun("retry", "10.00", "20.00", "30.00"), BatchAtomic); err != nil || result.Succeeded != 3 {
+		t.Fatalf("Expected the resubmitted batch to succeed, got %v", err)
+	}
+}
+
+func TestBatchAtomicRetryAfterReplay(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "events.jsonl")
+	p, err := OpenPaymentProcessor(logPath, EventLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, p, "USD", "employer", "employee-a", "employee-b")
+	if err := p.Deposit("employer", MustParseMoney("50.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ProcessBatch(context.Background(), payroll("40.00", "60.00"), BatchAtomic); !errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("Expected the batch to roll back, got %v", err)
+	}
+	p.Close()
+
+	// The rolled back IDs stay taken after a restart
+	restored, err := OpenPaymentProcessor(logPath, EventLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if tx, err := restored.GetTransaction("pay-a"); err != nil || tx.Status != StatusRolledBack {
+		t.Errorf("Expected the rolled back transaction to be restored, got %+v (%v)", tx, err)
+	}
+	if err := restored.Deposit("employer", MustParseMoney("50.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := restored.ProcessBatch(context.Background(), payrollRun("retry", "40.00", "60.00"), BatchAtomic); err != nil || result.Succeeded != 2 {
+		t.Fatalf("Expected the corrected batch to succeed, got %v", err)
+	}
+}
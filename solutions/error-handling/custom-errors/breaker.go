@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the protected operation while
+// the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Clock tells the time. Tests substitute a fake to control time without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function such as time.Now to Clock
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time { return f() }
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets calls through and watches the failure rate
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects calls until the cool-down has passed
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe calls through
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerSettings configures a CircuitBreaker. Zero fields take defaults.
+type BreakerSettings struct {
+	// Window is how far back the failure rate is measured (default 1m)
+	Window time.Duration
+	// MinRequests is the number of calls in the window before the breaker
+	// can trip (default 10)
+	MinRequests int
+	// FailureRate is the fraction of failed calls that trips the breaker (default 0.5)
+	FailureRate float64
+	// CoolDown is how long the breaker stays open before probing (default 30s)
+	CoolDown time.Duration
+	// HalfOpenProbes is how many successful probes close the breaker (default 1)
+	HalfOpenProbes int
+	// IsFailure decides which errors count against the circuit. By default
+	// every error except context cancellation does.
+	IsFailure func(error) bool
+	// OnStateChange, if set, is called after every state change. It runs
+	// outside the breaker's lock.
+	OnStateChange func(from, to CircuitState)
+	Clock         Clock
+}
+
+// outcome is a call result inside the failure-rate window
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// CircuitBreaker stops calling a failing dependency for a while so it can
+// recover. It is safe for concurrent use.
+type CircuitBreaker struct {
+	settings BreakerSettings
+
+	mu       sync.Mutex
+	state    CircuitState
+	outcomes []outcome // closed state only, oldest first
+	openedAt time.Time
+	probes   int // half-open calls in flight
+	passed   int // successful half-open calls
+	// generation increases on every state change so late results from an
+	// earlier state are ignored
+	generation uint64
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	if settings.Window <= 0 {
+		settings.Window = time.Minute
+	}
+	if settings.MinRequests <= 0 {
+		settings.MinRequests = 10
+	}
+	if settings.FailureRate <= 0 || settings.FailureRate > 1 {
+		settings.FailureRate = 0.5
+	}
+	if settings.CoolDown <= 0 {
+		settings.CoolDown = 30 * time.Second
+	}
+	if settings.HalfOpenProbes <= 0 {
+		settings.HalfOpenProbes = 1
+	}
+	if settings.IsFailure == nil {
+		settings.IsFailure = func(err error) bool {
+			return err != nil && !errors.Is(err, context.Canceled)
+		}
+	}
+	if settings.Clock == nil {
+		settings.Clock = ClockFunc(time.Now)
+	}
+	return &CircuitBreaker{settings: settings}
+}
+
+// State returns the current state, moving from open to half-open if the
+// cool-down has passed
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	changed := b.refresh()
+	state := b.state
+	b.mu.Unlock()
+	b.notify(changed)
+	return state
+}
+
+// Execute calls op unless the circuit is open, in which case it returns
+// ErrCircuitOpen
+func (b *CircuitBreaker) Execute(ctx context.Context, op func(context.Context) error) error {
+	generation, err := b.allow()
+	if err != nil {
+		return err
+	}
+	err = op(ctx)
+	b.record(generation, b.settings.IsFailure(err))
+	return err
+}
+
+// stateChange is a transition waiting to be reported to OnStateChange
+type stateChange struct {
+	from, to CircuitState
+}
+
+func (b *CircuitBreaker) notify(changes ...*stateChange) {
+	if b.settings.OnStateChange == nil {
+		return
+	}
+	for _, c := range changes {
+		if c != nil {
+			b.settings.OnStateChange(c.from, c.to)
+		}
+	}
+}
+
+// setState moves to a new state and resets its bookkeeping. The caller must hold b.mu.
+func (b *CircuitBreaker) setState(to CircuitState) *stateChange {
+	change := &stateChange{from: b.state, to: to}
+	b.state = to
+	b.outcomes = nil
+	b.probes, b.passed = 0, 0
+	b.generation++
+	if to == CircuitOpen {
+		b.openedAt = b.settings.Clock.Now()
+	}
+	return change
+}
+
+// refresh moves an open breaker to half-open once its cool-down is over.
+// The caller must hold b.mu.
+func (b *CircuitBreaker) refresh() *stateChange {
+	if b.state == CircuitOpen && !b.settings.Clock.Now().Before(b.openedAt.Add(b.settings.CoolDown)) {
+		return b.setState(CircuitHalfOpen)
+	}
+	return nil
+}
+
+// allow reserves a call, returning the generation it belongs to
+func (b *CircuitBreaker) allow() (uint64, error) {
+	b.mu.Lock()
+	changed := b.refresh()
+	var err error
+	switch b.state {
+	case CircuitOpen:
+		err = ErrCircuitOpen
+	case CircuitHalfOpen:
+		if b.probes+b.passed >= b.settings.HalfOpenProbes {
+			err = ErrCircuitOpen
+		} else {
+			b.probes++
+		}
+	}
+	generation := b.generation
+	b.mu.Unlock()
+	b.notify(changed)
+	return generation, err
+}
+
+func (b *CircuitBreaker) record(generation uint64, failed bool) {
+	b.mu.Lock()
+	if generation != b.generation {
+		b.mu.Unlock()
+		return
+	}
+	var changed *stateChange
+	switch b.state {
+	case CircuitHalfOpen:
+		b.probes--
+		if failed {
+			changed = b.setState(CircuitOpen)
+		} else if b.passed++; b.passed >= b.settings.HalfOpenProbes {
+			changed = b.setState(CircuitClosed)
+		}
+	case CircuitClosed:
+		now := b.settings.Clock.Now()
+		b.outcomes = append(b.outcomes, outcome{at: now, failed: failed})
+		cutoff := now.Add(-b.settings.Window)
+		keep := 0
+		for keep < len(b.outcomes) && b.outcomes[keep].at.Before(cutoff) {
+			keep++
+		}
+		b.outcomes = b.outcomes[keep:]
+		failures := 0
+		for _, o := range b.outcomes {
+			if o.failed {
+				failures++
+			}
+		}
+		if len(b.outcomes) >= b.settings.MinRequests &&
+			float64(failures) >= b.settings.FailureRate*float64(len(b.outcomes)) {
+			changed = b.setState(CircuitOpen)
+		}
+	}
+	b.mu.Unlock()
+	b.notify(changed)
+}
+
+// SetCircuitBreaker protects gateway calls with b. Nil removes the breaker.
+func (p *PaymentProcessor) SetCircuitBreaker(b *CircuitBreaker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.breaker = b
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestCircuitBreakerStates(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var changes []string
+	b := NewCircuitBreaker(BreakerSettings{
+		Window:      time.Minute,
+		MinRequests: 4,
+		FailureRate: 0.5,
+		CoolDown:    10 * time.Second,
+		Clock:       clock,
+		OnStateChange: func(from, to CircuitState) {
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	})
+	fail := func(context.Context) error { return ErrNetworkError }
+	ok := func(context.Context) error { return nil }
+	ctx := context.Background()
+
+	// Two failures out of three calls is not enough requests to trip
+	b.Execute(ctx, ok)
+	b.Execute(ctx, fail)
+	b.Execute(ctx, fail)
+	if b.State() != CircuitClosed {
+		t.Fatalf("Expected closed below MinRequests, got %s", b.State())
+	}
+	b.Execute(ctx, ok)
+	if b.State() != CircuitOpen {
+		t.Fatalf("Expected open at a 50%% failure rate, got %s", b.State())
+	}
+
+	calls := 0
+	err := b.Execute(ctx, func(context.Context) error { calls++; return nil })
+	if !errors.Is(err, ErrCircuitOpen) || calls != 0 {
+		t.Errorf("Expected ErrCircuitOpen without calling through, got %v (%d calls)", err, calls)
+	}
+
+	// A failed probe reopens the circuit for another cool-down
+	clock.Advance(10 * time.Second)
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("Expected half-open after the cool-down, got %s", b.State())
+	}
+	b.Execute(ctx, fail)
+	if b.State() != CircuitOpen {
+		t.Fatalf("Expected a failed probe to reopen, got %s", b.State())
+	}
+
+	clock.Advance(10 * time.Second)
+	if err := b.Execute(ctx, ok); err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if b.State() != CircuitClosed {
+		t.Errorf("Expected a successful probe to close, got %s", b.State())
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("State changes = %v, want %v", changes, want)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := NewCircuitBreaker(BreakerSettings{Window: time.Minute, MinRequests: 2, Clock: clock})
+	fail := func(context.Context) error { return ErrNetworkError }
+
+	b.Execute(context.Background(), fail)
+	clock.Advance(2 * time.Minute)
+	b.Execute(context.Background(), func(context.Context) error { return nil })
+	if b.State() != CircuitClosed {
+		t.Errorf("Failures outside the window should not count, got %s", b.State())
+	}
+}
+
+func TestCaptureCircuitOpen(t *testing.T) {
+	processor := NewPaymentProcessor()
+	processor.SetRetryPolicy(RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	processor.SetCircuitBreaker(NewCircuitBreaker(BreakerSettings{MinRequests: 3, FailureRate: 1}))
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	processor.SetGateway(func(context.Context) error {
+		calls++
+		return ErrNetworkError
+	})
+
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}
+	err := processor.ProcessTransaction(tx)
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected a TransactionError wrapping ErrCircuitOpen, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected retries to stop once the circuit opened, got %d calls", calls)
+	}
+
+	tx = &Transaction{ID: "tx2", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(tx); !errors.Is(err, ErrCircuitOpen) || calls != 3 {
+		t.Errorf("Expected ErrCircuitOpen without calling the network, got %v (%d calls)", err, calls)
+	}
+	if balance, _ := processor.GetBalance("a"); balance != MustParseMoney("10.00", "USD") {
+		t.Errorf("Expected no money moved, got %s", balance)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// CodeInternal is the code of errors that wrap no known sentinel
+const CodeInternal = "PAY_INTERNAL"
+
+// sentinels lists the known errors with their stable code and HTTP status.
+// When an error wraps several, the first match wins, so more specific causes
+// come first. Codes are part of the API and must never change. Every status
+// is an error status: results that are not failures, such as a transaction
+// held for review, are reported by their handlers instead.
+var sentinels = []struct {
+	name   string
+	err    error
+	code   string
+	status int
+}{
+	{"ErrCircuitOpen", ErrCircuitOpen, "PAY_NETWORK_UNAVAILABLE", http.StatusServiceUnavailable},
+	{"ErrTransactionDenied", ErrTransactionDenied, "PAY_TRANSACTION_DENIED", http.StatusForbidden},
+	{"ErrReviewRequired", ErrReviewRequired, "PAY_REVIEW_REQUIRED", http.StatusConflict},
+	{"ErrBatchRolledBack", ErrBatchRolledBack, "PAY_BATCH_ROLLED_BACK", http.StatusConflict},
+	{"ErrAccountFrozen", ErrAccountFrozen, "PAY_ACCOUNT_FROZEN", http.StatusForbidden},
+	{"ErrAccountClosed", ErrAccountClosed, "PAY_ACCOUNT_CLOSED", http.StatusForbidden},
+	{"ErrAccountExists", ErrAccountExists, "PAY_ACCOUNT_EXISTS", http.StatusConflict},
+	{"ErrAccountNotEmpty", ErrAccountNotEmpty, "PAY_ACCOUNT_NOT_EMPTY", http.StatusConflict},
+	{"ErrInsufficientFunds", ErrInsufficientFunds, "PAY_INSUFFICIENT_FUNDS", http.StatusUnprocessableEntity},
+	{"ErrDuplicateTransaction", ErrDuplicateTransaction, "PAY_DUPLICATE_TRANSACTION", http.StatusConflict},
+	{"ErrIdempotencyKeyReused", ErrIdempotencyKeyReused, "PAY_IDEMPOTENCY_KEY_REUSED", http.StatusUnprocessableEntity},
+	{"ErrInvalidStatement", ErrInvalidStatement, "PAY_INVALID_STATEMENT", http.StatusBadRequest},
+	{"ErrInvalidAmount", ErrInvalidAmount, "PAY_INVALID_AMOUNT", http.StatusBadRequest},
+	{"ErrInvalidAccount", ErrInvalidAccount, "PAY_INVALID_ACCOUNT", http.StatusBadRequest},
+	{"ErrUnsupportedCurrency", ErrUnsupportedCurrency, "PAY_UNSUPPORTED_CURRENCY", http.StatusBadRequest},
+	{"ErrInvalidSchedule", ErrInvalidSchedule, "PAY_INVALID_SCHEDULE", http.StatusBadRequest},
+	{"ErrScheduleExists", ErrScheduleExists, "PAY_SCHEDULE_EXISTS", http.StatusConflict},
+	{"ErrScheduleNotFound", ErrScheduleNotFound, "PAY_SCHEDULE_NOT_FOUND", http.StatusNotFound},
+	{"ErrInvalidQuery", ErrInvalidQuery, "PAY_INVALID_QUERY", http.StatusBadRequest},
+	{"ErrInvalidRequest", ErrInvalidRequest, "PAY_INVALID_REQUEST", http.StatusBadRequest},
+	{"ErrRouteNotFound", ErrRouteNotFound, "PAY_ROUTE_NOT_FOUND", http.StatusNotFound},
+	{"ErrMethodNotAllowed", ErrMethodNotAllowed, "PAY_METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed},
+	{"ErrTransactionNotFound", ErrTransactionNotFound, "PAY_TRANSACTION_NOT_FOUND", http.StatusNotFound},
+	{"ErrAccountNotFound", ErrAccountNotFound, "PAY_ACCOUNT_NOT_FOUND", http.StatusNotFound},
+	{"ErrIllegalTransition", ErrIllegalTransition, "PAY_ILLEGAL_TRANSITION", http.StatusConflict},
+	{"ErrRefundExceedsAmount", ErrRefundExceedsAmount, "PAY_REFUND_EXCEEDS_AMOUNT", http.StatusUnprocessableEntity},
+	{"ErrRateNotFound", ErrRateNotFound, "PAY_RATE_NOT_FOUND", http.StatusUnprocessableEntity},
+	{"ErrStaleRate", ErrStaleRate, "PAY_STALE_RATE", http.StatusUnprocessableEntity},
+	{"ErrCurrencyMismatch", ErrCurrencyMismatch, "PAY_CURRENCY_MISMATCH", http.StatusBadRequest},
+	{"ErrMoneyOverflow", ErrMoneyOverflow, "PAY_AMOUNT_OVERFLOW", http.StatusUnprocessableEntity},
+	{"ErrLedgerUnbalanced", ErrLedgerUnbalanced, "PAY_LEDGER_UNBALANCED", http.StatusInternalServerError},
+	{"ErrNetworkError", ErrNetworkError, "PAY_NETWORK_ERROR", http.StatusBadGateway},
+}
+
+// SentinelName returns the name of the first known sentinel err wraps, or "other"
+func SentinelName(err error) string {
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			return s.name
+		}
+	}
+	return "other"
+}
+
+// ErrorCode returns the stable code of the first known sentinel err wraps,
+// or CodeInternal
+func ErrorCode(err error) string {
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			return s.code
+		}
+	}
+	return CodeInternal
+}
+
+// HTTPStatus returns the HTTP status that best describes err
+func HTTPStatus(err error) int {
+	for _, s := range sentinels {
+		if errors.Is(err, s.err) {
+			return s.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// sentinelForCode returns the sentinel with the given code, or nil
+func sentinelForCode(code string) error {
+	for _, s := range sentinels {
+		if s.code == code {
+			return s.err
+		}
+	}
+	return nil
+}
+
+// Code returns the stable code of the error, e.g. PAY_INSUFFICIENT_FUNDS
+func (e *TransactionError) Code() string {
+	return ErrorCode(e.Err)
+}
+
+// HTTPStatus returns the HTTP status that best describes the error
+func (e *TransactionError) HTTPStatus() int {
+	return HTTPStatus(e.Err)
+}
+
+// codedError stands in for a cause decoded from JSON. It keeps the original
+// message and unwraps to the sentinel its code names, so errors.Is works on
+// the decoding side.
+type codedError struct {
+	message  string
+	sentinel error
+}
+
+func (e *codedError) Error() string {
+	return e.message
+}
+
+func (e *codedError) Unwrap() error {
+	return e.sentinel
+}
+
+// decodeCause rebuilds an error from its code and message
+func decodeCause(code, message string) error {
+	return &codedError{message: message, sentinel: sentinelForCode(code)}
+}
+
+// fieldErrorJSON is the wire form of a FieldError
+type fieldErrorJSON struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// transactionErrorJSON is the wire form of a TransactionError
+type transactionErrorJSON struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Cause   string           `json:"cause"`
+	Context string           `json:"context,omitempty"`
+	TxID    string           `json:"tx_id,omitempty"`
+	Amount  *Money           `json:"amount,omitempty"`
+	From    string           `json:"from,omitempty"`
+	To      string           `json:"to,omitempty"`
+	RuleID  string           `json:"rule_id,omitempty"`
+	Fields  []fieldErrorJSON `json:"fields,omitempty"`
+}
+
+// MarshalJSON encodes the error with its stable code. Validation failures
+// list every field with its own code.
+func (e *TransactionError) MarshalJSON() ([]byte, error) {
+	v := transactionErrorJSON{
+		Code:    e.Code(),
+		Message: e.Error(),
+		Context: e.Context,
+		TxID:    e.TxID,
+		From:    e.From,
+		To:      e.To,
+		RuleID:  e.RuleID,
+	}
+	if e.Err != nil {
+		v.Cause = e.Err.Error()
+	}
+	if e.Amount.Currency != "" {
+		amount := e.Amount
+		v.Amount = &amount
+	}
+	var validation *ValidationError
+	if errors.As(e.Err, &validation) {
+		for _, fe := range validation.Errors {
+			v.Fields = append(v.Fields, fieldErrorJSON{Field: fe.Field, Code: ErrorCode(fe.Err), Message: fe.Err.Error()})
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes the form written by MarshalJSON. The decoded Err
+// matches the original sentinels with errors.Is.
+func (e *TransactionError) UnmarshalJSON(data []byte) error {
+	var v transactionErrorJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = TransactionError{Context: v.Context, TxID: v.TxID, From: v.From, To: v.To, RuleID: v.RuleID}
+	if v.Amount != nil {
+		e.Amount = *v.Amount
+	}
+	if len(v.Fields) > 0 {
+		validation := &ValidationError{}
+		for _, f := range v.Fields {
+			validation.add(f.Field, decodeCause(f.Code, f.Message))
+		}
+		e.Err = validation
+		return nil
+	}
+	e.Err = decodeCause(v.Code, v.Cause)
+	return nil
+}
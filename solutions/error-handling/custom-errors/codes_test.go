@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{ErrInsufficientFunds, "PAY_INSUFFICIENT_FUNDS", http.StatusUnprocessableEntity},
+		{&TransitionError{From: StatusCancelled, To: StatusCaptured}, "PAY_ILLEGAL_TRANSITION", http.StatusConflict},
+		{&RetryError{Err: errors.Join(ErrNetworkError, ErrCircuitOpen)}, "PAY_NETWORK_UNAVAILABLE", http.StatusServiceUnavailable},
+		{ErrReviewRequired, "PAY_REVIEW_REQUIRED", http.StatusConflict},
+		{errors.New("boom"), CodeInternal, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		txErr := newTransactionError(&Transaction{ID: "tx"}, tt.err, "test")
+		if txErr.Code() != tt.code || txErr.HTTPStatus() != tt.status {
+			t.Errorf("%v: got %s/%d, want %s/%d", tt.err, txErr.Code(), txErr.HTTPStatus(), tt.code, tt.status)
+		}
+	}
+	for _, s := range sentinels {
+		if s.status < 400 {
+			t.Errorf("%s maps to %d, which is not an error status", s.name, s.status)
+		}
+	}
+}
+
+func TestTransactionErrorJSONRoundTrip(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	err := processor.ProcessTransaction(&Transaction{ID: "tx1", Amount: MustParseMoney("20.00", "USD"), From: "a", To: "b"})
+	var original *TransactionError
+	if !errors.As(err, &original) {
+		t.Fatalf("Expected a TransactionError, got %v", err)
+	}
+
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	if fields["code"] != "PAY_INSUFFICIENT_FUNDS" || fields["tx_id"] != "tx1" {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+
+	var decoded TransactionError
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(&decoded, ErrInsufficientFunds) {
+		t.Errorf("Decoded error should match ErrInsufficientFunds: %v", &decoded)
+	}
+	if decoded.Error() != original.Error() || decoded.Amount != original.Amount {
+		t.Errorf("Round trip changed the error:\n%v\n%v", original, &decoded)
+	}
+}
+
+func TestValidationErrorJSONRoundTrip(t *testing.T) {
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("0.00", "USD"), From: "a"}
+	original := newTransactionError(tx, tx.Validate(), "transaction validation failed")
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded TransactionError
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(&decoded, ErrInvalidAmount) || !errors.Is(&decoded, ErrInvalidAccount) {
+		t.Errorf("Decoded error should match both sentinels: %v", &decoded)
+	}
+	var v *ValidationError
+	if !errors.As(&decoded, &v) || len(v.Errors) != 2 || v.Errors[1].Field != "to" {
+		t.Errorf("Expected field errors to survive the round trip, got %v", decoded.Err)
+	}
+	if decoded.Error() != original.Error() {
+		t.Errorf("Round trip changed the message:\n%v\n%v", original, &decoded)
+	}
+}
+
+func TestUnknownCodeDecodes(t *testing.T) {
+	var decoded TransactionError
+	if err := json.Unmarshal([]byte(`{"code":"PAY_FROM_THE_FUTURE","cause":"new failure","tx_id":"tx9"}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Err.Error() != "new failure" || decoded.Code() != CodeInternal {
+		t.Errorf("Unexpected decoding of an unknown code: %v (%s)", &decoded, decoded.Code())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConcurrentTransfersConserveMoney(t *testing.T) {
+	const (
+		accounts  = 8
+		transfers = 5000
+	)
+	processor := NewPaymentProcessor()
+	for i := 0; i < accounts; i++ {
+		openAccounts(t, processor, "USD", fmt.Sprintf("acct%d", i))
+		if err := processor.Deposit(fmt.Sprintf("acct%d", i), MustParseMoney("100.00", "USD")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var succeeded, insufficient atomic.Int64
+	for i := 0; i < transfers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			tx := &Transaction{
+				ID:     fmt.Sprintf("tx%d", i),
+				Amount: NewMoney(int64(1+r.Intn(5000)), "USD"),
+				From:   fmt.Sprintf("acct%d", r.Intn(accounts)),
+				To:     fmt.Sprintf("acct%d", r.Intn(accounts)),
+			}
+			err := processor.ProcessTransaction(tx)
+			switch {
+			case err == nil:
+				succeeded.Add(1)
+			case errors.Is(err, ErrInsufficientFunds):
+				insufficient.Add(1)
+			default:
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := Money{Currency: "USD"}
+	for i := 0; i < accounts; i++ {
+		balance, err := processor.GetBalance(fmt.Sprintf("acct%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.IsNegative() {
+			t.Errorf("acct%d went negative: %s", i, balance)
+		}
+		total, _ = total.Add(balance)
+	}
+	if total != MustParseMoney("800.00", "USD") {
+		t.Errorf("Expected total of 800.00 USD to be conserved, got %s", total)
+	}
+	if _, err := processor.TrialBalance(); err != nil {
+		t.Errorf("Trial balance failed: %v", err)
+	}
+	if succeeded.Load()+insufficient.Load() != transfers {
+		t.Errorf("Expected %d outcomes, got %d", transfers, succeeded.Load()+insufficient.Load())
+	}
+}
+
+func TestConcurrentDuplicateTransaction(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("1000.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var succeeded atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := &Transaction{ID: "same", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}
+			if err := processor.ProcessTransaction(tx); err == nil {
+				succeeded.Add(1)
+			} else if !errors.Is(err, ErrDuplicateTransaction) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded.Load() != 1 {
+		t.Errorf("Expected exactly one success, got %d", succeeded.Load())
+	}
+	if balance, _ := processor.GetBalance("b"); balance != MustParseMoney("1.00", "USD") {
+		t.Errorf("Expected 1.00 USD credited once, got %s", balance)
+	}
+}
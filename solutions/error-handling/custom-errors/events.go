@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event log errors
+var (
+	ErrCorruptEvent   = errors.New("corrupt event record")
+	ErrEventLogClosed = errors.New("event log is closed")
+)
+
+// eventType names what an event records
+type eventType string
+
+const (
+	eventDeposit    eventType = "deposit"
+	eventAuthorized eventType = "authorized"
+	// eventStatus records a capture, void, settlement or refund
+	eventStatus   eventType = "status"
+	eventRejected eventType = "rejected"
+	// eventAccount records an account being opened or changing status
+	eventAccount eventType = "account"
+)
+
+// event is one record of the event log. Replaying the events in order
+// rebuilds the ledger, the balances and the transactions.
+type event struct {
+	Seq     int64          `json:"seq"`
+	Type    eventType      `json:"type"`
+	Time    time.Time      `json:"time"`
+	Entries []JournalEntry `json:"entries,omitempty"`
+	// Tx is the state of the transaction after the event
+	Tx        *txRecord      `json:"tx,omitempty"`
+	Rejection *rejection     `json:"rejection,omitempty"`
+	Account   *accountRecord `json:"account,omitempty"`
+}
+
+// accountRecord is the serialized form of an account, without its balance
+type accountRecord struct {
+	ID             string        `json:"id"`
+	Owner          string        `json:"owner,omitempty"`
+	Currency       string        `json:"currency"`
+	Status         AccountStatus `json:"status,omitempty"`
+	OverdraftLimit *Money        `json:"overdraft_limit,omitempty"`
+	OpenedAt       *time.Time    `json:"opened_at,omitempty"`
+}
+
+// record serializes the account. The caller must hold a.mu or own a exclusively.
+func (a *account) record() *accountRecord {
+	r := &accountRecord{ID: a.id, Owner: a.owner, Currency: a.currency, Status: a.status}
+	if !a.overdraft.IsZero() {
+		overdraft := a.overdraft
+		r.OverdraftLimit = &overdraft
+	}
+	if !a.openedAt.IsZero() {
+		opened := a.openedAt
+		r.OpenedAt = &opened
+	}
+	return r
+}
+
+// restoreAccount recreates or updates an account from its record. Records
+// written before accounts had a status are active.
+func (p *PaymentProcessor) restoreAccount(r *accountRecord) *account {
+	acct := p.accountOrCreate(r.ID, r.Currency)
+	acct.owner = r.Owner
+	if r.Status != "" {
+		acct.status = r.Status
+	}
+	if r.OverdraftLimit != nil {
+		acct.overdraft = *r.OverdraftLimit
+	}
+	if r.OpenedAt != nil {
+		acct.openedAt = *r.OpenedAt
+	}
+	return acct
+}
+
+// txRecord is the serialized form of a txState
+type txRecord struct {
+	Transaction    Transaction     `json:"transaction"`
+	FromAccount    string          `json:"from_account"`
+	ToAccount      string          `json:"to_account"`
+	Postings       []recordPosting `json:"postings"`
+	Hold           Money           `json:"hold"`
+	Debit          Money           `json:"debit"`
+	Credit         Money           `json:"credit"`
+	RefundedDebit  Money           `json:"refunded_debit"`
+	RefundedCredit Money           `json:"refunded_credit"`
+}
+
+type recordPosting struct {
+	Account string `json:"account"`
+	Side    Side   `json:"side"`
+	Amount  Money  `json:"amount"`
+}
+
+// rejection describes a transaction that was refused. Amounts are kept as
+// text because rejected requests may carry currencies Money cannot decode.
+type rejection struct {
+	TxID     string `json:"tx_id"`
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Code     string `json:"code"`
+	Error    string `json:"error"`
+}
+
+// record serializes the state. The caller must hold s.mu or own s exclusively.
+func (s *txState) record() *txRecord {
+	r := &txRecord{
+		Transaction:    *s.tx,
+		FromAccount:    s.from.id,
+		ToAccount:      s.to.id,
+		Hold:           s.hold,
+		Debit:          s.debit,
+		Credit:         s.credit,
+		RefundedDebit:  s.refundedDebit,
+		RefundedCredit: s.refundedCredit,
+	}
+	for _, e := range s.postings {
+		r.Postings = append(r.Postings, recordPosting{Account: e.acct.id, Side: e.side, Amount: e.amount})
+	}
+	return r
+}
+
+// restoreState rebuilds a txState from its record, creating missing accounts
+func (p *PaymentProcessor) restoreState(r *txRecord) *txState {
+	tx := r.Transaction
+	s := &txState{
+		tx:             &tx,
+		from:           p.accountOrCreate(r.FromAccount, r.Debit.Currency),
+		to:             p.accountOrCreate(r.ToAccount, r.Credit.Currency),
+		hold:           r.Hold,
+		debit:          r.Debit,
+		credit:         r.Credit,
+		refundedDebit:  r.RefundedDebit,
+		refundedCredit: r.RefundedCredit,
+	}
+	for _, e := range r.Postings {
+		s.postings = append(s.postings, posting{acct: p.accountOrCreate(e.Account, e.Amount.Currency), side: e.Side, amount: e.Amount})
+	}
+	return s
+}
+
+// envelope wraps each record with a checksum of its exact bytes
+type envelope struct {
+	CRC  uint32          `json:"crc"`
+	Data json.RawMessage `json:"data"`
+}
+
+func encodeRecord(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{CRC: crc32.ChecksumIEEE(data), Data: data})
+}
+
+func decodeRecord(line []byte, v any) error {
+	var env envelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptEvent, err)
+	}
+	if crc := crc32.ChecksumIEEE(env.Data); crc != env.CRC {
+		return fmt.Errorf("%w: checksum %08x, want %08x", ErrCorruptEvent, crc, env.CRC)
+	}
+	if err := json.Unmarshal(env.Data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptEvent, err)
+	}
+	return nil
+}
+
+// EventLogError reports a bad record in an event log
+type EventLogError struct {
+	Line   int
+	Offset int64
+	Err    error
+}
+
+func (e *EventLogError) Error() string {
+	return fmt.Sprintf("event log line %d (offset %d): %v", e.Line, e.Offset, e.Err)
+}
+
+func (e *EventLogError) Unwrap() error {
+	return e.Err
+}
+
+// readEvents calls fn with each event in the log from byte offset start, in
+// order, along with the offset just past it. A final line without a newline
+// is a write torn by a crash; it is skipped and its length returned as torn.
+// valid is the length of the log up to the last good record.
+func readEvents(path string, start int64, fn func(e *event, end int64) error) (valid, torn int64, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && start == 0 {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open event log: %w", err)
+	}
+	defer file.Close()
+	if start > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open event log: %w", err)
+		}
+		if info.Size() < start {
+			return 0, 0, fmt.Errorf("%w: log is %d bytes, snapshot starts at %d", ErrCorruptEvent, info.Size(), start)
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return 0, 0, fmt.Errorf("failed to read event log: %w", err)
+		}
+	}
+
+	valid = start
+	br := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, int64(len(data)), nil
+		}
+		if err != nil {
+			return valid, 0, fmt.Errorf("failed to read event log: %w", err)
+		}
+		var e event
+		if err := decodeRecord(data, &e); err != nil {
+			return valid, 0, &EventLogError{Line: line, Offset: valid, Err: err}
+		}
+		if err := fn(&e, valid+int64(len(data))); err != nil {
+			return valid, 0, &EventLogError{Line: line, Offset: valid, Err: err}
+		}
+		valid += int64(len(data))
+	}
+}
+
+// EventLogOptions configures OpenPaymentProcessor
+type EventLogOptions struct {
+	// SnapshotPath is where snapshots are kept. Empty disables snapshots.
+	SnapshotPath string
+	// SnapshotEvery takes a snapshot in the background after this many
+	// events. Zero disables automatic snapshots.
+	SnapshotEvery int
+	// Sync flushes every record to stable storage before returning
+	Sync bool
+	// OnSnapshotError, if set, is called when a background snapshot fails
+	OnSnapshotError func(error)
+}
+
+// eventLog appends events to a file
+type eventLog struct {
+	path string
+	opts EventLogOptions
+
+	mu            sync.Mutex
+	file          *os.File
+	seq           int64
+	err           error // sticky: after a failed write the file may end mid-record
+	sinceSnapshot int
+	snapshotting  bool
+	snapshots     sync.WaitGroup
+}
+
+// append assigns the next sequence number to e and writes it
+func (l *eventLog) append(e *event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	e.Seq = l.seq + 1
+	line, err := encodeRecord(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		l.err = fmt.Errorf("failed to write event log: %w", err)
+		return l.err
+	}
+	if l.opts.Sync {
+		if err := l.file.Sync(); err != nil {
+			l.err = fmt.Errorf("failed to sync event log: %w", err)
+			return l.err
+		}
+	}
+	l.seq = e.Seq
+
+	l.sinceSnapshot++
+	if l.opts.SnapshotPath != "" && l.opts.SnapshotEvery > 0 && l.sinceSnapshot >= l.opts.SnapshotEvery && !l.snapshotting {
+		l.snapshotting, l.sinceSnapshot = true, 0
+		l.snapshots.Add(1)
+		go l.snapshot()
+	}
+	return nil
+}
+
+// snapshot rebuilds the state from the previous snapshot and the log written
+// so far, so it never has to lock the live processor
+func (l *eventLog) snapshot() {
+	defer l.snapshots.Done()
+	err := WriteSnapshot(l.path, l.opts.SnapshotPath)
+	l.mu.Lock()
+	l.snapshotting = false
+	l.mu.Unlock()
+	if err != nil && l.opts.OnSnapshotError != nil {
+		l.opts.OnSnapshotError(err)
+	}
+}
+
+func (l *eventLog) close() error {
+	l.mu.Lock()
+	var err error
+	if l.err != ErrEventLogClosed {
+		err = l.file.Close()
+		l.err = ErrEventLogClosed
+	}
+	l.mu.Unlock()
+	l.snapshots.Wait()
+	return err
+}
+
+// logEvent appends e to the event log, if there is one
+func (p *PaymentProcessor) logEvent(e *event) error {
+	if p.events == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = p.now()
+	}
+	return p.events.append(e)
+}
+
+// logRejection records a refused transaction. Rejections do not change
+// state, so failing to log one is not reported.
+func (p *PaymentProcessor) logRejection(tx *Transaction, err error) {
+	p.logEvent(&event{Type: eventRejected, Rejection: &rejection{
+		TxID:     tx.ID,
+		Amount:   tx.Amount.Decimal(),
+		Currency: tx.Amount.Currency,
+		From:     tx.From,
+		To:       tx.To,
+		Code:     ErrorCode(err),
+		Error:    err.Error(),
+	}})
+}
+
+// OpenPaymentProcessor restores a processor from the snapshot and event log
+// and keeps appending every change to the log. A torn record at the end of
+// the log, left by a crash, is discarded. Idempotency keys are not persisted.
+func OpenPaymentProcessor(logPath string, opts EventLogOptions) (*PaymentProcessor, error) {
+	p := NewPaymentProcessor()
+	result, err := p.replay(logPath, opts.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	if err := file.Truncate(result.valid); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate torn event: %w", err)
+	}
+	if _, err := file.Seek(result.valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	p.events = &eventLog{path: logPath, opts: opts, file: file, seq: result.lastSeq}
+	return p, nil
+}
+
+// LoadPaymentProcessor restores a processor from the snapshot and event log
+// without opening either for writing, so the files are left as they are even
+// if the log ends in a torn record. Changes to the processor fail with
+// ErrEventLogClosed.
+func LoadPaymentProcessor(logPath, snapshotPath string) (*PaymentProcessor, error) {
+	p := NewPaymentProcessor()
+	result, err := p.replay(logPath, snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	p.events = &eventLog{path: logPath, seq: result.lastSeq, err: ErrEventLogClosed}
+	return p, nil
+}
+
+// Close stops logging and waits for any snapshot in progress
+func (p *PaymentProcessor) Close() error {
+	if p.events == nil {
+		return nil
+	}
+	return p.events.close()
+}
+
+// replayResult summarizes a replay
+type replayResult struct {
+	snapshot snapshotInfo
+	lastSeq  int64
+	events   int
+	rejected int
+	valid    int64
+	torn     int64
+}
+
+// replay loads the snapshot, if any, then applies the events after it,
+// reading the log from where the snapshot left off. p must be new and not
+// yet shared.
+func (p *PaymentProcessor) replay(logPath, snapshotPath string) (*replayResult, error) {
+	result := &replayResult{}
+	if snapshotPath != "" {
+		info, err := p.loadSnapshot(snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		result.snapshot, result.lastSeq = info, info.seq
+	}
+	valid, torn, err := readEvents(logPath, result.snapshot.offset, func(e *event, _ int64) error {
+		if e.Seq != result.lastSeq+1 {
+			return fmt.Errorf("%w: sequence %d follows %d", ErrCorruptEvent, e.Seq, result.lastSeq)
+		}
+		if err := p.apply(e); err != nil {
+			return err
+		}
+		result.lastSeq = e.Seq
+		result.events++
+		if e.Type == eventRejected {
+			result.rejected++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.valid, result.torn = valid, torn
+	p.restoreHolds()
+	return result, nil
+}
+
+// apply replays one event
+func (p *PaymentProcessor) apply(e *event) error {
+	sums := make(map[string]int64)
+	for _, entry := range e.Entries {
+		sums[entry.Amount.Currency] += entry.delta().Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%w: event %d is off by %s", ErrLedgerUnbalanced, e.Seq, NewMoney(sum, currency))
+		}
+	}
+	l := p.ledger
+	for _, entry := range e.Entries {
+		acct := p.accountOrCreate(entry.Account, entry.Amount.Currency)
+		balance, err := acct.balance.Add(entry.delta())
+		if err != nil {
+			return err
+		}
+		acct.balance = balance
+		if entry.Seq != len(l.entries)+1 {
+			return fmt.Errorf("%w: journal entry %d follows %d", ErrCorruptEvent, entry.Seq, len(l.entries))
+		}
+		l.entries = append(l.entries, entry)
+		l.byAccount[entry.Account] = append(l.byAccount[entry.Account], len(l.entries)-1)
+	}
+	if e.Tx != nil {
+		p.transactions[e.Tx.Transaction.ID] = p.restoreState(e.Tx)
+	}
+	if e.Account != nil {
+		p.restoreAccount(e.Account)
+	}
+	return nil
+}
+
+// restoreHolds recomputes held funds from the authorized transactions
+func (p *PaymentProcessor) restoreHolds() {
+	for _, acct := range p.accounts {
+		acct.held = Money{Currency: acct.currency}
+	}
+	for _, s := range p.transactions {
+		if s.tx.Status == StatusAuthorized {
+			s.from.held, _ = s.from.held.Add(s.hold)
+		}
+	}
+}
+
+// snapshot is the state of a processor as of an event, apart from its
+// ledger. Journal entries are appended to a journal file next to the
+// snapshot instead, so each snapshot only writes the entries since the last.
+type snapshot struct {
+	Seq int64 `json:"seq"`
+	// Offset is the length of the event log up to and including event Seq
+	Offset int64 `json:"offset"`
+	// JournalEntries is how many entries of the journal file the ledger had
+	JournalEntries int               `json:"journal_entries"`
+	Accounts       []snapshotAccount `json:"accounts"`
+	Transactions   []*txRecord       `json:"transactions"`
+}
+
+type snapshotAccount struct {
+	accountRecord
+	Balance Money `json:"balance"`
+}
+
+// snapshotInfo locates a loaded snapshot in the event log and its journal
+type snapshotInfo struct {
+	seq            int64
+	offset         int64
+	journalEntries int
+	// journalBytes is the length of the journal up to its last entry in use
+	journalBytes int64
+}
+
+// journalPath is where the ledger of the snapshot at snapshotPath is kept
+func journalPath(snapshotPath string) string {
+	return snapshotPath + ".journal"
+}
+
+// takeSnapshot captures the state of a processor that is not in use
+func (p *PaymentProcessor) takeSnapshot(seq, offset int64) *snapshot {
+	s := &snapshot{Seq: seq, Offset: offset, JournalEntries: len(p.ledger.entries)}
+	for _, acct := range p.accounts {
+		s.Accounts = append(s.Accounts, snapshotAccount{accountRecord: *acct.record(), Balance: acct.balance})
+	}
+	sort.Slice(s.Accounts, func(i, j int) bool { return s.Accounts[i].ID < s.Accounts[j].ID })
+	for _, state := range p.transactions {
+		s.Transactions = append(s.Transactions, state.record())
+	}
+	sort.Slice(s.Transactions, func(i, j int) bool { return s.Transactions[i].Transaction.ID < s.Transactions[j].Transaction.ID })
+	return s
+}
+
+// loadSnapshot restores a new processor from a snapshot file and its
+// journal. A missing file is an empty snapshot.
+func (p *PaymentProcessor) loadSnapshot(path string) (snapshotInfo, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshotInfo{}, nil
+	}
+	if err != nil {
+		return snapshotInfo{}, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var s snapshot
+	if err := decodeRecord(data, &s); err != nil {
+		return snapshotInfo{}, fmt.Errorf("snapshot: %w", err)
+	}
+	for _, a := range s.Accounts {
+		p.restoreAccount(&a.accountRecord).balance = a.Balance
+	}
+	journalBytes, err := p.readJournal(journalPath(path), s.JournalEntries)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	for _, r := range s.Transactions {
+		p.transactions[r.Transaction.ID] = p.restoreState(r)
+	}
+	return snapshotInfo{seq: s.Seq, offset: s.Offset, journalEntries: s.JournalEntries, journalBytes: journalBytes}, nil
+}
+
+// readJournal loads the first n entries of a journal file into the ledger and
+// returns their length in bytes. Entries after them were written by a
+// snapshot that did not complete and are ignored.
+func (p *PaymentProcessor) readJournal(path string, n int) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open snapshot journal: %w", err)
+	}
+	defer file.Close()
+	l := p.ledger
+	br := bufio.NewReader(file)
+	var size int64
+	for len(l.entries) < n {
+		data, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return 0, fmt.Errorf("%w: snapshot journal has %d of %d entries", ErrCorruptEvent, len(l.entries), n)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read snapshot journal: %w", err)
+		}
+		var entry JournalEntry
+		if err := decodeRecord(data, &entry); err != nil {
+			return 0, fmt.Errorf("snapshot journal entry %d: %w", len(l.entries)+1, err)
+		}
+		l.entries = append(l.entries, entry)
+		l.byAccount[entry.Account] = append(l.byAccount[entry.Account], len(l.entries)-1)
+		size += int64(len(data))
+	}
+	return size, nil
+}
+
+// appendJournal writes entries to the journal file after its first at bytes,
+// dropping anything a failed snapshot left there
+func appendJournal(path string, at int64, entries []JournalEntry) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot journal: %w", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(at); err != nil {
+		return fmt.Errorf("failed to truncate snapshot journal: %w", err)
+	}
+	if _, err := file.Seek(at, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to open snapshot journal: %w", err)
+	}
+	bw := bufio.NewWriter(file)
+	for _, entry := range entries {
+		line, err := encodeRecord(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode journal entry: %w", err)
+		}
+		bw.Write(append(line, '\n'))
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot journal: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot journal: %w", err)
+	}
+	return nil
+}
+
+// snapshotMu serializes snapshot writers, manual and background, so none
+// extends the journal past a snapshot another one is about to replace
+var snapshotMu sync.Mutex
+
+// WriteSnapshot brings the snapshot at snapshotPath up to date with the event
+// log, so later replays only read the events written after it. The journal is
+// extended before the snapshot is replaced, so a crash in between leaves the
+// old snapshot usable.
+func WriteSnapshot(logPath, snapshotPath string) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	p := NewPaymentProcessor()
+	result, err := p.replay(logPath, snapshotPath)
+	if err != nil {
+		return err
+	}
+	if result.events == 0 {
+		return nil
+	}
+	prev := result.snapshot
+	if err := appendJournal(journalPath(snapshotPath), prev.journalBytes, p.ledger.entries[prev.journalEntries:]); err != nil {
+		return err
+	}
+	data, err := encodeRecord(p.takeSnapshot(result.lastSeq, result.valid))
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	tmp := snapshotPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, snapshotPath); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// VerifyReport is the result of VerifyEventLog
+type VerifyReport struct {
+	Events      int
+	Rejected    int
+	SnapshotSeq int64 // zero if there was no snapshot to check
+	TornBytes   int64
+	Mismatches  []string
+}
+
+// OK reports whether verification found no mismatches
+func (r *VerifyReport) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+// VerifyEventLog replays the whole log from the start and reports
+// unbalanced events, cached balances that disagree with the ledger, and any
+// difference between the snapshot, if given, and the log at the same point.
+// The error is non-nil only if the log or snapshot cannot be read.
+func VerifyEventLog(logPath, snapshotPath string) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	var snap *PaymentProcessor
+	var info snapshotInfo
+	if snapshotPath != "" {
+		snap = NewPaymentProcessor()
+		var err error
+		if info, err = snap.loadSnapshot(snapshotPath); err != nil {
+			return report, err
+		}
+		report.SnapshotSeq = info.seq
+	}
+
+	p := NewPaymentProcessor()
+	var lastSeq int64
+	_, torn, err := readEvents(logPath, 0, func(e *event, end int64) error {
+		if e.Seq != lastSeq+1 {
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("event %d follows %d", e.Seq, lastSeq))
+		}
+		lastSeq = e.Seq
+		report.Events++
+		if e.Type == eventRejected {
+			report.Rejected++
+		}
+		if err := p.apply(e); err != nil {
+			if !errors.Is(err, ErrLedgerUnbalanced) {
+				return err
+			}
+			report.Mismatches = append(report.Mismatches, err.Error())
+		}
+		if snap != nil && e.Seq == report.SnapshotSeq {
+			report.Mismatches = append(report.Mismatches, compareBalances(snap, p, e.Seq)...)
+			if end != info.offset {
+				report.Mismatches = append(report.Mismatches, fmt.Sprintf("snapshot at event %d starts at offset %d, log has %d", e.Seq, info.offset, end))
+			}
+			if len(p.ledger.entries) != info.journalEntries {
+				report.Mismatches = append(report.Mismatches, fmt.Sprintf("snapshot at event %d has %d journal entries, log has %d", e.Seq, info.journalEntries, len(p.ledger.entries)))
+			}
+		}
+		return nil
+	})
+	report.TornBytes = torn
+	if err != nil {
+		return report, err
+	}
+	if snap != nil && lastSeq < report.SnapshotSeq {
+		report.Mismatches = append(report.Mismatches,
+			fmt.Sprintf("log ends at event %d before snapshot %d", lastSeq, report.SnapshotSeq))
+	}
+	p.restoreHolds()
+	if _, err := p.TrialBalance(); err != nil {
+		report.Mismatches = append(report.Mismatches, err.Error())
+	}
+	return report, nil
+}
+
+// compareBalances lists the accounts whose balances differ between a snapshot
+// and a replay at the same event
+func compareBalances(snap, replayed *PaymentProcessor, seq int64) []string {
+	var mismatches []string
+	ids := make(map[string]bool)
+	for id := range snap.accounts {
+		ids[id] = true
+	}
+	for id := range replayed.accounts {
+		ids[id] = true
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	for _, id := range sorted {
+		var want, got Money
+		if acct, ok := snap.accounts[id]; ok {
+			want = acct.balance
+		}
+		if acct, ok := replayed.accounts[id]; ok {
+			got = acct.balance
+		}
+		if want != got {
+			mismatches = append(mismatches, fmt.Sprintf("%s: snapshot at event %d has %s, log has %s", id, seq, want, got))
+		}
+	}
+	return mismatches
+}
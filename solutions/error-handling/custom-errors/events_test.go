@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runEventScenario exercises every kind of event
+func runEventScenario(t *testing.T, p *PaymentProcessor) {
+	t.Helper()
+	openAccounts(t, p, "USD", "a", "b", "c")
+	if err := p.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	steps := []*Transaction{
+		{ID: "tx1", Amount: MustParseMoney("30.00", "USD"), From: "a", To: "b"},
+		{ID: "tx2", Amount: MustParseMoney("500.00", "USD"), From: "a", To: "b"},
+	}
+	for _, tx := range steps {
+		p.ProcessTransaction(tx)
+	}
+	if err := p.Refund("tx1", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Authorize(&Transaction{ID: "tx3", Amount: MustParseMoney("50.00", "USD"), From: "a", To: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Authorize(&Transaction{ID: "tx4", Amount: MustParseMoney("5.00", "USD"), From: "a", To: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Void("tx4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.FreezeAccount("c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// processorState captures what a replay must reproduce
+func processorState(t *testing.T, p *PaymentProcessor) map[string]any {
+	t.Helper()
+	state := map[string]any{}
+	for id, acct := range p.accounts {
+		state["balance:"+id] = acct.balance
+		state["held:"+id] = acct.held
+		state["status:"+id] = acct.status
+	}
+	for id, s := range p.transactions {
+		tx := *s.tx
+		tx.Timestamp = tx.Timestamp.UTC() // drop the monotonic reading
+		state["tx:"+id] = tx
+	}
+	state["entries"] = len(p.ledger.entries)
+	return state
+}
+
+func TestEventLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events.jsonl")
+	p, err := OpenPaymentProcessor(logPath, EventLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEventScenario(t, p)
+	want := processorState(t, p)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Deposit("a", MustParseMoney("1.00", "USD")); !errors.Is(err, ErrEventLogClosed) {
+		t.Errorf("Expected ErrEventLogClosed after Close, got %v", err)
+	}
+
+	restored, err := OpenPaymentProcessor(logPath, EventLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if got := processorState(t, restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay differs:\n got %v\nwant %v", got, want)
+	}
+	if _, err := restored.TrialBalance(); err != nil {
+		t.Errorf("Replayed ledger unbalanced: %v", err)
+	}
+
+	// The restored hold on tx3 still limits spending, and the log keeps growing
+	tx := &Transaction{ID: "tx5", Amount: MustParseMoney("40.00", "USD"), From: "a", To: "b"}
+	if err := restored.ProcessTransaction(tx); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Expected the restored hold to apply, got %v", err)
+	}
+	// So does the freeze on c
+	if err := restored.Capture("tx3"); !errors.Is(err, ErrAccountFrozen) {
+		t.Errorf("Expected the restored freeze to apply, got %v", err)
+	}
+	if err := restored.UnfreezeAccount("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Capture("tx3"); err != nil {
+		t.Fatalf("Capture after replay failed: %v", err)
+	}
+
+	report, err := VerifyEventLog(logPath, "")
+	if err != nil || !report.OK() {
+		t.Fatalf("Verify failed: %v %+v", err, report)
+	}
+	if report.Rejected != 2 || report.Events != 15 {
+		t.Errorf("Expected 15 events with 2 rejections, got %+v", report)
+	}
+}
+
+func TestEventLogTornAndCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events.jsonl")
+	p, err := OpenPaymentProcessor(logPath, EventLogOptions{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEventScenario(t, p)
+	want := processorState(t, p)
+	p.Close()
+
+	// A crash mid-write leaves a partial final line, which is dropped
+	file, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0)
+	file.WriteString(`{"crc":12,"data":{"seq":`)
+	file.Close()
+	report, err := VerifyEventLog(logPath, "")
+	if err != nil || report.TornBytes == 0 {
+		t.Errorf("Expected a torn record to be reported, got %+v (%v)", report, err)
+	}
+	restored, err := OpenPaymentProcessor(logPath, EventLogOptions{})
+	if err != nil {
+		t.Fatalf("Torn record should not prevent replay: %v", err)
+	}
+	if got := processorState(t, restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay after torn write differs")
+	}
+	if err := restored.Deposit("b", MustParseMoney("1.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	restored.Close()
+	if report, err := VerifyEventLog(logPath, ""); err != nil || report.TornBytes != 0 || !report.OK() {
+		t.Errorf("Expected the torn record to be replaced cleanly, got %+v (%v)", report, err)
+	}
+
+	// A damaged record in the middle is an error
+	data, _ := os.ReadFile(logPath)
+	damaged := strings.Replace(string(data), `"100.00"`, `"900.00"`, 1)
+	os.WriteFile(logPath, []byte(damaged), 0o644)
+	_, err = OpenPaymentProcessor(logPath, EventLogOptions{})
+	var logErr *EventLogError
+	if !errors.As(err, &logErr) || !errors.Is(err, ErrCorruptEvent) || logErr.Line != 4 {
+		t.Errorf("Expected ErrCorruptEvent on line 4, got %v", err)
+	}
+}
+
+func TestEventLogSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events.jsonl")
+	snapshotPath := filepath.Join(dir, "events.snapshot")
+	var snapshotErr error
+	opts := EventLogOptions{SnapshotPath: snapshotPath, SnapshotEvery: 3, OnSnapshotError: func(err error) { snapshotErr = err }}
+	p, err := OpenPaymentProcessor(logPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEventScenario(t, p)
+	want := processorState(t, p)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if snapshotErr != nil {
+		t.Fatalf("Background snapshot failed: %v", snapshotErr)
+	}
+	if _, err := os.Stat(snapshotPath); err != nil {
+		t.Fatalf("Expected a background snapshot: %v", err)
+	}
+
+	if err := WriteSnapshot(logPath, snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenPaymentProcessor(logPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := processorState(t, restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay from snapshot differs:\n got %v\nwant %v", got, want)
+	}
+	restored.Close()
+
+	report, err := VerifyEventLog(logPath, snapshotPath)
+	if err != nil || !report.OK() || report.SnapshotSeq != 12 {
+		t.Errorf("Expected a clean verification at snapshot 12, got %+v (%v)", report, err)
+	}
+
+	// Replay from an up-to-date snapshot does not read the events before it
+	data, _ := os.ReadFile(logPath)
+	os.WriteFile(logPath, []byte(strings.Replace(string(data), `"100.00"`, `"900.00"`, 1)), 0o644)
+	compacted := NewPaymentProcessor()
+	if _, err := compacted.replay(logPath, snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := processorState(t, compacted); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay from snapshot alone differs")
+	}
+	if _, err := VerifyEventLog(logPath, snapshotPath); !errors.Is(err, ErrCorruptEvent) {
+		t.Errorf("Expected verification to read the whole log, got %v", err)
+	}
+	os.WriteFile(logPath, data, 0o644)
+
+	// A log shorter than the snapshot is an error
+	os.WriteFile(logPath, data[:len(data)/2], 0o644)
+	if _, err := NewPaymentProcessor().replay(logPath, snapshotPath); !errors.Is(err, ErrCorruptEvent) {
+		t.Errorf("Expected a truncated log to be reported, got %v", err)
+	}
+	os.WriteFile(logPath, data, 0o644)
+
+	// A snapshot that disagrees with the log is reported
+	tampered := NewPaymentProcessor()
+	info, err := tampered.loadSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.accounts["b"].balance = MustParseMoney("999.00", "USD")
+	data, _ = encodeRecord(tampered.takeSnapshot(info.seq, info.offset))
+	os.WriteFile(snapshotPath, data, 0o644)
+	report, err = VerifyEventLog(logPath, snapshotPath)
+	if err != nil || report.OK() || !strings.Contains(report.Mismatches[0], "b: snapshot at event 12 has 999.00 USD") {
+		t.Errorf("Expected a balance mismatch for b, got %+v (%v)", report, err)
+	}
+}
+
+func TestSnapshotWritersTakeTurns(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events.jsonl")
+	snapshotPath := filepath.Join(dir, "events.snapshot")
+	p, err := OpenPaymentProcessor(logPath, EventLogOptions{SnapshotPath: snapshotPath, SnapshotEvery: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While another writer holds the snapshot, the background one waits
+	snapshotMu.Lock()
+	openAccounts(t, p, "USD", "a")
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(snapshotPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the background snapshot to wait, got %v", err)
+	}
+	snapshotMu.Unlock()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := VerifyEventLog(logPath, snapshotPath); err != nil || !report.OK() || report.SnapshotSeq != 1 {
+		t.Errorf("Expected a clean snapshot at event 1, got %+v (%v)", report, err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exchange rate errors
+var (
+	ErrRateNotFound = errors.New("exchange rate not found")
+	ErrStaleRate    = errors.New("exchange rate is stale")
+)
+
+// ExchangeRate converts one unit of From into Rate units of To
+type ExchangeRate struct {
+	From      string
+	To        string
+	Rate      *big.Rat
+	Timestamp time.Time
+}
+
+// ExchangeRateProvider supplies exchange rates
+type ExchangeRateProvider interface {
+	Rate(from, to string) (ExchangeRate, error)
+}
+
+// RateError describes a missing or stale exchange rate. It unwraps to
+// ErrRateNotFound or ErrStaleRate.
+type RateError struct {
+	Err       error
+	From      string
+	To        string
+	Timestamp time.Time // zero when the rate was not found
+	Age       time.Duration
+}
+
+func (e *RateError) Error() string {
+	if e.Timestamp.IsZero() {
+		return fmt.Sprintf("%v: %s->%s", e.Err, e.From, e.To)
+	}
+	return fmt.Sprintf("%v: %s->%s quoted at %s (%s old)",
+		e.Err, e.From, e.To, e.Timestamp.Format(time.RFC3339), e.Age.Round(time.Second))
+}
+
+func (e *RateError) Unwrap() error {
+	return e.Err
+}
+
+// Conversion records how a foreign-currency transaction was settled
+type Conversion struct {
+	Rate          string    // rate applied to the transaction currency, source side if converted
+	RateTimestamp time.Time // when that rate was quoted
+	Debited       Money     // amount taken from the source account, excluding Fee
+	Credited      Money     // amount paid into the destination account
+	Fee           Money     // conversion fee charged to the source account
+}
+
+// StaticRateProvider serves rates from an in-memory table. Inverse rates are
+// derived automatically when only one direction is set.
+type StaticRateProvider struct {
+	mu    sync.RWMutex
+	rates map[[2]string]ExchangeRate
+}
+
+// NewStaticRateProvider creates an empty rate table
+func NewStaticRateProvider() *StaticRateProvider {
+	return &StaticRateProvider{rates: make(map[[2]string]ExchangeRate)}
+}
+
+// Set stores the rate for one unit of from in to, e.g. Set("EUR", "USD", "1.08", ts)
+func (p *StaticRateProvider) Set(from, to, rate string, timestamp time.Time) error {
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return fmt.Errorf("invalid exchange rate %q", rate)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rates[[2]string{from, to}] = ExchangeRate{From: from, To: to, Rate: r, Timestamp: timestamp}
+	return nil
+}
+
+func (p *StaticRateProvider) Rate(from, to string) (ExchangeRate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return lookupRate(p.rates, from, to)
+}
+
+func lookupRate(rates map[[2]string]ExchangeRate, from, to string) (ExchangeRate, error) {
+	if from == to {
+		return ExchangeRate{From: from, To: to, Rate: big.NewRat(1, 1)}, nil
+	}
+	if rate, ok := rates[[2]string{from, to}]; ok {
+		return rate, nil
+	}
+	if rate, ok := rates[[2]string{to, from}]; ok {
+		return ExchangeRate{From: from, To: to, Rate: new(big.Rat).Inv(rate.Rate), Timestamp: rate.Timestamp}, nil
+	}
+	return ExchangeRate{}, &RateError{Err: ErrRateNotFound, From: from, To: to}
+}
+
+// rateFileEntry is one rate in a rate file
+type rateFileEntry struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      string    `json:"rate"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// FileRateProvider serves rates from a JSON file, reloading it whenever its
+// modification time changes. The file holds an array of
+// {"from": "EUR", "to": "USD", "rate": "1.08", "timestamp": "..."} objects.
+type FileRateProvider struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	rates   map[[2]string]ExchangeRate
+}
+
+// NewFileRateProvider loads rates from path
+func NewFileRateProvider(path string) (*FileRateProvider, error) {
+	p := &FileRateProvider{path: path}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reload re-reads the file if it changed. The caller must hold p.mu or be the constructor.
+func (p *FileRateProvider) reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat rate file: %w", err)
+	}
+	if p.rates != nil && info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to read rate file: %w", err)
+	}
+	var entries []rateFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to decode rate file: %w", err)
+	}
+	rates := make(map[[2]string]ExchangeRate, len(entries))
+	for _, e := range entries {
+		r, ok := new(big.Rat).SetString(e.Rate)
+		if !ok || r.Sign() <= 0 {
+			return fmt.Errorf("invalid exchange rate %q for %s->%s", e.Rate, e.From, e.To)
+		}
+		rates[[2]string{e.From, e.To}] = ExchangeRate{From: e.From, To: e.To, Rate: r, Timestamp: e.Timestamp}
+	}
+	p.rates = rates
+	p.modTime = info.ModTime()
+	return nil
+}
+
+func (p *FileRateProvider) Rate(from, to string) (ExchangeRate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.reload(); err != nil {
+		return ExchangeRate{}, err
+	}
+	return lookupRate(p.rates, from, to)
+}
+
+// SetExchangeRates configures the provider used for foreign-currency
+// transactions. Rates older than maxAge are rejected; zero disables the check.
+func (p *PaymentProcessor) SetExchangeRates(provider ExchangeRateProvider, maxAge time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rates = provider
+	p.maxRateAge = maxAge
+}
+
+// SetConversionFee sets the fee, in basis points of the debited amount,
+// charged on transactions that need a currency conversion
+func (p *PaymentProcessor) SetConversionFee(bps int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conversionFeeBps = bps
+}
+
+// FeeAccount returns the account that collects conversion fees in a currency
+func FeeAccount(currency string) string {
+	return "fees:" + currency
+}
+
+// convert returns amount expressed in currency, using the configured provider
+func (p *PaymentProcessor) convert(amount Money, currency string) (Money, ExchangeRate, error) {
+	if amount.Currency == currency {
+		return amount, ExchangeRate{From: currency, To: currency, Rate: big.NewRat(1, 1)}, nil
+	}
+	p.mu.RLock()
+	provider, maxAge := p.rates, p.maxRateAge
+	p.mu.RUnlock()
+	if provider == nil {
+		return Money{}, ExchangeRate{}, &RateError{Err: ErrRateNotFound, From: amount.Currency, To: currency}
+	}
+	rate, err := provider.Rate(amount.Currency, currency)
+	if err != nil {
+		return Money{}, ExchangeRate{}, err
+	}
+	if age := p.now().Sub(rate.Timestamp); maxAge > 0 && age > maxAge {
+		return Money{}, ExchangeRate{}, &RateError{
+			Err:       ErrStaleRate,
+			From:      amount.Currency,
+			To:        currency,
+			Timestamp: rate.Timestamp,
+			Age:       age,
+		}
+	}
+	converted, err := RoundMoney(new(big.Rat).Mul(amount.Rat(), rate.Rate), currency, RoundHalfEven)
+	if err != nil {
+		return Money{}, ExchangeRate{}, err
+	}
+	return converted, rate, nil
+}
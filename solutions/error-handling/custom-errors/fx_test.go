@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestForeignCurrencyTransaction(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rates := NewStaticRateProvider()
+	if err := rates.Set("EUR", "USD", "1.10", now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	processor := NewPaymentProcessor()
+	processor.now = func() time.Time { return now }
+	processor.SetExchangeRates(rates, time.Hour)
+	processor.SetConversionFee(100) // 1%
+	openAccounts(t, processor, "USD", "us")
+	if err := processor.Deposit("us", MustParseMoney("200.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, processor, "EUR", "eu")
+
+	tx := &Transaction{ID: "fx1", Amount: MustParseMoney("50.00", "EUR"), From: "us", To: "eu"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	c := tx.Conversion
+	if c == nil {
+		t.Fatal("Expected conversion details on the transaction")
+	}
+	if c.Debited != MustParseMoney("55.00", "USD") || c.Fee != MustParseMoney("0.55", "USD") || c.Credited != MustParseMoney("50.00", "EUR") {
+		t.Errorf("Unexpected conversion: %+v", c)
+	}
+	if balance, _ := processor.GetBalance("us"); balance != MustParseMoney("144.45", "USD") {
+		t.Errorf("Expected 144.45 USD, got %s", balance)
+	}
+	if balance, _ := processor.GetBalance(FeeAccount("USD")); balance != MustParseMoney("0.55", "USD") {
+		t.Errorf("Expected 0.55 USD in fees, got %s", balance)
+	}
+
+	// The inverse direction is derived from the same quote
+	back := &Transaction{ID: "fx2", Amount: MustParseMoney("11.00", "USD"), From: "eu", To: "us"}
+	if err := processor.ProcessTransaction(back); err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	if back.Conversion.Debited != MustParseMoney("10.00", "EUR") {
+		t.Errorf("Expected 10.00 EUR debited, got %s", back.Conversion.Debited)
+	}
+}
+
+func TestMissingAndStaleRates(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rates := NewStaticRateProvider()
+	if err := rates.Set("EUR", "USD", "1.10", now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	processor := NewPaymentProcessor()
+	processor.now = func() time.Time { return now }
+	processor.SetExchangeRates(rates, time.Hour)
+	openAccounts(t, processor, "USD", "us", "x")
+	if err := processor.Deposit("us", MustParseMoney("200.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := processor.ProcessTransaction(&Transaction{ID: "a", Amount: MustParseMoney("1.00", "EUR"), From: "us", To: "x"})
+	var rateErr *RateError
+	if !errors.Is(err, ErrStaleRate) || !errors.As(err, &rateErr) || rateErr.Age != 2*time.Hour {
+		t.Errorf("Expected stale rate error, got %v", err)
+	}
+
+	err = processor.ProcessTransaction(&Transaction{ID: "b", Amount: MustParseMoney("1.00", "GBP"), From: "us", To: "x"})
+	var txErr *TransactionError
+	if !errors.Is(err, ErrRateNotFound) || !errors.As(err, &txErr) || txErr.TxID != "b" {
+		t.Errorf("Expected missing rate error, got %v", err)
+	}
+
+	err = processor.ProcessTransaction(&Transaction{ID: "c", Amount: NewMoney(100, "XXX"), From: "us", To: "x"})
+	if !errors.Is(err, ErrUnsupportedCurrency) {
+		t.Errorf("Expected ErrUnsupportedCurrency, got %v", err)
+	}
+}
+
+func TestFileRateProviderReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	write := func(rate string, mtime time.Time) {
+		data := `[{"from":"GBP","to":"USD","rate":"` + rate + `","timestamp":"2024-06-01T00:00:00Z"}]`
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("1.25", time.Unix(1000, 0))
+	provider, err := NewFileRateProvider(path)
+	if err != nil {
+		t.Fatalf("NewFileRateProvider failed: %v", err)
+	}
+	rate, err := provider.Rate("GBP", "USD")
+	if err != nil || rate.Rate.FloatString(2) != "1.25" {
+		t.Errorf("Expected rate 1.25, got %v (err %v)", rate.Rate, err)
+	}
+
+	write("1.30", time.Unix(2000, 0))
+	rate, err = provider.Rate("USD", "GBP")
+	if err != nil || rate.Rate.RatString() != "10/13" {
+		t.Errorf("Expected reloaded inverse rate 10/13, got %v (err %v)", rate.Rate, err)
+	}
+}
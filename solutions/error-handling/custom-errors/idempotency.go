@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// idempotencyRecord remembers the outcome of the first request made with a key
+type idempotencyRecord struct {
+	fingerprint string
+	expires     time.Time
+	done        chan struct{} // closed once tx and err are set
+	tx          *Transaction
+	err         error
+}
+
+// idempotencyStore maps keys to records. Records are expired lazily in
+// insertion order, which matches expiry order while the TTL is unchanged.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[string]*idempotencyRecord
+	order   []queuedKey
+}
+
+type queuedKey struct {
+	key string
+	rec *idempotencyRecord
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, records: make(map[string]*idempotencyRecord)}
+}
+
+// SetIdempotencyTTL sets how long an idempotency key is remembered
+func (p *PaymentProcessor) SetIdempotencyTTL(ttl time.Duration) {
+	p.idempotency.mu.Lock()
+	defer p.idempotency.mu.Unlock()
+	p.idempotency.ttl = ttl
+}
+
+// requestFingerprint identifies the payload a key was first used with
+func requestFingerprint(tx *Transaction) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%q|%d|%q|%q|%q",
+		tx.ID, tx.Amount.Amount, tx.Amount.Currency, tx.From, tx.To)))
+	return hex.EncodeToString(sum[:])
+}
+
+// withIdempotency runs process once per idempotency key. Replaying an
+// identical request returns the original result, waiting for it if the first
+// attempt is still in flight; reusing the key for a different request fails
+// with ErrIdempotencyKeyReused. The original result is observed once, when
+// process returns it, so replays do not count the same error again.
+func (p *PaymentProcessor) withIdempotency(tx *Transaction, process func(*Transaction) error) error {
+	s := p.idempotency
+	fingerprint := requestFingerprint(tx)
+	now := p.now()
+
+	s.mu.Lock()
+	s.expire(now)
+	rec, exists := s.records[tx.IdempotencyKey]
+	if exists && !now.Before(rec.expires) {
+		exists = false
+	}
+	if !exists {
+		rec = &idempotencyRecord{fingerprint: fingerprint, expires: now.Add(s.ttl), done: make(chan struct{})}
+		s.records[tx.IdempotencyKey] = rec
+		s.order = append(s.order, queuedKey{key: tx.IdempotencyKey, rec: rec})
+	}
+	s.mu.Unlock()
+
+	if exists {
+		if rec.fingerprint != fingerprint {
+			return p.observe(newTransactionError(tx, ErrIdempotencyKeyReused, "idempotency check failed"))
+		}
+		<-rec.done
+		if rec.err == nil && rec.tx != tx {
+			tx.Status = rec.tx.Status
+			tx.Conversion = rec.tx.Conversion
+		}
+		return rec.err
+	}
+
+	rec.tx = tx
+	rec.err = p.observe(process(tx))
+	close(rec.done)
+	return rec.err
+}
+
+// expire drops completed records whose TTL has passed. Records still in
+// flight stay at the front of the queue until they complete. The caller must
+// hold s.mu.
+func (s *idempotencyStore) expire(now time.Time) {
+	var inFlight []queuedKey
+	for len(s.order) > 0 && !now.Before(s.order[0].rec.expires) {
+		front := s.order[0]
+		s.order = s.order[1:]
+		// The key may have been reused since; only drop the record we queued
+		if s.records[front.key] != front.rec {
+			continue
+		}
+		if !front.rec.isDone() {
+			inFlight = append(inFlight, front)
+			continue
+		}
+		delete(s.records, front.key)
+	}
+	if len(inFlight) > 0 {
+		s.order = append(inFlight, s.order...)
+	}
+}
+
+func (r *idempotencyRecord) isDone() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	newTx := func() *Transaction {
+		return &Transaction{ID: "tx1", Amount: MustParseMoney("4.00", "USD"), From: "a", To: "b", IdempotencyKey: "key-1"}
+	}
+	if err := processor.ProcessTransaction(newTx()); err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	retry := newTx()
+	if err := processor.ProcessTransaction(retry); err != nil {
+		t.Errorf("Replay should succeed like the original, got %v", err)
+	}
+	if retry.Status != StatusCaptured {
+		t.Errorf("Replay should report the original status, got %q", retry.Status)
+	}
+	if balance, _ := processor.GetBalance("a"); balance != MustParseMoney("6.00", "USD") {
+		t.Errorf("Expected a single debit leaving 6.00 USD, got %s", balance)
+	}
+
+	// Without a key the same ID is still a duplicate
+	plain := newTx()
+	plain.IdempotencyKey = ""
+	if err := processor.ProcessTransaction(plain); !errors.Is(err, ErrDuplicateTransaction) {
+		t.Errorf("Expected ErrDuplicateTransaction, got %v", err)
+	}
+
+	changed := newTx()
+	changed.Amount = MustParseMoney("5.00", "USD")
+	if err := processor.ProcessTransaction(changed); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("Expected ErrIdempotencyKeyReused, got %v", err)
+	}
+}
+
+func TestIdempotentReplayOfFailure(t *testing.T) {
+	processor := NewPaymentProcessor()
+	metrics := NewErrorMetrics(MetricsOptions{})
+	processor.SetErrorRecorder(metrics)
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("1.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	tx := &Transaction{ID: "big", Amount: MustParseMoney("5.00", "USD"), From: "a", To: "b", IdempotencyKey: "key-2"}
+	first := processor.ProcessTransaction(tx)
+	if !errors.Is(first, ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got %v", first)
+	}
+
+	// Topping up does not change the replayed answer
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	replay := *tx
+	if err := processor.ProcessTransaction(&replay); err != first {
+		t.Errorf("Expected the original error to be replayed, got %v", err)
+	}
+	if s := metrics.Snapshot(); s.Total != 1 || s.BySentinel["ErrInsufficientFunds"] != 1 {
+		t.Errorf("Expected the replayed error to be counted once, got %v", s.BySentinel)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	processor := NewPaymentProcessor()
+	processor.now = func() time.Time { return now }
+	processor.SetIdempotencyTTL(time.Minute)
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &Transaction{ID: "t1", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b", IdempotencyKey: "k"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	other := &Transaction{ID: "t2", Amount: MustParseMoney("2.00", "USD"), From: "a", To: "b", IdempotencyKey: "k"}
+	if err := processor.ProcessTransaction(other); err != nil {
+		t.Errorf("Expired key should be reusable, got %v", err)
+	}
+}
+
+func TestIdempotencyExpiryKeepsInFlightRecords(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newIdempotencyStore(time.Minute)
+	slow := &idempotencyRecord{expires: now.Add(time.Minute), done: make(chan struct{})}
+	quick := &idempotencyRecord{expires: now.Add(time.Minute), done: make(chan struct{})}
+	close(quick.done)
+	s.records["slow"], s.records["quick"] = slow, quick
+	s.order = []queuedKey{{"slow", slow}, {"quick", quick}}
+
+	// An expired record still in flight is kept for later
+	s.expire(now.Add(2 * time.Minute))
+	if len(s.records) != 1 || s.records["slow"] != slow || len(s.order) != 1 {
+		t.Fatalf("Expected only the in-flight record to remain, got %v and %v", s.records, s.order)
+	}
+	close(slow.done)
+	s.expire(now.Add(2 * time.Minute))
+	if len(s.records) != 0 || len(s.order) != 0 {
+		t.Errorf("Expected the record to be dropped once done, got %v and %v", s.records, s.order)
+	}
+}
+
+func TestConcurrentIdempotentRequests(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := &Transaction{ID: "once", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b", IdempotencyKey: "k"}
+			if err := processor.ProcessTransaction(tx); err != nil {
+				t.Errorf("Every replay should succeed, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if balance, _ := processor.GetBalance("b"); balance != MustParseMoney("1.00", "USD") {
+		t.Errorf("Expected exactly one credit, got %s", balance)
+	}
+}
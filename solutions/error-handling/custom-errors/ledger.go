@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ErrLedgerUnbalanced is returned when debits and credits do not match
+var ErrLedgerUnbalanced = errors.New("ledger is unbalanced")
+
+// Side is the side of the journal an entry is posted to
+type Side int
+
+const (
+	Debit Side = iota
+	Credit
+)
+
+func (s Side) String() string {
+	if s == Credit {
+		return "credit"
+	}
+	return "debit"
+}
+
+// MarshalText encodes the side as "debit" or "credit"
+func (s Side) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes the form written by MarshalText
+func (s *Side) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "debit":
+		*s = Debit
+	case "credit":
+		*s = Credit
+	default:
+		return fmt.Errorf("invalid side %q", text)
+	}
+	return nil
+}
+
+// Opposite returns the other side of the journal
+func (s Side) Opposite() Side {
+	if s == Credit {
+		return Debit
+	}
+	return Credit
+}
+
+// JournalEntry is one line of the ledger. Every transaction posts a set of
+// entries whose debits and credits balance in each currency. Account balances
+// follow the customer's point of view: credits increase them, debits decrease them.
+type JournalEntry struct {
+	Seq     int
+	TxID    string
+	Account string
+	Side    Side
+	Amount  Money // always positive
+	Time    time.Time
+}
+
+// delta returns the signed effect of the entry on its account's balance
+func (e JournalEntry) delta() Money {
+	if e.Side == Debit {
+		return Money{Amount: -e.Amount.Amount, Currency: e.Amount.Currency}
+	}
+	return e.Amount
+}
+
+// ExternalAccount returns the account that funds deposits from outside the system
+func ExternalAccount(currency string) string {
+	return "external:" + currency
+}
+
+// FXAccount returns the clearing account that balances currency conversions
+func FXAccount(currency string) string {
+	return "fx:" + currency
+}
+
+// Ledger is an append-only journal of balanced postings
+type Ledger struct {
+	mu        sync.RWMutex
+	entries   []JournalEntry
+	byAccount map[string][]int // indexes into entries, in posting order
+}
+
+// NewLedger creates an empty ledger
+func NewLedger() *Ledger {
+	return &Ledger{byAccount: make(map[string][]int)}
+}
+
+// posting is an entry that has not been written to the ledger yet
+type posting struct {
+	acct   *account
+	side   Side
+	amount Money
+}
+
+// post validates and writes a balanced set of postings and updates the
+// cached balance of every affected account. The entries are added to e, which
+// is written to the event log first. The caller must hold the lock of every
+// account in postings; on error nothing is written.
+func (p *PaymentProcessor) post(txID string, postings []posting, e *event) error {
+	sums := make(map[string]int64)
+	staged := make(map[*account]Money, len(postings))
+	for _, e := range postings {
+		if e.amount.IsNegative() || e.amount.Currency != e.acct.currency {
+			return fmt.Errorf("invalid posting of %s to %s", e.amount, e.acct.id)
+		}
+		if _, ok := staged[e.acct]; !ok {
+			staged[e.acct] = e.acct.balance
+		}
+		var err error
+		entry := JournalEntry{Side: e.side, Amount: e.amount}
+		staged[e.acct], err = staged[e.acct].Add(entry.delta())
+		if err != nil {
+			return err
+		}
+		sums[e.amount.Currency] += entry.delta().Amount
+	}
+	for currency, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("%w: postings for %s are off by %s", ErrLedgerUnbalanced, txID, NewMoney(sum, currency))
+		}
+	}
+
+	l := p.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Read the clock under the ledger lock so entry times never go backwards
+	now := p.now()
+	entries := make([]JournalEntry, 0, len(postings))
+	for _, e := range postings {
+		if e.amount.IsZero() {
+			continue
+		}
+		entries = append(entries, JournalEntry{
+			Seq:     len(l.entries) + len(entries) + 1,
+			TxID:    txID,
+			Account: e.acct.id,
+			Side:    e.side,
+			Amount:  e.amount,
+			Time:    now,
+		})
+	}
+	// The ledger lock orders the log like the journal
+	e.Time, e.Entries = now, entries
+	if err := p.logEvent(e); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		l.entries = append(l.entries, entry)
+		l.byAccount[entry.Account] = append(l.byAccount[entry.Account], len(l.entries)-1)
+	}
+
+	for acct, balance := range staged {
+		acct.balance = balance
+	}
+	return nil
+}
+
+// GetBalanceAt derives an account's balance as of t from the ledger
+func (p *PaymentProcessor) GetBalanceAt(accountID string, t time.Time) (Money, error) {
+	acct, exists := p.account(accountID)
+	if !exists {
+		return Money{}, p.observe(&TransactionError{
+			Err:     ErrAccountNotFound,
+			From:    accountID,
+			Context: "balance lookup failed",
+		})
+	}
+	l := p.ledger
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	balance := Money{Currency: acct.currency}
+	for _, i := range l.byAccount[accountID] {
+		e := l.entries[i]
+		if e.Time.After(t) {
+			break
+		}
+		var err error
+		if balance, err = balance.Add(e.delta()); err != nil {
+			return Money{}, err
+		}
+	}
+	return balance, nil
+}
+
+// StatementLine is a journal entry with the account balance after it
+type StatementLine struct {
+	JournalEntry
+	Balance Money
+	// Counterparty is the other account of the transaction the entry
+	// belongs to, empty for deposits
+	Counterparty string
+}
+
+// Statement lists an account's entries in [From, To) with running balances
+type Statement struct {
+	Account string
+	Owner   string
+	From    time.Time
+	To      time.Time
+	Opening Money
+	Closing Money
+	Lines   []StatementLine
+}
+
+// Statement returns the entries posted to an account in [from, to)
+func (p *PaymentProcessor) Statement(accountID string, from, to time.Time) (*Statement, error) {
+	st, err := p.statement(accountID, from, to)
+	return st, p.observe(err)
+}
+
+func (p *PaymentProcessor) statement(accountID string, from, to time.Time) (*Statement, error) {
+	acct, exists := p.account(accountID)
+	if !exists {
+		return nil, &TransactionError{
+			Err:     ErrAccountNotFound,
+			From:    accountID,
+			Context: "statement failed",
+		}
+	}
+	st := &Statement{Account: accountID, Owner: acct.owner, From: from, To: to, Opening: Money{Currency: acct.currency}}
+	if err := p.statementLines(st); err != nil {
+		return nil, err
+	}
+	// Counterparties come from the transactions, read after the ledger lock is released
+	for i := range st.Lines {
+		line := &st.Lines[i]
+		state, err := p.lookupState(strings.TrimSuffix(line.TxID, ":refund"))
+		if err != nil {
+			continue
+		}
+		line.Counterparty = state.to.id
+		if state.to.id == accountID {
+			line.Counterparty = state.from.id
+		}
+	}
+	return st, nil
+}
+
+// statementLines fills in the balances and lines of st from the ledger
+func (p *PaymentProcessor) statementLines(st *Statement) error {
+	l := p.ledger
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	balance := st.Opening
+	for _, i := range l.byAccount[st.Account] {
+		e := l.entries[i]
+		if !e.Time.Before(st.To) {
+			break
+		}
+		var err error
+		if balance, err = balance.Add(e.delta()); err != nil {
+			return err
+		}
+		if e.Time.Before(st.From) {
+			st.Opening = balance
+			continue
+		}
+		st.Lines = append(st.Lines, StatementLine{JournalEntry: e, Balance: balance})
+	}
+	st.Closing = balance
+	return nil
+}
+
+// MonthlyStatement returns an account's statement for a calendar month,
+// with month boundaries in loc
+func (p *PaymentProcessor) MonthlyStatement(accountID string, year int, month time.Month, loc *time.Location) (*Statement, error) {
+	from := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	return p.Statement(accountID, from, from.AddDate(0, 1, 0))
+}
+
+// WriteText renders the statement as a plain-text table, with times in the
+// location of st.From
+func (st *Statement) WriteText(w io.Writer) error {
+	loc := st.From.Location()
+	title := st.Account
+	if st.Owner != "" {
+		title += " (" + st.Owner + ")"
+	}
+	fmt.Fprintf(w, "Statement for %s\n", title)
+	fmt.Fprintf(w, "Period %s to %s\n\n", st.From.Format(time.DateOnly), st.To.Add(-time.Nanosecond).Format(time.DateOnly))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Date\tTransaction\tCounterparty\tAmount\tBalance\n")
+	fmt.Fprintf(tw, "Opening balance\t\t\t\t%s\n", st.Opening)
+	for _, line := range st.Lines {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", line.Time.In(loc).Format(time.DateTime),
+			line.TxID, line.Counterparty, line.delta().Decimal(), line.Balance)
+	}
+	fmt.Fprintf(tw, "Closing balance\t\t\t\t%s\n", st.Closing)
+	return tw.Flush()
+}
+
+// TrialBalance totals debits and credits per currency
+type TrialBalance struct {
+	Debits  map[string]Money
+	Credits map[string]Money
+}
+
+// TrialBalance sums the ledger and checks that debits equal credits in every
+// currency and that every cached balance matches the ledger. It returns the
+// totals along with an ErrLedgerUnbalanced error if any check fails.
+func (p *PaymentProcessor) TrialBalance() (*TrialBalance, error) {
+	p.mu.RLock()
+	accounts := make([]*account, 0, len(p.accounts))
+	for _, acct := range p.accounts {
+		accounts = append(accounts, acct)
+	}
+	p.mu.RUnlock()
+	// Hold every account lock so no posting is half-applied while we read
+	unlock := lockAccounts(accounts...)
+	defer unlock()
+
+	l := p.ledger
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	tb := &TrialBalance{Debits: make(map[string]Money), Credits: make(map[string]Money)}
+	derived := make(map[string]int64)
+	for _, e := range l.entries {
+		totals := tb.Debits
+		if e.Side == Credit {
+			totals = tb.Credits
+		}
+		sum, ok := totals[e.Amount.Currency]
+		if !ok {
+			sum = Money{Currency: e.Amount.Currency}
+		}
+		sum, err := sum.Add(e.Amount)
+		if err != nil {
+			return nil, err
+		}
+		totals[e.Amount.Currency] = sum
+		derived[e.Account] += e.delta().Amount
+	}
+
+	var problems []error
+	currencies := make([]string, 0, len(tb.Debits)+len(tb.Credits))
+	for currency := range tb.Debits {
+		currencies = append(currencies, currency)
+	}
+	for currency := range tb.Credits {
+		if _, ok := tb.Debits[currency]; !ok {
+			currencies = append(currencies, currency)
+		}
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		if tb.Debits[currency].Amount != tb.Credits[currency].Amount {
+			problems = append(problems, fmt.Errorf("%s debits %s != credits %s",
+				currency, tb.Debits[currency].Decimal(), tb.Credits[currency].Decimal()))
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].id < accounts[j].id })
+	for _, acct := range accounts {
+		if acct.balance.Amount != derived[acct.id] {
+			problems = append(problems, fmt.Errorf("%s cached balance %s != ledger %s",
+				acct.id, acct.balance, NewMoney(derived[acct.id], acct.currency)))
+		}
+	}
+	if len(problems) > 0 {
+		return tb, fmt.Errorf("%w: %w", ErrLedgerUnbalanced, errors.Join(problems...))
+	}
+	return tb, nil
+}
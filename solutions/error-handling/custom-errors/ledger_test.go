@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLedgerStatementAndBalanceAt(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	now := start
+	processor := NewPaymentProcessor()
+	processor.now = func() time.Time { return now }
+
+	openAccounts(t, processor, "USD", "alice", "bob")
+	if err := processor.Deposit("alice", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		id     string
+		amount string
+		from   string
+		to     string
+	}{
+		{"t1", "30.00", "alice", "bob"},
+		{"t2", "10.00", "bob", "alice"},
+		{"t3", "5.00", "alice", "bob"},
+	}
+	for _, step := range steps {
+		now = now.Add(time.Hour)
+		tx := &Transaction{ID: step.id, Amount: MustParseMoney(step.amount, "USD"), From: step.from, To: step.to}
+		if err := processor.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction %s failed: %v", step.id, err)
+		}
+	}
+
+	balance, err := processor.GetBalanceAt("alice", start.Add(90*time.Minute))
+	if err != nil || balance != MustParseMoney("70.00", "USD") {
+		t.Errorf("Expected 70.00 USD after t1, got %s (err %v)", balance, err)
+	}
+	balance, _ = processor.GetBalanceAt("alice", start.Add(-time.Minute))
+	if !balance.IsZero() {
+		t.Errorf("Expected zero balance before the deposit, got %s", balance)
+	}
+
+	st, err := processor.Statement("alice", start.Add(time.Hour), start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatalf("Statement failed: %v", err)
+	}
+	if st.Opening != MustParseMoney("100.00", "USD") || st.Closing != MustParseMoney("80.00", "USD") {
+		t.Errorf("Expected opening 100.00 and closing 80.00, got %s and %s", st.Opening, st.Closing)
+	}
+	if len(st.Lines) != 2 || st.Lines[0].TxID != "t1" || st.Lines[0].Side != Debit || st.Lines[1].Balance != st.Closing {
+		t.Errorf("Unexpected statement lines: %+v", st.Lines)
+	}
+
+	tb, err := processor.TrialBalance()
+	if err != nil {
+		t.Fatalf("TrialBalance failed: %v", err)
+	}
+	if tb.Debits["USD"] != MustParseMoney("145.00", "USD") || tb.Credits["USD"] != tb.Debits["USD"] {
+		t.Errorf("Unexpected trial balance: %+v", tb)
+	}
+}
+
+func TestLedgerBalancesAcrossCurrencies(t *testing.T) {
+	rates := NewStaticRateProvider()
+	if err := rates.Set("USD", "EUR", "0.9", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	processor := NewPaymentProcessor()
+	processor.SetExchangeRates(rates, 0)
+	processor.SetConversionFee(25)
+	openAccounts(t, processor, "USD", "us")
+	if err := processor.Deposit("us", MustParseMoney("500.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, processor, "EUR", "eu")
+	if err := processor.Deposit("eu", MustParseMoney("1.00", "EUR")); err != nil {
+		t.Fatal(err)
+	}
+	tx := &Transaction{ID: "fx", Amount: MustParseMoney("100.00", "USD"), From: "us", To: "eu"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	if _, err := processor.TrialBalance(); err != nil {
+		t.Errorf("Trial balance failed: %v", err)
+	}
+	if balance, _ := processor.GetBalance(FXAccount("EUR")); balance != MustParseMoney("-90.00", "EUR") {
+		t.Errorf("Expected EUR clearing position of -90.00, got %s", balance)
+	}
+
+	// Corrupt a cached balance and make sure the trial balance notices
+	acct, _ := processor.account("eu")
+	acct.balance = MustParseMoney("0.00", "EUR")
+	if _, err := processor.TrialBalance(); !errors.Is(err, ErrLedgerUnbalanced) {
+		t.Errorf("Expected ErrLedgerUnbalanced, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Lifecycle errors
+var (
+	ErrIllegalTransition   = errors.New("illegal status transition")
+	ErrRefundExceedsAmount = errors.New("refund exceeds transaction amount")
+)
+
+// TransactionStatus is the lifecycle state of a transaction
+type TransactionStatus string
+
+const (
+	StatusPending           TransactionStatus = "pending"
+	StatusAuthorized        TransactionStatus = "authorized"
+	StatusCaptured          TransactionStatus = "captured"
+	StatusSettled           TransactionStatus = "settled"
+	StatusFailed            TransactionStatus = "failed"
+	StatusCancelled         TransactionStatus = "cancelled"
+	StatusRefunded          TransactionStatus = "refunded"
+	StatusPartiallyRefunded TransactionStatus = "partially_refunded"
+	// StatusRolledBack marks a transaction undone with the rest of an atomic
+	// batch. It is final and keeps the ID taken.
+	StatusRolledBack TransactionStatus = "rolled_back"
+)
+
+// transitions lists the states each state may move to
+var transitions = map[TransactionStatus][]TransactionStatus{
+	StatusPending:           {StatusAuthorized, StatusFailed},
+	StatusAuthorized:        {StatusCaptured, StatusCancelled},
+	StatusCaptured:          {StatusSettled, StatusRefunded, StatusPartiallyRefunded},
+	StatusSettled:           {StatusRefunded, StatusPartiallyRefunded},
+	StatusPartiallyRefunded: {StatusRefunded, StatusPartiallyRefunded},
+}
+
+// CanTransition reports whether a transaction may move from s to next
+func (s TransactionStatus) CanTransition(next TransactionStatus) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError reports an operation that is not allowed in the
+// transaction's current state. It unwraps to ErrIllegalTransition.
+type TransitionError struct {
+	From TransactionStatus
+	To   TransactionStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%v: %s -> %s", ErrIllegalTransition, e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrIllegalTransition
+}
+
+// txState is the processor's own record of an accepted transaction
+type txState struct {
+	mu       sync.Mutex
+	tx       *Transaction
+	from, to *account
+	postings []posting // written to the ledger on capture
+	hold     Money     // held on the source account while authorized
+	debit    Money     // amount moved out of the source account, excluding fees
+	credit   Money     // amount moved into the destination account
+	// refundedDebit and refundedCredit track how much of debit and credit
+	// have been reversed by refunds
+	refundedDebit  Money
+	refundedCredit Money
+	// capturing is set while a capture waits on the payment network, which
+	// happens without state.mu held
+	capturing bool
+}
+
+// available returns the balance not reserved by holds, plus any overdraft
+// limit. The caller must hold a.mu.
+func (a *account) available() (Money, error) {
+	free, err := a.balance.Sub(a.held)
+	if err != nil {
+		return Money{}, err
+	}
+	return free.Add(a.overdraft)
+}
+
+// creditLegs returns the postings that move debit, taken from a source
+// account, into credit on to. Conversions go through per-currency clearing
+// accounts so each currency balances on its own.
+func (p *PaymentProcessor) creditLegs(to *account, debit, credit Money) []posting {
+	if debit.Currency == credit.Currency {
+		return []posting{{acct: to, side: Credit, amount: credit}}
+	}
+	fxFrom := p.accountOrCreate(FXAccount(debit.Currency), debit.Currency)
+	fxTo := p.accountOrCreate(FXAccount(credit.Currency), credit.Currency)
+	return []posting{
+		{acct: fxFrom, side: Credit, amount: debit},
+		{acct: fxTo, side: Debit, amount: credit},
+		{acct: to, side: Credit, amount: credit},
+	}
+}
+
+// Authorize validates a transaction and holds the funds it needs on the
+// source account without moving them. Follow with Capture or Void.
+func (p *PaymentProcessor) Authorize(tx *Transaction) error {
+	if tx.IdempotencyKey != "" {
+		return p.withIdempotency(tx, p.authorize)
+	}
+	return p.observe(p.authorize(tx))
+}
+
+// Capture submits an authorized transaction to the payment network and
+// moves the funds it holds
+func (p *PaymentProcessor) Capture(id string) error {
+	return p.observe(p.capture(context.Background(), id, nil))
+}
+
+// CaptureContext is like Capture but stops retrying the payment network
+// once ctx is done
+func (p *PaymentProcessor) CaptureContext(ctx context.Context, id string) error {
+	return p.observe(p.capture(ctx, id, nil))
+}
+
+// Void cancels an authorized transaction and releases its hold
+func (p *PaymentProcessor) Void(id string) error {
+	return p.observe(p.transition(id, StatusCancelled, nil))
+}
+
+// Settle marks a captured transaction as settled with the counterparty
+func (p *PaymentProcessor) Settle(id string) error {
+	return p.observe(p.transition(id, StatusSettled, nil))
+}
+
+// lookupState returns the state of an accepted transaction
+func (p *PaymentProcessor) lookupState(id string) (*txState, error) {
+	p.mu.RLock()
+	state, exists := p.transactions[id]
+	p.mu.RUnlock()
+	if !exists {
+		return nil, &TransactionError{Err: ErrTransactionNotFound, TxID: id, Context: "transaction lookup failed"}
+	}
+	return state, nil
+}
+
+// checkTransition returns a TransactionError if state cannot move to next,
+// or any status change while a capture is in flight. The caller must hold
+// state.mu.
+func checkTransition(state *txState, next TransactionStatus) error {
+	if state.capturing {
+		return newTransactionError(state.tx, &TransitionError{From: state.tx.Status, To: next}, "capture in progress")
+	}
+	if !state.tx.Status.CanTransition(next) {
+		return newTransactionError(state.tx, &TransitionError{From: state.tx.Status, To: next}, "status transition rejected")
+	}
+	return nil
+}
+
+// beginCapture marks a capture of state as in flight, so that the payment
+// network never sees the same capture twice. Follow with endCapture.
+func beginCapture(state *txState) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if err := checkTransition(state, StatusCaptured); err != nil {
+		return err
+	}
+	state.capturing = true
+	return nil
+}
+
+// endCapture clears the in-flight mark set by beginCapture. The caller must
+// hold state.mu.
+func endCapture(state *txState) {
+	state.capturing = false
+}
+
+// setStatus records a new status and mirrors it onto the caller's copy of the
+// transaction, if any. The caller must hold state.mu.
+func setStatus(state *txState, status TransactionStatus, caller *Transaction) {
+	state.tx.Status = status
+	if caller != nil {
+		caller.Status = status
+		caller.Refunded = state.tx.Refunded
+	}
+}
+
+func (p *PaymentProcessor) capture(ctx context.Context, id string, caller *Transaction) error {
+	state, err := p.lookupState(id)
+	if err != nil {
+		return err
+	}
+	if err := beginCapture(state); err != nil {
+		return err
+	}
+	// The network call may retry for seconds, so it runs without state.mu
+	// and readers of the transaction are not kept waiting
+	err = p.submit(ctx, state)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	endCapture(state)
+	if err != nil {
+		return err
+	}
+	return p.postCapture(state, caller)
+}
+
+// submit sends a capture marked by beginCapture to the payment network
+func (p *PaymentProcessor) submit(ctx context.Context, state *txState) error {
+	if err := p.callGateway(ctx); err != nil {
+		if errors.Is(err, ErrCircuitOpen) {
+			return newTransactionError(state.tx, err, "payment network unavailable")
+		}
+		return newTransactionError(state.tx, err, "payment network call failed")
+	}
+	return nil
+}
+
+// postCapture moves the funds of a submitted capture and releases its hold.
+// The caller must hold state.mu.
+func (p *PaymentProcessor) postCapture(state *txState, caller *Transaction) error {
+	locked := make([]*account, len(state.postings))
+	for i, e := range state.postings {
+		locked[i] = e.acct
+	}
+	unlock := lockAccounts(locked...)
+	defer unlock()
+	if err := checkAccounts(state.tx, state.from, state.to); err != nil {
+		return err
+	}
+
+	source := state.from
+	held, err := source.held.Sub(state.hold)
+	if err != nil {
+		return newTransactionError(state.tx, err, "hold release failed")
+	}
+	// The hold guaranteed the funds, so posting can only fail on overflow or
+	// an event log error
+	record := state.record()
+	record.Transaction.Status = StatusCaptured
+	if err := p.post(state.tx.ID, state.postings, &event{Type: eventStatus, Tx: record}); err != nil {
+		return newTransactionError(state.tx, err, "ledger posting failed")
+	}
+	source.held = held
+	setStatus(state, StatusCaptured, caller)
+	return nil
+}
+
+// transition performs a status change that moves no money: voiding releases
+// the hold, settling just records the new state
+func (p *PaymentProcessor) transition(id string, next TransactionStatus, caller *Transaction) error {
+	state, err := p.lookupState(id)
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if err := checkTransition(state, next); err != nil {
+		return err
+	}
+	record := state.record()
+	record.Transaction.Status = next
+	if next == StatusCancelled {
+		source := state.from
+		unlock := lockAccounts(source)
+		defer unlock()
+		held, err := source.held.Sub(state.hold)
+		if err != nil {
+			return newTransactionError(state.tx, err, "hold release failed")
+		}
+		if err := p.logEvent(&event{Type: eventStatus, Tx: record}); err != nil {
+			return newTransactionError(state.tx, err, "event log write failed")
+		}
+		source.held = held
+	} else if err := p.logEvent(&event{Type: eventStatus, Tx: record}); err != nil {
+		return newTransactionError(state.tx, err, "event log write failed")
+	}
+	setStatus(state, next, caller)
+	return nil
+}
+
+// Refund returns amount, in the transaction currency, from the destination
+// back to the source account. Refunds may be repeated until the whole amount
+// is returned. Conversion fees are not refunded and converted legs are
+// reversed pro rata at the original rate.
+func (p *PaymentProcessor) Refund(id string, amount Money) error {
+	return p.observe(p.refund(id, amount))
+}
+
+func (p *PaymentProcessor) refund(id string, amount Money) error {
+	state, err := p.lookupState(id)
+	if err != nil {
+		return err
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	tx := state.tx
+
+	if !amount.IsPositive() || amount.Currency != tx.Amount.Currency {
+		return newTransactionError(tx, ErrInvalidAmount, "refund validation failed")
+	}
+	refunded, err := tx.Refunded.Add(amount)
+	if err != nil {
+		return newTransactionError(tx, err, "refund validation failed")
+	}
+	cmp, _ := refunded.Cmp(tx.Amount)
+	if cmp > 0 {
+		return newTransactionError(tx, ErrRefundExceedsAmount, "refund validation failed")
+	}
+	next := StatusPartiallyRefunded
+	if cmp == 0 {
+		next = StatusRefunded
+	}
+	if err := checkTransition(state, next); err != nil {
+		return err
+	}
+
+	// Round the total owed after this refund rather than each refund on its
+	// own, so rounding errors never add up and the final refund returns
+	// exactly what is left
+	share := new(big.Rat).Quo(refunded.Rat(), tx.Amount.Rat())
+	var debitBack, creditBack Money
+	owedDebit, err := state.debit.Mul(share, RoundHalfEven)
+	if err == nil {
+		debitBack, err = owedDebit.Sub(state.refundedDebit)
+	}
+	if err == nil {
+		var owedCredit Money
+		owedCredit, err = state.credit.Mul(share, RoundHalfEven)
+		if err == nil {
+			creditBack, err = owedCredit.Sub(state.refundedCredit)
+		}
+	}
+	if err != nil {
+		return newTransactionError(tx, err, "refund calculation failed")
+	}
+
+	source, destination := state.from, state.to
+	forward := append([]posting{{acct: source, side: Debit, amount: debitBack}}, p.creditLegs(destination, debitBack, creditBack)...)
+	postings := make([]posting, len(forward))
+	locked := make([]*account, len(forward))
+	for i, e := range forward {
+		e.side = e.side.Opposite()
+		postings[i] = e
+		locked[i] = e.acct
+	}
+	unlock := lockAccounts(locked...)
+	defer unlock()
+	if err := checkAccounts(tx, source, destination); err != nil {
+		return err
+	}
+
+	available, err := destination.available()
+	if err != nil {
+		return newTransactionError(tx, err, "balance check failed")
+	}
+	if cmp, err := available.Cmp(creditBack); err != nil || cmp < 0 {
+		return newTransactionError(tx, ErrInsufficientFunds, "refund failed")
+	}
+	refundedDebit, err := state.refundedDebit.Add(debitBack)
+	if err != nil {
+		return newTransactionError(tx, err, "refund calculation failed")
+	}
+	refundedCredit, err := state.refundedCredit.Add(creditBack)
+	if err != nil {
+		return newTransactionError(tx, err, "refund calculation failed")
+	}
+	record := state.record()
+	record.Transaction.Status, record.Transaction.Refunded = next, refunded
+	record.RefundedDebit, record.RefundedCredit = refundedDebit, refundedCredit
+	if err := p.post(id+":refund", postings, &event{Type: eventStatus, Tx: record}); err != nil {
+		return newTransactionError(tx, err, "ledger posting failed")
+	}
+
+	state.refundedDebit, state.refundedCredit = refundedDebit, refundedCredit
+	tx.Refunded = refunded
+	setStatus(state, next, nil)
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeHoldsFunds(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("8.00", "USD"), From: "a", To: "b"}
+	if err := processor.Authorize(tx); err != nil {
+		t.Fatalf("Authorize failed: %v", err)
+	}
+	if tx.Status != StatusAuthorized {
+		t.Errorf("Expected authorized, got %q", tx.Status)
+	}
+	if balance, _ := processor.GetBalance("a"); balance != MustParseMoney("10.00", "USD") {
+		t.Errorf("Authorization should not move money, got %s", balance)
+	}
+
+	// The hold reduces what other transactions can spend
+	second := &Transaction{ID: "tx2", Amount: MustParseMoney("5.00", "USD"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(second); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds while funds are held, got %v", err)
+	}
+	if second.Status != StatusFailed {
+		t.Errorf("Expected failed, got %q", second.Status)
+	}
+
+	if err := processor.Void("tx1"); err != nil {
+		t.Fatalf("Void failed: %v", err)
+	}
+	if err := processor.Capture("tx1"); !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Expected ErrIllegalTransition capturing a voided transaction, got %v", err)
+	}
+	var txErr *TransactionError
+	var transErr *TransitionError
+	if err := processor.Capture("tx1"); !errors.As(err, &txErr) || !errors.As(err, &transErr) ||
+		transErr.From != StatusCancelled || transErr.To != StatusCaptured {
+		t.Errorf("Expected a TransactionError wrapping cancelled -> captured, got %v", err)
+	}
+
+	third := &Transaction{ID: "tx3", Amount: MustParseMoney("5.00", "USD"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(third); err != nil {
+		t.Errorf("Void should release the hold, got %v", err)
+	}
+}
+
+func TestCaptureSettleRefund(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("6.00", "USD"), From: "a", To: "b"}
+	if err := processor.Authorize(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := processor.Settle("tx1"); !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Expected ErrIllegalTransition settling an uncaptured transaction, got %v", err)
+	}
+	if err := processor.Capture("tx1"); err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if err := processor.Settle("tx1"); err != nil {
+		t.Fatalf("Settle failed: %v", err)
+	}
+
+	if err := processor.Refund("tx1", MustParseMoney("2.50", "USD")); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+	got, _ := processor.GetTransaction("tx1")
+	if got.Status != StatusPartiallyRefunded || got.Refunded != MustParseMoney("2.50", "USD") {
+		t.Errorf("Expected partially refunded 2.50 USD, got %q %s", got.Status, got.Refunded)
+	}
+	if err := processor.Refund("tx1", MustParseMoney("4.00", "USD")); !errors.Is(err, ErrRefundExceedsAmount) {
+		t.Errorf("Expected ErrRefundExceedsAmount, got %v", err)
+	}
+	if err := processor.Refund("tx1", MustParseMoney("3.50", "USD")); err != nil {
+		t.Fatalf("Final refund failed: %v", err)
+	}
+	got, _ = processor.GetTransaction("tx1")
+	if got.Status != StatusRefunded {
+		t.Errorf("Expected refunded, got %q", got.Status)
+	}
+	if err := processor.Refund("tx1", MustParseMoney("0.01", "USD")); !errors.Is(err, ErrRefundExceedsAmount) {
+		t.Errorf("Expected ErrRefundExceedsAmount after a full refund, got %v", err)
+	}
+
+	a, _ := processor.GetBalance("a")
+	b, _ := processor.GetBalance("b")
+	if a != MustParseMoney("10.00", "USD") || !b.IsZero() {
+		t.Errorf("Expected balances restored to 10.00/0.00, got %s/%s", a, b)
+	}
+	if _, err := processor.TrialBalance(); err != nil {
+		t.Errorf("Ledger unbalanced after refunds: %v", err)
+	}
+}
+
+func TestRefundConvertedTransaction(t *testing.T) {
+	processor := NewPaymentProcessor()
+	rates := NewStaticRateProvider()
+	if err := rates.Set("EUR", "USD", "1.10", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	processor.SetExchangeRates(rates, 0)
+	processor.SetConversionFee(100)
+	openAccounts(t, processor, "USD", "a")
+	if err := processor.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, processor, "EUR", "b")
+
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("10.00", "EUR"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	// 10.00 EUR = 11.00 USD plus a 0.11 USD fee that is kept
+	for _, amount := range []string{"3.33", "3.33", "3.34"} {
+		if err := processor.Refund("tx1", MustParseMoney(amount, "EUR")); err != nil {
+			t.Fatalf("Refund %s failed: %v", amount, err)
+		}
+	}
+	if a, _ := processor.GetBalance("a"); a != MustParseMoney("99.89", "USD") {
+		t.Errorf("Expected 99.89 USD after refunding all but the fee, got %s", a)
+	}
+	if b, _ := processor.GetBalance("b"); !b.IsZero() {
+		t.Errorf("Expected destination emptied, got %s", b)
+	}
+	if _, err := processor.TrialBalance(); err != nil {
+		t.Errorf("Ledger unbalanced: %v", err)
+	}
+}
+
+func TestManySmallConvertedRefunds(t *testing.T) {
+	processor := NewPaymentProcessor()
+	rates := NewStaticRateProvider()
+	if err := rates.Set("EUR", "USD", "0.70", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	processor.SetExchangeRates(rates, 0)
+	openAccounts(t, processor, "USD", "a")
+	if err := processor.Deposit("a", MustParseMoney("1.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, processor, "EUR", "b")
+
+	// 0.07 EUR costs 0.05 USD, so no single cent refund is worth a whole cent
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("0.07", "EUR"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := processor.Refund("tx1", MustParseMoney("0.01", "EUR")); err != nil {
+			t.Fatalf("Refund %d failed: %v", i+1, err)
+		}
+		if a, _ := processor.GetBalance("a"); a.Amount > 100 {
+			t.Fatalf("Refund %d returned more than was paid, balance %s", i+1, a)
+		}
+	}
+	if a, _ := processor.GetBalance("a"); a != MustParseMoney("1.00", "USD") {
+		t.Errorf("Expected 1.00 USD after a full refund, got %s", a)
+	}
+	if b, _ := processor.GetBalance("b"); !b.IsZero() {
+		t.Errorf("Expected destination emptied, got %s", b)
+	}
+	if _, err := processor.TrialBalance(); err != nil {
+		t.Errorf("Ledger unbalanced: %v", err)
+	}
+}
+
+func TestRefundNeedsDestinationFunds(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b", "c")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	steps := []*Transaction{
+		{ID: "tx1", Amount: MustParseMoney("10.00", "USD"), From: "a", To: "b"},
+		{ID: "tx2", Amount: MustParseMoney("10.00", "USD"), From: "b", To: "c"},
+	}
+	for _, tx := range steps {
+		if err := processor.ProcessTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := processor.Refund("tx1", MustParseMoney("1.00", "USD")); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds refunding from an empty account, got %v", err)
+	}
+}
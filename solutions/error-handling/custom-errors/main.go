@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"math/big"
 	"math/rand"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -17,20 +23,27 @@ var (
 	ErrTransactionNotFound  = errors.New("transaction not found")
 	ErrAccountNotFound      = errors.New("account not found")
 	ErrNetworkError         = errors.New("network error")
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
 )
 
 // TransactionError wraps transaction-related errors with additional context
 type TransactionError struct {
 	Err     error
 	TxID    string
-	Amount  float64
+	Amount  Money
 	From    string
 	To      string
 	Context string
+	// RuleID is the rule that denied or flagged the transaction, if any
+	RuleID string
 }
 
 func (e *TransactionError) Error() string {
-	return fmt.Sprintf("%s: %v (tx: %s, amount: %.2f, from: %s, to: %s)",
+	if e.RuleID != "" {
+		return fmt.Sprintf("%s: %v (tx: %s, amount: %s, from: %s, to: %s, rule: %s)",
+			e.Context, e.Err, e.TxID, e.Amount, e.From, e.To, e.RuleID)
+	}
+	return fmt.Sprintf("%s: %v (tx: %s, amount: %s, from: %s, to: %s)",
 		e.Context, e.Err, e.TxID, e.Amount, e.From, e.To)
 }
 
@@ -38,138 +51,301 @@ func (e *TransactionError) Unwrap() error {
 	return e.Err
 }
 
+// newTransactionError wraps err with the fields of tx
+func newTransactionError(tx *Transaction, err error, context string) *TransactionError {
+	return &TransactionError{
+		Err:     err,
+		TxID:    tx.ID,
+		Amount:  tx.Amount,
+		From:    tx.From,
+		To:      tx.To,
+		Context: context,
+	}
+}
+
 // Transaction represents a payment transaction
 type Transaction struct {
 	ID        string
-	Amount    float64
-	Currency  string
+	Amount    Money
 	From      string
 	To        string
 	Timestamp time.Time
-	Status    string
+	Status    TransactionStatus
+	// Refunded is the total refunded so far, in the transaction currency
+	Refunded Money
+	// Conversion is set when the transaction crossed currencies
+	Conversion *Conversion
+	// IdempotencyKey, when set, makes retries of the same request return the original result
+	IdempotencyKey string
+	// ReviewRule is set when a rule held the transaction for review. It stays
+	// authorized until someone captures or voids it.
+	ReviewRule string
 }
 
-// PaymentProcessor handles payment transactions
+// PaymentProcessor handles payment transactions. It is safe for concurrent use.
 type PaymentProcessor struct {
-	transactions map[string]*Transaction
-	balances     map[string]float64
+	// mu guards the maps below and the configuration fields. Balances are
+	// guarded by the per-account locks, which are always taken after mu is
+	// released and in lock order (see lockAccounts).
+	mu           sync.RWMutex
+	transactions map[string]*txState
+	pending      map[string]bool // IDs reserved by in-flight transactions
+	accounts     map[string]*account
+	ledger       *Ledger
+	idempotency  *idempotencyStore
+
+	rules            *RulesEngine
+	rates            ExchangeRateProvider
+	maxRateAge       time.Duration
+	conversionFeeBps int64
+	gateway          func(context.Context) error
+	retry            RetryPolicy
+	breaker          *CircuitBreaker
+	recorder         ErrorRecorder
+	reporter         ErrorReporter
+	events           *eventLog // nil unless opened with OpenPaymentProcessor
+	now              func() time.Time
 }
 
 // NewPaymentProcessor creates a new payment processor
 func NewPaymentProcessor() *PaymentProcessor {
 	return &PaymentProcessor{
-		transactions: make(map[string]*Transaction),
-		balances:     make(map[string]float64),
+		transactions: make(map[string]*txState),
+		pending:      make(map[string]bool),
+		accounts:     make(map[string]*account),
+		ledger:       NewLedger(),
+		idempotency:  newIdempotencyStore(24 * time.Hour),
+		retry:        DefaultRetryPolicy,
+		now:          time.Now,
 	}
 }
 
-// ProcessTransaction processes a payment transaction
+// ProcessTransaction authorizes and captures a payment transaction in one
+// step. The debit and credit are applied atomically with respect to
+// concurrent calls. Transactions with an IdempotencyKey are processed at most
+// once per key; see withIdempotency.
 func (p *PaymentProcessor) ProcessTransaction(tx *Transaction) error {
-	// Validate amount
-	if tx.Amount <= 0 {
-		return &TransactionError{
-			Err:     ErrInvalidAmount,
-			TxID:    tx.ID,
-			Amount:  tx.Amount,
-			From:    tx.From,
-			To:      tx.To,
-			Context: "amount validation failed",
-		}
+	return p.ProcessTransactionContext(context.Background(), tx)
+}
+
+// ProcessTransactionContext is like ProcessTransaction but stops retrying
+// the payment network once ctx is done
+func (p *PaymentProcessor) ProcessTransactionContext(ctx context.Context, tx *Transaction) error {
+	process := func(tx *Transaction) error { return p.processTransaction(ctx, tx) }
+	if tx.IdempotencyKey != "" {
+		return p.withIdempotency(tx, process)
 	}
+	return p.observe(process(tx))
+}
 
-	// Validate accounts
-	if tx.From == "" || tx.To == "" {
-		return &TransactionError{
-			Err:     ErrInvalidAccount,
-			TxID:    tx.ID,
-			Amount:  tx.Amount,
-			From:    tx.From,
-			To:      tx.To,
-			Context: "account validation failed",
+// processTransaction authorizes and immediately captures a transaction,
+// unless a rule held it for review
+func (p *PaymentProcessor) processTransaction(ctx context.Context, tx *Transaction) error {
+	if err := p.authorize(tx); err != nil {
+		return err
+	}
+	if tx.ReviewRule != "" {
+		err := newTransactionError(tx, ErrReviewRequired, "transaction held for review")
+		err.RuleID = tx.ReviewRule
+		return err
+	}
+	if err := p.capture(ctx, tx.ID, tx); err != nil {
+		if voidErr := p.transition(tx.ID, StatusCancelled, tx); voidErr != nil {
+			return errors.Join(err, voidErr)
 		}
+		return err
 	}
+	return nil
+}
 
-	// Check for duplicate transaction
-	if _, exists := p.transactions[tx.ID]; exists {
-		return &TransactionError{
-			Err:     ErrDuplicateTransaction,
-			TxID:    tx.ID,
-			Amount:  tx.Amount,
-			From:    tx.From,
-			To:      tx.To,
-			Context: "duplicate transaction detected",
+// authorize validates a transaction and places a hold on the source account
+// for the amount it will debit, including any conversion fee
+func (p *PaymentProcessor) authorize(tx *Transaction) (err error) {
+	defer func() {
+		if err != nil {
+			p.logRejection(tx, err)
 		}
+	}()
+	if err := tx.Validate(); err != nil {
+		return newTransactionError(tx, err, "transaction validation failed")
 	}
 
-	// Check currency
-	if tx.Currency != "USD" {
-		return &TransactionError{
-			Err:     ErrUnsupportedCurrency,
-			TxID:    tx.ID,
-			Amount:  tx.Amount,
-			From:    tx.From,
-			To:      tx.To,
-			Context: "currency validation failed",
-		}
+	// Check for duplicate transaction, reserving the ID until we finish
+	if !p.reserve(tx.ID) {
+		return newTransactionError(tx, ErrDuplicateTransaction, "duplicate transaction detected")
 	}
+	tx.Status = StatusPending
+	var state *txState
+	defer func() {
+		if err != nil {
+			tx.Status = StatusFailed
+		}
+		p.release(tx.ID, state)
+	}()
 
-	// Check sufficient funds
-	balance, exists := p.balances[tx.From]
+	from, exists := p.account(tx.From)
 	if !exists {
-		return &TransactionError{
-			Err:     ErrAccountNotFound,
-			TxID:    tx.ID,
-			Amount:  tx.Amount,
-			From:    tx.From,
-			To:      tx.To,
-			Context: "source account not found",
-		}
+		return newTransactionError(tx, ErrAccountNotFound, "source account not found")
+	}
+	to, exists := p.account(tx.To)
+	if !exists {
+		return newTransactionError(tx, ErrAccountNotFound, "destination account not found")
+	}
+	// Capture checks again, so a freeze after this point still stops the transfer
+	unlockBoth := lockAccounts(from, to)
+	err = checkAccounts(tx, from, to)
+	unlockBoth()
+	if err != nil {
+		return err
+	}
+	if tx.Timestamp.IsZero() {
+		tx.Timestamp = p.now()
+	}
+	verdict, err := p.checkRules(tx)
+	if err != nil {
+		return err
 	}
 
-	if balance < tx.Amount {
-		return &TransactionError{
-			Err:     ErrInsufficientFunds,
-			TxID:    tx.ID,
-			Amount:  tx.Amount,
-			From:    tx.From,
-			To:      tx.To,
-			Context: "insufficient funds",
+	// Convert into each account's currency when they differ from the transaction's
+	debit, rate, err := p.convert(tx.Amount, from.currency)
+	if err != nil {
+		return newTransactionError(tx, err, "currency conversion failed")
+	}
+	credit, creditRate, err := p.convert(tx.Amount, to.currency)
+	if err != nil {
+		return newTransactionError(tx, err, "currency conversion failed")
+	}
+	var conversion *Conversion
+	fee := Money{Currency: from.currency}
+	if debit.Currency != tx.Amount.Currency || credit.Currency != tx.Amount.Currency {
+		p.mu.RLock()
+		feeBps := p.conversionFeeBps
+		p.mu.RUnlock()
+		fee, err = debit.Mul(big.NewRat(feeBps, 10000), RoundHalfEven)
+		if err != nil {
+			return newTransactionError(tx, err, "fee calculation failed")
+		}
+		// Record the source-side rate unless only the destination was converted
+		if debit.Currency == tx.Amount.Currency {
+			rate = creditRate
+		}
+		conversion = &Conversion{
+			Rate:          rate.Rate.FloatString(6),
+			RateTimestamp: rate.Timestamp,
+			Debited:       debit,
+			Credited:      credit,
+			Fee:           fee,
 		}
 	}
+	total, err := debit.Add(fee)
+	if err != nil {
+		return newTransactionError(tx, err, "fee calculation failed")
+	}
+	postings := append([]posting{{acct: from, side: Debit, amount: total}}, p.creditLegs(to, debit, credit)...)
+	if !fee.IsZero() {
+		feeAccount := p.accountOrCreate(FeeAccount(fee.Currency), fee.Currency)
+		postings = append(postings, posting{acct: feeAccount, side: Credit, amount: fee})
+	}
 
-	// Process the transaction
-	p.balances[tx.From] -= tx.Amount
-	p.balances[tx.To] += tx.Amount
-	tx.Status = "completed"
-	p.transactions[tx.ID] = tx
+	unlock := lockAccounts(from)
+	defer unlock()
+
+	// Check sufficient funds, net of holds from other authorizations
+	available, err := from.available()
+	if err != nil {
+		return newTransactionError(tx, err, "balance check failed")
+	}
+	cmp, err := available.Cmp(total)
+	if err != nil {
+		return newTransactionError(tx, err, "balance check failed")
+	}
+	if cmp < 0 {
+		return newTransactionError(tx, ErrInsufficientFunds, "insufficient funds")
+	}
+	held, err := from.held.Add(total)
+	if err != nil {
+		return newTransactionError(tx, err, "hold failed")
+	}
 
+	record := *tx
+	record.Conversion = conversion
+	record.Status = StatusAuthorized
+	record.Refunded = Money{Currency: tx.Amount.Currency}
+	if verdict.Decision == DecisionReview {
+		record.ReviewRule = verdict.RuleID
+	}
+	accepted := &txState{
+		tx:             &record,
+		from:           from,
+		to:             to,
+		postings:       postings,
+		hold:           total,
+		debit:          debit,
+		credit:         credit,
+		refundedDebit:  Money{Currency: debit.Currency},
+		refundedCredit: Money{Currency: credit.Currency},
+	}
+	if err := p.logEvent(&event{Type: eventAuthorized, Tx: accepted.record()}); err != nil {
+		return newTransactionError(tx, err, "event log write failed")
+	}
+	from.held = held
+	tx.Conversion, tx.Status, tx.Refunded, tx.ReviewRule = record.Conversion, record.Status, record.Refunded, record.ReviewRule
+	state = accepted
 	return nil
 }
 
-// GetTransaction retrieves a transaction by ID
+// reserve claims a transaction ID, reporting false if it is already in use
+func (p *PaymentProcessor) reserve(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.transactions[id]; exists || p.pending[id] {
+		return false
+	}
+	p.pending[id] = true
+	return true
+}
+
+// release drops a reservation, recording the transaction's state if it was accepted
+func (p *PaymentProcessor) release(id string, state *txState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+	if state != nil {
+		p.transactions[id] = state
+	}
+}
+
+// GetTransaction returns a snapshot of a transaction by ID
 func (p *PaymentProcessor) GetTransaction(id string) (*Transaction, error) {
-	tx, exists := p.transactions[id]
+	p.mu.RLock()
+	state, exists := p.transactions[id]
+	p.mu.RUnlock()
 	if !exists {
-		return nil, &TransactionError{
+		return nil, p.observe(&TransactionError{
 			Err:     ErrTransactionNotFound,
 			TxID:    id,
 			Context: "transaction lookup failed",
-		}
+		})
 	}
-	return tx, nil
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	snapshot := *state.tx
+	return &snapshot, nil
 }
 
 // GetBalance retrieves the balance for an account
-func (p *PaymentProcessor) GetBalance(account string) (float64, error) {
-	balance, exists := p.balances[account]
+func (p *PaymentProcessor) GetBalance(account string) (Money, error) {
+	acct, exists := p.account(account)
 	if !exists {
-		return 0, &TransactionError{
+		return Money{}, p.observe(&TransactionError{
 			Err:     ErrAccountNotFound,
 			From:    account,
 			Context: "balance lookup failed",
-		}
+		})
 	}
-	return balance, nil
+	acct.mu.Lock()
+	defer acct.mu.Unlock()
+	return acct.balance, nil
 }
 
 // SimulateNetworkError simulates a network error
@@ -181,22 +357,97 @@ func SimulateNetworkError() error {
 }
 
 func main() {
+	dashboard := flag.String("dashboard", "", "serve the error dashboard on this address after the demo, e.g. localhost:8080")
+	events := flag.String("events", "", "persist to this event log, replaying it at startup")
+	verify := flag.String("verify", "", "verify this event log and its snapshot, then exit")
+	api := flag.String("api", "", "serve the payments API on this address after the demo, e.g. localhost:8081")
+	reconcile := flag.String("reconcile", "", "reconcile this CSV bank statement against -ledger or -events, then exit")
+	ledgerCSV := flag.String("ledger", "", "transactions exported as CSV to reconcile against")
+	reconcileAccount := flag.String("account", "", "account the bank statement is for")
+	amountTolerance := flag.String("amount-tolerance", "0", "largest amount difference that still matches, in the statement currency")
+	dateTolerance := flag.Int("date-tolerance", 2, "most days between a booking and a transaction matched on amount")
+	flag.Parse()
+
+	if *verify != "" {
+		report, err := VerifyEventLog(*verify, *verify+".snapshot")
+		if err != nil {
+			fmt.Printf("Error verifying event log: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Verified %d events (%d rejected, snapshot at %d)\n", report.Events, report.Rejected, report.SnapshotSeq)
+		for _, m := range report.Mismatches {
+			fmt.Printf("Mismatch: %s\n", m)
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *reconcile != "" {
+		opts := ReconcileOptions{Account: *reconcileAccount, DateTolerance: *dateTolerance}
+		report, err := runReconciliation(*reconcile, *ledgerCSV, *events, *amountTolerance, opts)
+		if err != nil {
+			fmt.Printf("Error reconciling: %v\n", err)
+			os.Exit(1)
+		}
+		report.WriteText(os.Stdout)
+		if !report.Reconciled() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	processor := NewPaymentProcessor()
+	if *events != "" {
+		var err error
+		processor, err = OpenPaymentProcessor(*events, EventLogOptions{SnapshotPath: *events + ".snapshot", SnapshotEvery: 100})
+		if err != nil {
+			fmt.Printf("Error opening event log: %v\n", err)
+			return
+		}
+		defer processor.Close()
+	}
+	metrics := NewErrorMetrics(MetricsOptions{})
+	processor.SetErrorRecorder(metrics)
 
-	// Set initial balances
-	processor.balances["account1"] = 1000.0
-	processor.balances["account2"] = 500.0
+	// Open the accounts and set initial balances
+	for _, acct := range []*Account{
+		{ID: "account1", Owner: "Alice", Currency: "USD", OverdraftLimit: MustParseMoney("100.00", "USD")},
+		{ID: "account2", Owner: "Bob", Currency: "USD"},
+	} {
+		if err := processor.OpenAccount(acct); err != nil && !errors.Is(err, ErrAccountExists) {
+			fmt.Printf("Error opening account: %v\n", err)
+			return
+		}
+	}
+	if err := processor.Deposit("account1", MustParseMoney("1000.00", "USD")); err != nil {
+		fmt.Printf("Error depositing: %v\n", err)
+		return
+	}
+	if err := processor.Deposit("account2", MustParseMoney("500.00", "USD")); err != nil {
+		fmt.Printf("Error depositing: %v\n", err)
+		return
+	}
 
 	// Create a transaction
 	tx := &Transaction{
 		ID:        "tx1",
-		Amount:    100.0,
-		Currency:  "USD",
+		Amount:    MustParseMoney("100.00", "USD"),
 		From:      "account1",
 		To:        "account2",
 		Timestamp: time.Now(),
 	}
 
+	// Captures go out to a flaky payment network and are retried on failure
+	processor.SetGateway(func(context.Context) error { return SimulateNetworkError() })
+	processor.SetRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Millisecond})
+	processor.SetCircuitBreaker(NewCircuitBreaker(BreakerSettings{
+		OnStateChange: func(from, to CircuitState) {
+			fmt.Printf("Payment network circuit %s -> %s\n", from, to)
+		},
+	}))
+
 	// Process the transaction
 	err := processor.ProcessTransaction(tx)
 	if err != nil {
@@ -213,8 +464,7 @@ func main() {
 	// Try to process a transaction with insufficient funds
 	tx2 := &Transaction{
 		ID:        "tx2",
-		Amount:    2000.0,
-		Currency:  "USD",
+		Amount:    MustParseMoney("2000.00", "USD"),
 		From:      "account1",
 		To:        "account2",
 		Timestamp: time.Now(),
@@ -224,18 +474,93 @@ func main() {
 		fmt.Printf("Error processing transaction with insufficient funds: %v\n", err)
 	}
 
-	// Try to process a transaction with unsupported currency
+	// Process a foreign-currency transaction through the exchange rate table
+	rates := NewStaticRateProvider()
+	if err := rates.Set("EUR", "USD", "1.08", time.Now()); err != nil {
+		fmt.Printf("Error setting exchange rate: %v\n", err)
+		return
+	}
+	processor.SetExchangeRates(rates, time.Hour)
+	processor.SetConversionFee(50)
 	tx3 := &Transaction{
 		ID:        "tx3",
-		Amount:    100.0,
-		Currency:  "EUR",
+		Amount:    MustParseMoney("100.00", "EUR"),
 		From:      "account1",
 		To:        "account2",
 		Timestamp: time.Now(),
 	}
 	err = processor.ProcessTransaction(tx3)
 	if err != nil {
-		fmt.Printf("Error processing transaction with unsupported currency: %v\n", err)
+		fmt.Printf("Error processing foreign-currency transaction: %v\n", err)
+	} else {
+		fmt.Printf("Converted transaction: debited %s plus %s fee at rate %s\n",
+			tx3.Conversion.Debited, tx3.Conversion.Fee, tx3.Conversion.Rate)
+	}
+
+	// Try to process a transaction with no exchange rate
+	tx4 := &Transaction{
+		ID:        "tx4",
+		Amount:    MustParseMoney("100.00", "GBP"),
+		From:      "account1",
+		To:        "account2",
+		Timestamp: time.Now(),
+	}
+	err = processor.ProcessTransaction(tx4)
+	if err != nil {
+		fmt.Printf("Error processing transaction without exchange rate: %v\n", err)
+	}
+
+	// Every validation failure is reported at once
+	err = processor.ProcessTransaction(&Transaction{ID: "tx5", Amount: MustParseMoney("-5.00", "USD")})
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		for _, fe := range validationErr.Errors {
+			fmt.Printf("Invalid field %s: %v\n", fe.Field, fe.Err)
+		}
+	}
+
+	// Frozen accounts can neither send nor receive
+	if err := processor.FreezeAccount("account2"); err != nil {
+		fmt.Printf("Error freezing account: %v\n", err)
+	}
+	err = processor.ProcessTransaction(&Transaction{ID: "tx6", Amount: MustParseMoney("10.00", "USD"), From: "account1", To: "account2"})
+	if err != nil {
+		fmt.Printf("Error paying a frozen account: %v\n", err)
+	}
+	if err := processor.UnfreezeAccount("account2"); err != nil {
+		fmt.Printf("Error unfreezing account: %v\n", err)
+	}
+
+	// An atomic batch goes through as a whole or not at all
+	batch := []*Transaction{
+		{ID: "pay1", Amount: MustParseMoney("50.00", "USD"), From: "account1", To: "account2"},
+		{ID: "pay2", Amount: MustParseMoney("5000.00", "USD"), From: "account1", To: "account2"},
+	}
+	result, err := processor.ProcessBatch(context.Background(), batch, BatchAtomic)
+	if err != nil {
+		fmt.Printf("Error processing batch: %v\n", err)
+	}
+	fmt.Printf("Batch: %d succeeded, %d failed, rolled back: %t\n", result.Succeeded, result.Failed, result.RolledBack)
+
+	// Scheduled transfers run once they are due
+	scheduler := NewScheduler(processor, SchedulerOptions{Retry: RunRetryPolicy{MaxRetries: 3}})
+	allowance := Transaction{Amount: MustParseMoney("20.00", "USD"), From: "account1", To: "account2"}
+	if _, err := scheduler.Schedule("allowance", allowance, time.Now(), Recurrence{Frequency: Weekly}); err != nil {
+		fmt.Printf("Error scheduling transfer: %v\n", err)
+	}
+	for _, run := range scheduler.RunDue(context.Background()) {
+		fmt.Printf("Scheduled run %s: %s %v\n", run.TxID, run.Status, run.Err)
+	}
+
+	// Print this month's statement and export the account's transactions
+	now := time.Now()
+	if st, err := processor.MonthlyStatement("account2", now.Year(), now.Month(), time.Local); err != nil {
+		fmt.Printf("Error generating statement: %v\n", err)
+	} else {
+		st.WriteText(os.Stdout)
+	}
+	if err := processor.ExportTransactions(os.Stdout, TransactionQuery{Account: "account2"}, ExportCSV); err != nil {
+		fmt.Printf("Error exporting transactions: %v\n", err)
 	}
 
 	// Try to get a non-existent transaction
@@ -243,4 +568,23 @@ func main() {
 	if err != nil {
 		fmt.Printf("Error getting non-existent transaction: %v\n", err)
 	}
+
+	var servers sync.WaitGroup
+	serve := func(name, addr string, handler http.Handler) {
+		fmt.Printf("Serving %s on http://%s/\n", name, addr)
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			if err := http.ListenAndServe(addr, handler); err != nil {
+				fmt.Printf("Error serving %s: %v\n", name, err)
+			}
+		}()
+	}
+	if *dashboard != "" {
+		serve("error dashboard", *dashboard, metrics)
+	}
+	if *api != "" {
+		serve("payments API", *api, NewAPI(processor))
+	}
+	servers.Wait()
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorRecorder receives every TransactionError returned by PaymentProcessor
+type ErrorRecorder interface {
+	RecordError(err *TransactionError)
+}
+
+// ErrorEvent is one recorded error
+type ErrorEvent struct {
+	Time     time.Time `json:"time"`
+	TxID     string    `json:"tx_id"`
+	Sentinel string    `json:"sentinel"`
+	Context  string    `json:"context"`
+	Message  string    `json:"message"`
+}
+
+// WindowStats counts the errors recorded within a rolling window
+type WindowStats struct {
+	Window     string         `json:"window"`
+	Total      int            `json:"total"`
+	PerMinute  float64        `json:"per_minute"`
+	BySentinel map[string]int `json:"by_sentinel"`
+}
+
+// MetricsSnapshot is a point-in-time copy of ErrorMetrics
+type MetricsSnapshot struct {
+	Total      int            `json:"total"`
+	BySentinel map[string]int `json:"by_sentinel"`
+	ByContext  map[string]int `json:"by_context"`
+	Windows    []WindowStats  `json:"windows"`
+	Recent     []ErrorEvent   `json:"recent"` // newest first
+}
+
+// MetricsOptions configures ErrorMetrics. Zero fields take defaults.
+type MetricsOptions struct {
+	// Windows are the rolling windows rates are reported for (default 1m, 5m, 15m)
+	Windows []time.Duration
+	// Recent is how many of the latest errors are kept (default 50)
+	Recent int
+	Clock  Clock
+}
+
+// metricsBucketWidth is the resolution of the rolling windows
+const metricsBucketWidth = 10 * time.Second
+
+// metricsBucket counts the errors recorded in one metricsBucketWidth interval
+type metricsBucket struct {
+	start      time.Time
+	bySentinel map[string]int
+}
+
+// ErrorMetrics counts errors by sentinel and context, overall and over
+// rolling windows. It is safe for concurrent use.
+type ErrorMetrics struct {
+	windows   []time.Duration
+	maxRecent int
+	clock     Clock
+
+	mu         sync.Mutex
+	total      int
+	bySentinel map[string]int
+	byContext  map[string]int
+	buckets    []metricsBucket // oldest first
+	recent     []ErrorEvent    // ring buffer of the latest events
+	next       int             // index in recent to overwrite once full
+}
+
+// NewErrorMetrics creates an empty collector
+func NewErrorMetrics(opts MetricsOptions) *ErrorMetrics {
+	if len(opts.Windows) == 0 {
+		opts.Windows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+	}
+	if opts.Recent <= 0 {
+		opts.Recent = 50
+	}
+	if opts.Clock == nil {
+		opts.Clock = ClockFunc(time.Now)
+	}
+	windows := append([]time.Duration(nil), opts.Windows...)
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	return &ErrorMetrics{
+		windows:    windows,
+		maxRecent:  opts.Recent,
+		clock:      opts.Clock,
+		bySentinel: make(map[string]int),
+		byContext:  make(map[string]int),
+	}
+}
+
+// RecordError counts err
+func (m *ErrorMetrics) RecordError(err *TransactionError) {
+	now := m.clock.Now()
+	event := ErrorEvent{
+		Time:     now,
+		TxID:     err.TxID,
+		Sentinel: SentinelName(err),
+		Context:  err.Context,
+		Message:  err.Error(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total++
+	m.bySentinel[event.Sentinel]++
+	m.byContext[event.Context]++
+
+	start := now.Truncate(metricsBucketWidth)
+	if n := len(m.buckets); n == 0 || !m.buckets[n-1].start.Equal(start) {
+		m.buckets = append(m.buckets, metricsBucket{start: start, bySentinel: make(map[string]int)})
+	}
+	m.buckets[len(m.buckets)-1].bySentinel[event.Sentinel]++
+	m.prune(now)
+
+	if len(m.recent) < m.maxRecent {
+		m.recent = append(m.recent, event)
+	} else {
+		m.recent[m.next] = event
+		m.next = (m.next + 1) % m.maxRecent
+	}
+}
+
+// prune drops buckets older than the longest window. The caller must hold m.mu.
+func (m *ErrorMetrics) prune(now time.Time) {
+	cutoff := now.Add(-m.windows[len(m.windows)-1])
+	drop := 0
+	for drop < len(m.buckets) && !m.buckets[drop].start.Add(metricsBucketWidth).After(cutoff) {
+		drop++
+	}
+	m.buckets = m.buckets[drop:]
+}
+
+// Snapshot returns the current counts
+func (m *ErrorMetrics) Snapshot() MetricsSnapshot {
+	now := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+
+	s := MetricsSnapshot{
+		Total:      m.total,
+		BySentinel: make(map[string]int, len(m.bySentinel)),
+		ByContext:  make(map[string]int, len(m.byContext)),
+	}
+	for k, v := range m.bySentinel {
+		s.BySentinel[k] = v
+	}
+	for k, v := range m.byContext {
+		s.ByContext[k] = v
+	}
+	for _, window := range m.windows {
+		stats := WindowStats{Window: window.String(), BySentinel: make(map[string]int)}
+		cutoff := now.Add(-window)
+		for _, b := range m.buckets {
+			// Buckets straddling the cutoff count in full
+			if !b.start.Add(metricsBucketWidth).After(cutoff) {
+				continue
+			}
+			for k, v := range b.bySentinel {
+				stats.BySentinel[k] += v
+				stats.Total += v
+			}
+		}
+		stats.PerMinute = float64(stats.Total) / window.Minutes()
+		s.Windows = append(s.Windows, stats)
+	}
+	for i := range m.recent {
+		// Walk backwards from the newest event
+		j := (m.next - 1 - i + 2*len(m.recent)) % len(m.recent)
+		s.Recent = append(s.Recent, m.recent[j])
+	}
+	return s
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Payment errors</title></head>
+<body>
+<h1>Payment errors ({{.Total}})</h1>
+<h2>Rates</h2>
+<table border="1">
+<tr><th>Window</th><th>Errors</th><th>Per minute</th></tr>
+{{range .Windows}}<tr><td>{{.Window}}</td><td>{{.Total}}</td><td>{{printf "%.2f" .PerMinute}}</td></tr>
+{{end}}</table>
+<h2>By error</h2>
+<table border="1">
+<tr><th>Error</th><th>Count</th></tr>
+{{range $name, $count := .BySentinel}}<tr><td>{{$name}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+<h2>By context</h2>
+<table border="1">
+<tr><th>Context</th><th>Count</th></tr>
+{{range $context, $count := .ByContext}}<tr><td>{{$context}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<table border="1">
+<tr><th>Time</th><th>Transaction</th><th>Error</th><th>Context</th><th>Message</th></tr>
+{{range .Recent}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.TxID}}</td><td>{{.Sentinel}}</td><td>{{.Context}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ServeHTTP renders the metrics as an HTML dashboard, or as JSON when the
+// request asks for it with ?format=json or an Accept: application/json header
+func (m *ErrorMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot := m.Snapshot()
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, snapshot); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// SetErrorRecorder sends every TransactionError returned by the processor's
+// methods to r. Nil stops recording.
+func (p *PaymentProcessor) SetErrorRecorder(r ErrorRecorder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recorder = r
+}
+
+// observe passes err to the error recorder and reporter if it is a
+// TransactionError and returns it unchanged
+func (p *PaymentProcessor) observe(err error) error {
+	var txErr *TransactionError
+	if err == nil || !errors.As(err, &txErr) {
+		return err
+	}
+	p.mu.RLock()
+	recorder, reporter := p.recorder, p.reporter
+	p.mu.RUnlock()
+	if recorder != nil {
+		recorder.RecordError(txErr)
+	}
+	if reporter != nil {
+		reporter.Report(NewErrorReport(err, p.now()))
+	}
+	return err
+}
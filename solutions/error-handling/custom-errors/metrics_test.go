@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorMetricsCounts(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	metrics := NewErrorMetrics(MetricsOptions{Windows: []time.Duration{time.Minute, 10 * time.Minute}, Recent: 2, Clock: clock})
+	processor := NewPaymentProcessor()
+	processor.SetErrorRecorder(metrics)
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("50.00", "USD"), From: "a", To: "b"}
+	processor.ProcessTransaction(tx)
+	clock.Advance(5 * time.Minute)
+	tx = &Transaction{ID: "tx2", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	processor.ProcessTransaction(tx)
+	processor.GetTransaction("missing")
+
+	s := metrics.Snapshot()
+	if s.Total != 3 {
+		t.Errorf("Expected 3 errors, got %d", s.Total)
+	}
+	if s.BySentinel["ErrInsufficientFunds"] != 1 || s.BySentinel["ErrDuplicateTransaction"] != 1 ||
+		s.BySentinel["ErrTransactionNotFound"] != 1 {
+		t.Errorf("Unexpected counts by sentinel: %v", s.BySentinel)
+	}
+	if s.ByContext["duplicate transaction detected"] != 1 {
+		t.Errorf("Unexpected counts by context: %v", s.ByContext)
+	}
+	if s.Windows[0].Total != 2 || s.Windows[1].Total != 3 {
+		t.Errorf("Expected 2 errors in the last minute and 3 in ten, got %+v", s.Windows)
+	}
+	if len(s.Recent) != 2 || s.Recent[0].TxID != "missing" || s.Recent[1].TxID != "tx2" {
+		t.Errorf("Expected the two newest errors, newest first, got %+v", s.Recent)
+	}
+
+	clock.Advance(time.Hour)
+	if s := metrics.Snapshot(); s.Windows[1].Total != 0 || s.Total != 3 {
+		t.Errorf("Expected windows to empty while totals remain, got %+v", s)
+	}
+}
+
+func TestErrorMetricsCountAccountErrors(t *testing.T) {
+	metrics := NewErrorMetrics(MetricsOptions{})
+	processor := NewPaymentProcessor()
+	processor.SetErrorRecorder(metrics)
+	openAccounts(t, processor, "USD", "a")
+
+	processor.Deposit("a", MustParseMoney("-1.00", "USD"))
+	processor.Deposit("missing", MustParseMoney("1.00", "USD"))
+	processor.GetBalance("missing")
+	processor.OpenAccount(&Account{ID: "a", Currency: "USD"})
+	processor.Statement("missing", time.Time{}, time.Now())
+
+	s := metrics.Snapshot()
+	if s.Total != 5 {
+		t.Errorf("Expected 5 errors, got %d", s.Total)
+	}
+	if s.BySentinel["ErrInvalidAmount"] != 1 || s.BySentinel["ErrAccountNotFound"] != 3 ||
+		s.BySentinel["ErrAccountExists"] != 1 {
+		t.Errorf("Unexpected counts by sentinel: %v", s.BySentinel)
+	}
+}
+
+func TestSentinelName(t *testing.T) {
+	err := &RetryError{Err: ErrNetworkError}
+	if got := SentinelName(newTransactionError(&Transaction{}, err, "x")); got != "ErrNetworkError" {
+		t.Errorf("Expected ErrNetworkError, got %s", got)
+	}
+	if got := SentinelName(ErrCircuitOpen); got != "ErrCircuitOpen" {
+		t.Errorf("Expected ErrCircuitOpen, got %s", got)
+	}
+	if got := SentinelName(http.ErrHandlerTimeout); got != "other" {
+		t.Errorf("Expected other, got %s", got)
+	}
+}
+
+func TestErrorDashboard(t *testing.T) {
+	metrics := NewErrorMetrics(MetricsOptions{})
+	metrics.RecordError(&TransactionError{Err: ErrInsufficientFunds, TxID: "tx<1>", Context: "insufficient funds"})
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var s MetricsSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 1 || s.Recent[0].TxID != "tx<1>" || s.Recent[0].Sentinel != "ErrInsufficientFunds" {
+		t.Errorf("Unexpected JSON snapshot: %+v", s)
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body strings.Builder
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(body.String(), "tx&lt;1&gt;") {
+		t.Errorf("Expected an HTML table with the escaped tx ID, got %s", body.String())
+	}
+
+	resp, err = http.Post(server.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Money errors
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrMoneyOverflow    = errors.New("money overflow")
+	ErrInvalidMoney     = errors.New("invalid money amount")
+)
+
+// minorUnits maps ISO 4217 codes to the number of digits after the decimal point
+var minorUnits = map[string]int{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"JPY": 0,
+	"KWD": 3,
+}
+
+// MinorUnits returns the number of decimal places used by a currency
+func MinorUnits(currency string) (int, error) {
+	digits, ok := minorUnits[currency]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return digits, nil
+}
+
+// RoundingMode decides how amounts finer than a currency's minor unit are rounded
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // banker's rounding
+	RoundHalfUp                       // ties away from zero
+	RoundDown                         // toward zero
+	RoundUp                           // away from zero
+	RoundFloor                        // toward negative infinity
+	RoundCeiling                      // toward positive infinity
+)
+
+// Money is an exact amount in the minor units (e.g. cents) of a currency
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney returns minor units of currency, e.g. NewMoney(1050, "USD") is $10.50
+func NewMoney(minor int64, currency string) Money {
+	return Money{Amount: minor, Currency: currency}
+}
+
+// ParseMoney parses a decimal string such as "-12.34". Digits beyond the
+// currency's minor unit are rejected rather than silently rounded.
+func ParseMoney(s, currency string) (Money, error) {
+	r, err := parseDecimal(s)
+	if err != nil {
+		return Money{}, err
+	}
+	m, err := RoundMoney(r, currency, RoundDown)
+	if err != nil {
+		return Money{}, err
+	}
+	if m.Rat().Cmp(r) != 0 {
+		return Money{}, fmt.Errorf("%w: %q has more precision than %s allows", ErrInvalidMoney, s, currency)
+	}
+	return m, nil
+}
+
+// MustParseMoney is like ParseMoney but panics on error
+func MustParseMoney(s, currency string) Money {
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// parseDecimal accepts an optional sign, digits and an optional fraction
+func parseDecimal(s string) (*big.Rat, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" && frac == "" || strings.Trim(whole+frac, "0123456789") != "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+	return r, nil
+}
+
+// RoundMoney rounds an exact value in major units (e.g. dollars) to the
+// currency's minor unit
+func RoundMoney(r *big.Rat, currency string, mode RoundingMode) (Money, error) {
+	digits, err := MinorUnits(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(digits)))
+	n, err := roundRat(scaled, mode)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: n, Currency: currency}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// roundRat rounds r to an integer according to mode
+func roundRat(r *big.Rat, mode RoundingMode) (int64, error) {
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		negative := r.Sign() < 0
+		// cmpHalf compares the discarded fraction with one half
+		cmpHalf := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(r.Denom())
+		away := false
+		switch mode {
+		case RoundHalfEven:
+			away = cmpHalf > 0 || cmpHalf == 0 && q.Bit(0) == 1
+		case RoundHalfUp:
+			away = cmpHalf >= 0
+		case RoundDown:
+		case RoundUp:
+			away = true
+		case RoundFloor:
+			away = negative
+		case RoundCeiling:
+			away = !negative
+		default:
+			return 0, fmt.Errorf("unknown rounding mode %d", mode)
+		}
+		if away {
+			if negative {
+				q.Sub(q, big.NewInt(1))
+			} else {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+	if !q.IsInt64() {
+		return 0, ErrMoneyOverflow
+	}
+	return q.Int64(), nil
+}
+
+// Rat returns the amount in major units as an exact rational
+func (m Money) Rat() *big.Rat {
+	digits := minorUnits[m.Currency]
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(digits))
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool { return m.Amount == 0 }
+
+// IsPositive reports whether the amount is greater than zero
+func (m Money) IsPositive() bool { return m.Amount > 0 }
+
+// IsNegative reports whether the amount is less than zero
+func (m Money) IsNegative() bool { return m.Amount < 0 }
+
+func (m Money) sameCurrency(o Money) error {
+	if m.Currency != o.Currency {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	return nil
+}
+
+// Add returns m+o, failing on mismatched currencies or int64 overflow
+func (m Money) Add(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	if o.Amount > 0 && m.Amount > math.MaxInt64-o.Amount ||
+		o.Amount < 0 && m.Amount < math.MinInt64-o.Amount {
+		return Money{}, fmt.Errorf("%w: %s + %s", ErrMoneyOverflow, m, o)
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m-o, failing on mismatched currencies or int64 overflow
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Amount == math.MinInt64 {
+		return Money{}, fmt.Errorf("%w: %s - %s", ErrMoneyOverflow, m, o)
+	}
+	return m.Add(Money{Amount: -o.Amount, Currency: o.Currency})
+}
+
+// Cmp compares m and o, returning -1, 0 or +1
+func (m Money) Cmp(o Money) (int, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Mul multiplies m by an exact factor, rounding to the currency's minor unit
+func (m Money) Mul(factor *big.Rat, mode RoundingMode) (Money, error) {
+	return RoundMoney(new(big.Rat).Mul(m.Rat(), factor), m.Currency, mode)
+}
+
+// Decimal formats the amount without the currency code, e.g. "-12.34"
+func (m Money) Decimal() string {
+	digits := minorUnits[m.Currency]
+	return m.Rat().FloatString(digits)
+}
+
+// String formats the amount with its currency code, e.g. "12.34 USD"
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency
+}
+
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// MarshalJSON encodes the amount as a decimal string to avoid float rounding
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+// UnmarshalJSON decodes the form written by MarshalJSON
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v moneyJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(v.Amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
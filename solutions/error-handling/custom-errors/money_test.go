@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestParseAndFormatMoney(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		minor    int64
+		out      string
+	}{
+		{"12.34", "USD", 1234, "12.34 USD"},
+		{"-0.5", "EUR", -50, "-0.50 EUR"},
+		{"1000", "JPY", 1000, "1000 JPY"},
+		{"1.234", "KWD", 1234, "1.234 KWD"},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.in, tt.currency)
+		if err != nil {
+			t.Errorf("ParseMoney(%q, %s) failed: %v", tt.in, tt.currency, err)
+			continue
+		}
+		if m.Amount != tt.minor || m.String() != tt.out {
+			t.Errorf("ParseMoney(%q, %s) = %d (%s), expected %d (%s)", tt.in, tt.currency, m.Amount, m, tt.minor, tt.out)
+		}
+	}
+
+	for _, bad := range []string{"", ".", "1.2.3", "abc", "1e3", "1/3", "0.001"} {
+		if _, err := ParseMoney(bad, "USD"); !errors.Is(err, ErrInvalidMoney) {
+			t.Errorf("ParseMoney(%q) expected ErrInvalidMoney, got %v", bad, err)
+		}
+	}
+	if _, err := ParseMoney("1", "XXX"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Errorf("Expected ErrUnknownCurrency, got %v", err)
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	// 0.1 + 0.2 is exactly 0.3 with integer minor units
+	sum, err := MustParseMoney("0.10", "USD").Add(MustParseMoney("0.20", "USD"))
+	if err != nil || sum != MustParseMoney("0.30", "USD") {
+		t.Errorf("Expected 0.30 USD, got %s (err %v)", sum, err)
+	}
+
+	if _, err := NewMoney(1, "USD").Add(NewMoney(1, "EUR")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Expected ErrCurrencyMismatch, got %v", err)
+	}
+	if _, err := NewMoney(math.MaxInt64, "USD").Add(NewMoney(1, "USD")); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("Expected ErrMoneyOverflow on add, got %v", err)
+	}
+	if _, err := NewMoney(math.MinInt64, "USD").Sub(NewMoney(1, "USD")); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("Expected ErrMoneyOverflow on sub, got %v", err)
+	}
+}
+
+func TestMoneyRounding(t *testing.T) {
+	half := big.NewRat(1, 2)
+	tests := []struct {
+		minor int64
+		mode  RoundingMode
+		want  int64
+	}{
+		{5, RoundHalfEven, 2},
+		{7, RoundHalfEven, 4},
+		{5, RoundHalfUp, 3},
+		{-5, RoundHalfUp, -3},
+		{5, RoundDown, 2},
+		{5, RoundUp, 3},
+		{-5, RoundFloor, -3},
+		{-5, RoundCeiling, -2},
+	}
+	for _, tt := range tests {
+		got, err := NewMoney(tt.minor, "USD").Mul(half, tt.mode)
+		if err != nil {
+			t.Fatalf("Mul failed: %v", err)
+		}
+		if got.Amount != tt.want {
+			t.Errorf("%d cents / 2 with mode %d = %d, expected %d", tt.minor, tt.mode, got.Amount, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	m := MustParseMoney("-1234.56", "USD")
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(data) != `{"amount":"-1234.56","currency":"USD"}` {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+	var decoded Money
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded != m {
+		t.Errorf("Round trip gave %s (err %v), expected %s", decoded, err, m)
+	}
+}
+
+func TestProcessTransactionWithMoney(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("0.30", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []string{"0.10", "0.20"} {
+		tx := &Transaction{ID: "tx-" + amount, Amount: MustParseMoney(amount, "USD"), From: "a", To: "b"}
+		if err := processor.ProcessTransaction(tx); err != nil {
+			t.Fatalf("ProcessTransaction failed: %v", err)
+		}
+	}
+	balance, err := processor.GetBalance("a")
+	if err != nil || !balance.IsZero() {
+		t.Errorf("Expected exactly zero balance, got %s (err %v)", balance, err)
+	}
+
+	tx := &Transaction{ID: "over", Amount: MustParseMoney("0.01", "USD"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(tx); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds, got %v", err)
+	}
+}
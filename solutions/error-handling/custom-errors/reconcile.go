@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ErrInvalidStatement is returned for bank statements that cannot be read
+var ErrInvalidStatement = errors.New("invalid bank statement")
+
+// BankRecord is one line of an external bank statement
+type BankRecord struct {
+	// Line is the line of the record in the statement file
+	Line      int
+	Reference string
+	// Date is midnight of the booking day
+	Date time.Time
+	// Amount is signed from the account holder's side: credits are positive
+	Amount      Money
+	Description string
+}
+
+// statementColumns are the columns ReadBankStatement requires
+var statementColumns = []string{"reference", "date", "amount", "currency"}
+
+// ReadBankStatement reads a CSV bank statement. The header row names the
+// columns reference, date, amount, currency and optionally description, in
+// any order and case. Dates are YYYY-MM-DD in loc, or RFC 3339. Every bad
+// line is reported at once in a *ValidationError wrapped with
+// ErrInvalidStatement.
+func ReadBankStatement(r io.Reader, loc *time.Location) ([]BankRecord, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidStatement)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStatement, err)
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	v := &ValidationError{}
+	for _, name := range statementColumns {
+		if _, ok := col[name]; !ok {
+			v.add("header."+name, ErrInvalidStatement)
+		}
+	}
+	if err := v.errOrNil(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStatement, err)
+	}
+
+	var records []BankRecord
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidStatement, err)
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := col[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec := BankRecord{Line: line, Reference: field("reference"), Description: field("description")}
+		if rec.Date, err = parseStatementDate(field("date"), loc); err != nil {
+			v.add(fmt.Sprintf("line %d.date", line), ErrInvalidStatement)
+		}
+		currency := field("currency")
+		if _, err := MinorUnits(currency); err != nil {
+			v.add(fmt.Sprintf("line %d.currency", line), ErrUnsupportedCurrency)
+		} else if rec.Amount, err = ParseMoney(field("amount"), currency); err != nil {
+			v.add(fmt.Sprintf("line %d.amount", line), ErrInvalidAmount)
+		}
+		records = append(records, rec)
+	}
+	if err := v.errOrNil(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidStatement, err)
+	}
+	return records, nil
+}
+
+// parseStatementDate parses a booking date, keeping only the day
+func parseStatementDate(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return startOfDay(t.In(loc)), nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// ReconcileStatus classifies an item of a reconciliation
+type ReconcileStatus string
+
+const (
+	ReconcileMatched ReconcileStatus = "matched"
+	// ReconcileMissingOurs is on the statement but was not recorded by us
+	ReconcileMissingOurs ReconcileStatus = "missing_ours"
+	// ReconcileMissingTheirs was recorded by us but is not on the statement
+	ReconcileMissingTheirs ReconcileStatus = "missing_theirs"
+	// ReconcileAmountMismatch has the same reference on both sides but
+	// amounts further apart than the tolerance
+	ReconcileAmountMismatch ReconcileStatus = "amount_mismatch"
+)
+
+// reconcileOrder is the order of statuses in a report
+var reconcileOrder = []ReconcileStatus{ReconcileAmountMismatch, ReconcileMissingOurs, ReconcileMissingTheirs, ReconcileMatched}
+
+// ReconcileOptions controls how ReconcileTransactions pairs records
+type ReconcileOptions struct {
+	// Account the statement is for. Our transactions are limited to those to
+	// or from it and signed from its side, in its currency. Without it,
+	// statement amounts are compared by absolute value.
+	Account string
+	// AmountTolerance is the largest difference between two amounts that
+	// still counts as equal. It applies to amounts in its currency only.
+	AmountTolerance Money
+	// DateTolerance is the most days a booking date may be from our
+	// transaction date for the two to match on amount alone
+	DateTolerance int
+	// Since and Until bound our transactions to [Since, Until). By default
+	// they span the statement's dates, widened by DateTolerance.
+	Since time.Time
+	Until time.Time
+}
+
+func (o ReconcileOptions) validate() error {
+	v := &ValidationError{}
+	if o.AmountTolerance.Currency != "" {
+		if _, err := MinorUnits(o.AmountTolerance.Currency); err != nil {
+			v.add("amount_tolerance.currency", ErrUnsupportedCurrency)
+		}
+	}
+	if o.AmountTolerance.IsNegative() {
+		v.add("amount_tolerance.amount", ErrInvalidAmount)
+	}
+	if o.DateTolerance < 0 {
+		v.add("date_tolerance", ErrInvalidQuery)
+	}
+	if !o.Since.IsZero() && !o.Until.IsZero() && o.Until.Before(o.Since) {
+		v.add("until", ErrInvalidQuery)
+	}
+	return v.errOrNil()
+}
+
+// window returns the period of our transactions to reconcile against records
+func (o ReconcileOptions) window(records []BankRecord) (since, until time.Time) {
+	since, until = o.Since, o.Until
+	for _, rec := range records {
+		if first := rec.Date.AddDate(0, 0, -o.DateTolerance); o.Since.IsZero() && (since.IsZero() || first.Before(since)) {
+			since = first
+		}
+		if last := rec.Date.AddDate(0, 0, o.DateTolerance+1); o.Until.IsZero() && last.After(until) {
+			until = last
+		}
+	}
+	return since, until
+}
+
+// ReconcileItem is one pairing, or one unpaired record, of a reconciliation
+type ReconcileItem struct {
+	Status ReconcileStatus
+	// Bank is nil for ReconcileMissingTheirs and Tx for ReconcileMissingOurs
+	Bank *BankRecord
+	Tx   *Transaction
+	// Recorded is the amount of Tx as it should appear on the statement
+	Recorded Money
+	// Difference is the statement amount less Recorded, when both are in
+	// the same currency
+	Difference Money
+	// ByReference is set when the records were paired by reference rather
+	// than by amount and date
+	ByReference bool
+	// DaysApart is the number of days between the booking and our transaction
+	DaysApart int
+}
+
+// ReconciliationReport is the outcome of ReconcileTransactions. Items are
+// ordered by status, discrepancies first, then by date.
+type ReconciliationReport struct {
+	Account string
+	Since   time.Time
+	Until   time.Time
+	Items   []ReconcileItem
+	Counts  map[ReconcileStatus]int
+}
+
+// Reconciled reports whether every record on both sides was matched
+func (r *ReconciliationReport) Reconciled() bool {
+	return r.Counts[ReconcileMatched] == len(r.Items)
+}
+
+// ReconcileTransactions pairs our transactions with the records of a bank
+// statement. A record whose reference is the ID of one of our transactions
+// is paired with it, and is a mismatch if the amounts differ by more than
+// the tolerance. Each remaining record is then paired with the unpaired
+// transaction of equal amount, within the tolerances, closest in date. Only
+// transactions whose funds moved are reconciled.
+func ReconcileTransactions(ours []Transaction, theirs []BankRecord, opts ReconcileOptions) (*ReconciliationReport, error) {
+	if err := opts.validate(); err != nil {
+		return nil, &TransactionError{Err: err, From: opts.Account, Context: "reconciliation failed"}
+	}
+	since, until := opts.window(theirs)
+	report := &ReconciliationReport{Account: opts.Account, Since: since, Until: until, Counts: make(map[ReconcileStatus]int)}
+
+	var txs []*Transaction
+	byID := make(map[string]int)
+	for i := range ours {
+		tx := &ours[i]
+		if !tx.moved() || (opts.Account != "" && tx.From != opts.Account && tx.To != opts.Account) {
+			continue
+		}
+		if (!since.IsZero() && tx.Timestamp.Before(since)) || (!until.IsZero() && !tx.Timestamp.Before(until)) {
+			continue
+		}
+		byID[tx.ID] = len(txs)
+		txs = append(txs, tx)
+	}
+	paired := make([]bool, len(txs))
+	var unpaired []*BankRecord
+	for i := range theirs {
+		rec := &theirs[i]
+		j, ok := byID[rec.Reference]
+		if !ok || paired[j] {
+			unpaired = append(unpaired, rec)
+			continue
+		}
+		paired[j] = true
+		item := newReconcileItem(rec, txs[j], opts)
+		item.ByReference = true
+		if !opts.withinTolerance(item.Difference) {
+			item.Status = ReconcileAmountMismatch
+		}
+		report.add(item)
+	}
+
+	for _, rec := range unpaired {
+		best := -1
+		var bestItem ReconcileItem
+		for j, tx := range txs {
+			if paired[j] {
+				continue
+			}
+			item := newReconcileItem(rec, tx, opts)
+			if !opts.withinTolerance(item.Difference) || item.DaysApart > opts.DateTolerance {
+				continue
+			}
+			if best < 0 || item.DaysApart < bestItem.DaysApart ||
+				(item.DaysApart == bestItem.DaysApart && abs(item.Difference.Amount) < abs(bestItem.Difference.Amount)) {
+				best, bestItem = j, item
+			}
+		}
+		if best < 0 {
+			report.add(ReconcileItem{Status: ReconcileMissingOurs, Bank: rec})
+			continue
+		}
+		paired[best] = true
+		report.add(bestItem)
+	}
+	for j, tx := range txs {
+		if !paired[j] {
+			report.add(ReconcileItem{Status: ReconcileMissingTheirs, Tx: tx, Recorded: recordedAmount(tx, opts.Account)})
+		}
+	}
+
+	rank := make(map[ReconcileStatus]int, len(reconcileOrder))
+	for i, s := range reconcileOrder {
+		rank[s] = i
+	}
+	sort.SliceStable(report.Items, func(i, j int) bool {
+		a, b := report.Items[i], report.Items[j]
+		if a.Status != b.Status {
+			return rank[a.Status] < rank[b.Status]
+		}
+		return a.date().Before(b.date())
+	})
+	return report, nil
+}
+
+func (r *ReconciliationReport) add(item ReconcileItem) {
+	r.Items = append(r.Items, item)
+	r.Counts[item.Status]++
+}
+
+// newReconcileItem pairs rec with tx as a match, before tolerances are checked
+func newReconcileItem(rec *BankRecord, tx *Transaction, opts ReconcileOptions) ReconcileItem {
+	item := ReconcileItem{Status: ReconcileMatched, Bank: rec, Tx: tx, Recorded: recordedAmount(tx, opts.Account)}
+	statement := rec.Amount
+	if opts.Account == "" {
+		statement.Amount = abs(statement.Amount)
+	}
+	if diff, err := statement.Sub(item.Recorded); err == nil {
+		item.Difference = diff
+	}
+	tday := startOfDay(tx.Timestamp.In(rec.Date.Location()))
+	item.DaysApart = int(math.Abs(math.Round(rec.Date.Sub(tday).Hours() / 24)))
+	return item
+}
+
+// withinTolerance reports whether diff is small enough to count as equal
+func (o ReconcileOptions) withinTolerance(diff Money) bool {
+	if diff.Currency == "" {
+		// Amounts in different currencies never match
+		return false
+	}
+	return diff.Amount == 0 || (diff.Currency == o.AmountTolerance.Currency && abs(diff.Amount) <= o.AmountTolerance.Amount)
+}
+
+// recordedAmount is how tx should appear on the statement of account: the
+// amount debited including fees as negative, or the amount credited, less
+// what has been refunded. Without an account it is the transaction amount
+// less refunds.
+func recordedAmount(tx *Transaction, account string) Money {
+	c := tx.Conversion
+	switch {
+	case account == "":
+		return unrefunded(tx, tx.Amount)
+	case tx.From == account && c != nil:
+		debit, err := unrefunded(tx, c.Debited).Add(c.Fee)
+		if err != nil {
+			debit = unrefunded(tx, c.Debited)
+		}
+		debit.Amount = -debit.Amount
+		return debit
+	case tx.From == account:
+		debit := unrefunded(tx, tx.Amount)
+		debit.Amount = -debit.Amount
+		return debit
+	case c != nil:
+		return unrefunded(tx, c.Credited)
+	default:
+		return unrefunded(tx, tx.Amount)
+	}
+}
+
+// unrefunded returns the part of m, one leg of tx, that has not been
+// refunded. Refunds return the same share of every leg, and never the fee.
+func unrefunded(tx *Transaction, m Money) Money {
+	if tx.Refunded.IsZero() || tx.Amount.IsZero() {
+		return m
+	}
+	share := new(big.Rat).Quo(tx.Refunded.Rat(), tx.Amount.Rat())
+	back, err := m.Mul(share, RoundHalfEven)
+	if err != nil {
+		return m
+	}
+	rest, err := m.Sub(back)
+	if err != nil {
+		return m
+	}
+	return rest
+}
+
+// moved reports whether the funds of tx have moved
+func (tx *Transaction) moved() bool {
+	switch tx.Status {
+	case StatusCaptured, StatusSettled, StatusRefunded, StatusPartiallyRefunded:
+		return true
+	}
+	return false
+}
+
+func (item ReconcileItem) date() time.Time {
+	if item.Bank != nil {
+		return item.Bank.Date
+	}
+	return item.Tx.Timestamp
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Reconcile reconciles what p recorded against a bank statement, as
+// ReconcileTransactions does. For an account it reconciles the account's
+// ledger postings, so deposits and each refund are matched as movements of
+// their own; without one, it reconciles p's transactions.
+func (p *PaymentProcessor) Reconcile(theirs []BankRecord, opts ReconcileOptions) (*ReconciliationReport, error) {
+	var ours []Transaction
+	if opts.Account == "" {
+		ours = p.findTransactions(TransactionQuery{})
+	} else {
+		var err error
+		if ours, err = p.movements(opts.Account); err != nil {
+			return nil, p.observe(&TransactionError{Err: err, From: opts.Account, Context: "reconciliation failed"})
+		}
+	}
+	report, err := ReconcileTransactions(ours, theirs, opts)
+	return report, p.observe(err)
+}
+
+// endOfTime is later than any journal entry
+var endOfTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// movements returns the postings to an account as one captured transaction
+// per change of its balance, so their recorded amounts are the changes. A
+// transaction's postings to the account, its fees among them, are one
+// change. The ID is that of the ledger posting: the transaction ID, or a
+// deposit or refund ID derived from it.
+func (p *PaymentProcessor) movements(accountID string) ([]Transaction, error) {
+	st, err := p.statement(accountID, time.Time{}, endOfTime)
+	if err != nil {
+		return nil, err
+	}
+	var txs []Transaction
+	var net int64
+	for i, line := range st.Lines {
+		if i == 0 || line.TxID != st.Lines[i-1].TxID || !line.Time.Equal(st.Lines[i-1].Time) {
+			txs = append(txs, Transaction{ID: line.TxID, To: accountID, Timestamp: line.Time, Status: StatusCaptured})
+			net = 0
+		}
+		net += line.delta().Amount
+		tx := &txs[len(txs)-1]
+		counterparty := line.Counterparty
+		if counterparty == "" {
+			counterparty = ExternalAccount(line.Amount.Currency)
+		}
+		tx.Amount, tx.From, tx.To = NewMoney(abs(net), line.Amount.Currency), counterparty, accountID
+		if net < 0 {
+			tx.From, tx.To = accountID, counterparty
+		}
+	}
+	return txs, nil
+}
+
+// WriteText renders the report as a summary followed by a plain-text table
+func (r *ReconciliationReport) WriteText(w io.Writer) error {
+	title := "all accounts"
+	if r.Account != "" {
+		title = r.Account
+	}
+	fmt.Fprintf(w, "Reconciliation for %s\n", title)
+	if !r.Since.IsZero() && !r.Until.IsZero() {
+		fmt.Fprintf(w, "Period %s to %s\n", r.Since.Format(time.DateOnly), r.Until.Add(-time.Nanosecond).Format(time.DateOnly))
+	}
+	summary := make([]string, len(reconcileOrder))
+	for i, s := range reconcileOrder {
+		summary[i] = fmt.Sprintf("%d %s", r.Counts[s], s)
+	}
+	fmt.Fprintf(w, "%s\n\n", strings.Join(summary, ", "))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Date\tLine\tReference\tTransaction\tStatement\tRecorded\tDifference\tStatus\n")
+	for _, item := range r.Items {
+		line, ref, statement := "", "", ""
+		if b := item.Bank; b != nil {
+			line, ref, statement = fmt.Sprint(b.Line), b.Reference, b.Amount.String()
+		}
+		txID, recorded, diff := "", "", ""
+		if item.Tx != nil {
+			txID, recorded = item.Tx.ID, item.Recorded.String()
+		}
+		if item.Bank != nil && item.Tx != nil && item.Difference.Currency != "" {
+			diff = item.Difference.Decimal()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", item.date().Format(time.DateOnly),
+			line, ref, txID, statement, recorded, diff, item.Status)
+	}
+	return tw.Flush()
+}
+
+// runReconciliation reconciles the bank statement at statementPath against
+// a CSV export at ledgerPath or, without one, the event log at eventsPath.
+// tolerance is a decimal in the statement's currency.
+func runReconciliation(statementPath, ledgerPath, eventsPath, tolerance string, opts ReconcileOptions) (*ReconciliationReport, error) {
+	f, err := os.Open(statementPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	theirs, err := ReadBankStatement(f, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	if len(theirs) > 0 {
+		if opts.AmountTolerance, err = ParseMoney(tolerance, theirs[0].Amount.Currency); err != nil {
+			return nil, fmt.Errorf("amount tolerance: %w", err)
+		}
+	}
+
+	switch {
+	case ledgerPath != "":
+		lf, err := os.Open(ledgerPath)
+		if err != nil {
+			return nil, err
+		}
+		defer lf.Close()
+		ours, err := ReadTransactionsCSV(lf)
+		if err != nil {
+			return nil, err
+		}
+		return ReconcileTransactions(ours, theirs, opts)
+	case eventsPath != "":
+		p, err := LoadPaymentProcessor(eventsPath, eventsPath+".snapshot")
+		if err != nil {
+			return nil, err
+		}
+		return p.Reconcile(theirs, opts)
+	default:
+		return nil, errors.New("either a ledger export or an event log is required")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStatement = `Date,Reference,Description,Amount,Currency
+2024-05-01,tx1,Payment to b,-10.00,USD
+2024-05-02,tx2,Payment to b,-21.00,USD
+2024-05-04,BANK-889,Card payment,-5.00,USD
+2024-05-03,FEE-1,Monthly fee,-2.50,USD
+`
+
+// newReconcileProcessor pays b from a once a day from May 1, 2024
+func newReconcileProcessor(t *testing.T) *PaymentProcessor {
+	t.Helper()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p := NewPaymentProcessor()
+	p.now = func() time.Time { return now }
+	openAccounts(t, p, "USD", "a", "b")
+	if err := p.Deposit("a", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct{ id, amount string }{{"tx1", "10.00"}, {"tx2", "20.00"}, {"tx3", "5.00"}, {"tx4", "7.00"}} {
+		if err := p.ProcessTransaction(&Transaction{ID: step.id, Amount: MustParseMoney(step.amount, "USD"), From: "a", To: "b"}); err != nil {
+			t.Fatal(err)
+		}
+		now = now.AddDate(0, 0, 1)
+	}
+	return p
+}
+
+func readTestStatement(t *testing.T) []BankRecord {
+	t.Helper()
+	records, err := ReadBankStatement(strings.NewReader(testStatement), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestReadBankStatement(t *testing.T) {
+	records := readTestStatement(t)
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(records))
+	}
+	want := BankRecord{Line: 3, Reference: "tx2", Date: time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), Amount: MustParseMoney("-21.00", "USD"), Description: "Payment to b"}
+	if records[1] != want {
+		t.Errorf("Expected %+v, got %+v", want, records[1])
+	}
+
+	_, err := ReadBankStatement(strings.NewReader("date,amount\n"), time.UTC)
+	var validationErr *ValidationError
+	if !errors.Is(err, ErrInvalidStatement) || !errors.As(err, &validationErr) || len(validationErr.Errors) != 2 {
+		t.Errorf("Expected the missing columns to be reported, got %v", err)
+	}
+
+	bad := "reference,date,amount,currency\nr1,yesterday,1.00,USD\nr2,2024-05-01,1.001,USD\nr3,2024-05-01,1.00,XXX\n"
+	_, err = ReadBankStatement(strings.NewReader(bad), time.UTC)
+	if !errors.As(err, &validationErr) || len(validationErr.Errors) != 3 || ErrorCode(err) != "PAY_INVALID_STATEMENT" {
+		t.Fatalf("Expected every bad line to be reported, got %v", err)
+	}
+	if validationErr.Errors[0].Field != "line 2.date" || !errors.Is(validationErr.Errors[1], ErrInvalidAmount) {
+		t.Errorf("Unexpected field errors %v", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	p := newReconcileProcessor(t)
+	report, err := p.Reconcile(readTestStatement(t), ReconcileOptions{Account: "a", DateTolerance: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]ReconcileItem)
+	for _, item := range report.Items {
+		key := ""
+		if item.Bank != nil {
+			key = item.Bank.Reference
+		}
+		if item.Tx != nil {
+			key += "/" + item.Tx.ID
+		}
+		got[key] = item
+	}
+	tests := []struct {
+		key    string
+		status ReconcileStatus
+	}{
+		{"tx1/tx1", ReconcileMatched},
+		{"tx2/tx2", ReconcileAmountMismatch},
+		{"BANK-889/tx3", ReconcileMatched},
+		{"FEE-1", ReconcileMissingOurs},
+		{"/tx4", ReconcileMissingTheirs},
+		{"/deposit:a", ReconcileMissingTheirs},
+	}
+	if len(report.Items) != len(tests) {
+		t.Errorf("Expected %d items, got %+v", len(tests), got)
+	}
+	for _, tt := range tests {
+		if item, ok := got[tt.key]; !ok || item.Status != tt.status {
+			t.Errorf("%s: expected %s, got %+v", tt.key, tt.status, item)
+		}
+	}
+	if item := got["tx2/tx2"]; item.Difference != MustParseMoney("-1.00", "USD") || item.Recorded != MustParseMoney("-20.00", "USD") || !item.ByReference {
+		t.Errorf("Unexpected mismatch %+v", item)
+	}
+	if item := got["BANK-889/tx3"]; item.ByReference || item.DaysApart != 1 {
+		t.Errorf("Expected a match on amount a day apart, got %+v", item)
+	}
+	if report.Items[0].Status != ReconcileAmountMismatch || report.Reconciled() {
+		t.Errorf("Expected discrepancies first, got %+v", report.Items[0])
+	}
+
+	// Tolerances absorb the small difference and the late booking
+	report, err = p.Reconcile(readTestStatement(t), ReconcileOptions{Account: "a", AmountTolerance: MustParseMoney("1.00", "USD")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Counts[ReconcileAmountMismatch] != 0 || report.Counts[ReconcileMatched] != 2 || report.Counts[ReconcileMissingOurs] != 2 {
+		t.Errorf("Unexpected counts %v", report.Counts)
+	}
+
+	if _, err := p.Reconcile(nil, ReconcileOptions{Account: "nobody"}); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Expected an unknown account to be rejected, got %v", err)
+	}
+	if _, err := p.Reconcile(nil, ReconcileOptions{DateTolerance: -1}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Expected a negative tolerance to be rejected, got %v", err)
+	}
+}
+
+func TestReconcileDepositsAndRefunds(t *testing.T) {
+	p := newReconcileProcessor(t)
+	if err := p.Refund("tx2", MustParseMoney("4.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	statement := `Date,Reference,Amount,Currency
+2024-05-01,BANK-1,100.00,USD
+2024-05-01,tx1,-10.00,USD
+2024-05-02,tx2,-20.00,USD
+2024-05-03,tx3,-5.00,USD
+2024-05-04,tx4,-7.00,USD
+2024-05-05,BANK-2,4.00,USD
+`
+	records, err := ReadBankStatement(strings.NewReader(statement), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := p.Reconcile(records, ReconcileOptions{Account: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Reconciled() || len(report.Items) != 6 {
+		t.Errorf("Expected the deposit and the refund to be matched, got %v", report.Counts)
+	}
+	for _, item := range report.Items {
+		if item.Bank.Reference == "BANK-2" && (item.Tx.ID != "tx2:refund" || item.Tx.From != "b") {
+			t.Errorf("Expected the refund from b, got %+v", item.Tx)
+		}
+	}
+
+	// Without the ledger, a refund nets off the transaction it returns
+	tx, err := p.GetTransaction("tx2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recordedAmount(tx, "a"); got != MustParseMoney("-16.00", "USD") {
+		t.Errorf("Expected -16.00 USD after the refund, got %s", got)
+	}
+	if got := recordedAmount(tx, "b"); got != MustParseMoney("16.00", "USD") {
+		t.Errorf("Expected 16.00 USD after the refund, got %s", got)
+	}
+}
+
+func TestRunReconciliation(t *testing.T) {
+	p := newReconcileProcessor(t)
+	dir := t.TempDir()
+	ledger, err := os.Create(filepath.Join(dir, "ledger.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ExportTransactions(ledger, TransactionQuery{}, ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	ledger.Close()
+	statement := filepath.Join(dir, "statement.csv")
+	if err := os.WriteFile(statement, []byte(testStatement), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := runReconciliation(statement, ledger.Name(), "", "1.00", ReconcileOptions{Account: "a", DateTolerance: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := report.WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, want := range []string{
+		"Reconciliation for a\n",
+		"0 amount_mismatch, 1 missing_ours, 1 missing_theirs, 3 matched\n",
+		"2024-05-03  5     FEE-1",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in report:\n%s", want, text)
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimRight(line, " ") != line {
+			t.Errorf("Trailing whitespace in %q", line)
+		}
+	}
+
+	// Reconciling against an event log leaves a torn record in place
+	logPath := filepath.Join(dir, "events.jsonl")
+	logged, err := OpenPaymentProcessor(logPath, EventLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, logged, "USD", "a")
+	if err := logged.Deposit("a", MustParseMoney("5.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	logged.Close()
+	file, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0)
+	file.WriteString(`{"crc":12,"data":{"seq":`)
+	file.Close()
+	before, _ := os.ReadFile(logPath)
+	if _, err := runReconciliation(statement, "", logPath, "0", ReconcileOptions{Account: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(logPath); string(after) != string(before) {
+		t.Error("Expected the event log to be left unchanged")
+	}
+	if _, err := os.Stat(logPath + ".snapshot"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no snapshot to be written, got %v", err)
+	}
+
+	if _, err := runReconciliation(statement, "", "", "0", ReconcileOptions{}); err == nil {
+		t.Error("Expected a missing ledger to be rejected")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrReporterClosed is returned when reporting to a closed ErrorReporter
+	ErrReporterClosed = errors.New("error reporter is closed")
+	// ErrReportQueueFull is returned when a report is dropped because the
+	// sink is falling behind
+	ErrReportQueueFull = errors.New("error report queue is full")
+)
+
+// ErrorReporter forwards error reports to an external sink
+type ErrorReporter interface {
+	Report(r ErrorReport) error
+	// Close flushes pending reports and releases the sink
+	Close() error
+}
+
+// ChainLink is one error in an unwrap chain
+type ChainLink struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// ErrorReport describes an error for an external sink
+type ErrorReport struct {
+	Time time.Time `json:"time"`
+	// Fingerprint is equal for errors of the same kind raised at the same
+	// step, whatever transaction they came from
+	Fingerprint string `json:"fingerprint"`
+	Message     string `json:"message"`
+	Sentinel    string `json:"sentinel"`
+	Context     string `json:"context,omitempty"`
+	TxID        string `json:"tx_id,omitempty"`
+	Amount      *Money `json:"amount,omitempty"`
+	From        string `json:"from,omitempty"`
+	To          string `json:"to,omitempty"`
+	// Chain lists err and everything it wraps, depth first
+	Chain []ChainLink `json:"chain"`
+}
+
+// NewErrorReport describes err. Transaction fields are filled from the first
+// TransactionError in its chain, if any.
+func NewErrorReport(err error, at time.Time) ErrorReport {
+	r := ErrorReport{
+		Time:     at,
+		Message:  err.Error(),
+		Sentinel: SentinelName(err),
+		Chain:    unwrapChain(err),
+	}
+	var txErr *TransactionError
+	if errors.As(err, &txErr) {
+		r.Context = txErr.Context
+		r.TxID = txErr.TxID
+		r.From = txErr.From
+		r.To = txErr.To
+		if txErr.Amount.Currency != "" {
+			amount := txErr.Amount
+			r.Amount = &amount
+		}
+	}
+	// Messages carry amounts and IDs, so only types and the context are
+	// hashed. Each type counts once, so a retried failure keeps its
+	// fingerprint however many attempts it took.
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s", r.Sentinel, r.Context)
+	seen := make(map[string]bool)
+	for _, link := range r.Chain {
+		if !seen[link.Type] {
+			seen[link.Type] = true
+			fmt.Fprintf(h, "\x00%s", link.Type)
+		}
+	}
+	r.Fingerprint = hex.EncodeToString(h.Sum(nil))[:16]
+	return r
+}
+
+// unwrapChain walks err depth first through both Unwrap() error and
+// Unwrap() []error
+func unwrapChain(err error) []ChainLink {
+	var chain []ChainLink
+	var walk func(error)
+	walk = func(err error) {
+		if err == nil {
+			return
+		}
+		chain = append(chain, ChainLink{Type: reflect.TypeOf(err).String(), Message: err.Error()})
+		switch u := err.(type) {
+		case interface{ Unwrap() error }:
+			walk(u.Unwrap())
+		case interface{ Unwrap() []error }:
+			for _, e := range u.Unwrap() {
+				walk(e)
+			}
+		}
+	}
+	walk(err)
+	return chain
+}
+
+// MemoryReporter keeps reports in memory, for tests
+type MemoryReporter struct {
+	mu      sync.Mutex
+	reports []ErrorReport
+}
+
+func (m *MemoryReporter) Report(r ErrorReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports = append(m.reports, r)
+	return nil
+}
+
+func (m *MemoryReporter) Close() error { return nil }
+
+// Reports returns a copy of everything reported so far
+func (m *MemoryReporter) Reports() []ErrorReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ErrorReport(nil), m.reports...)
+}
+
+// FileReporterOptions configures a FileReporter. Zero fields take defaults.
+type FileReporterOptions struct {
+	// MaxBytes is the size at which the file is rotated (default 10 MiB)
+	MaxBytes int64
+	// MaxBackups is how many rotated files are kept as path.1, path.2, ... (default 3)
+	MaxBackups int
+}
+
+// FileReporter appends reports to a JSON Lines file, rotating it by size
+type FileReporter struct {
+	path string
+	opts FileReporterOptions
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileReporter opens path for appending, creating it if needed
+func NewFileReporter(path string, opts FileReporterOptions) (*FileReporter, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 10 << 20
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = 3
+	}
+	f := &FileReporter{path: path, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current file. The caller must hold f.mu or be the constructor.
+func (f *FileReporter) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open report file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat report file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *FileReporter) Report(r ErrorReport) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return ErrReporterClosed
+	}
+	if f.size > 0 && f.size+int64(len(line)) > f.opts.MaxBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, the oldest falling off, and starts a new
+// file. The caller must hold f.mu.
+func (f *FileReporter) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close report file: %w", err)
+	}
+	f.file = nil
+	for i := f.opts.MaxBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d", f.path, i)
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate report file: %w", err)
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate report file: %w", err)
+	}
+	return f.open()
+}
+
+func (f *FileReporter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// WebhookError is a webhook response with a non-2xx status. 5xx and 429
+// responses are temporary.
+type WebhookError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("webhook returned %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *WebhookError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// WebhookOptions configures a WebhookReporter. Zero fields take defaults.
+type WebhookOptions struct {
+	Client *http.Client // default http.DefaultClient
+	// BatchSize is the most reports sent in one request (default 20)
+	BatchSize int
+	// FlushInterval bounds how long a report waits for its batch to fill (default 5s)
+	FlushInterval time.Duration
+	// QueueSize is the most reports waiting for delivery; more are dropped
+	// (default 1000)
+	QueueSize int
+	Retry     RetryPolicy
+	// OnError, if set, is called with batches that could not be delivered
+	// and with reports dropped because the queue was full. It must not block.
+	OnError func(batch []ErrorReport, err error)
+}
+
+// WebhookReporter posts reports as JSON arrays to a URL in the background,
+// batching them and retrying transient failures. Reporting never waits on
+// the webhook: when the queue is full, reports are dropped.
+type WebhookReporter struct {
+	url     string
+	opts    WebhookOptions
+	dropped atomic.Int64
+
+	mu      sync.RWMutex
+	closed  bool
+	reports chan ErrorReport
+	done    chan struct{}
+}
+
+// NewWebhookReporter starts a reporter that posts to url
+func NewWebhookReporter(url string, opts WebhookOptions) *WebhookReporter {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 20
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	w := &WebhookReporter{
+		url:     url,
+		opts:    opts,
+		reports: make(chan ErrorReport, opts.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Report queues r for delivery, or drops it with ErrReportQueueFull if the
+// queue is full
+func (w *WebhookReporter) Report(r ErrorReport) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrReporterClosed
+	}
+	select {
+	case w.reports <- r:
+		return nil
+	default:
+	}
+	w.dropped.Add(1)
+	if w.opts.OnError != nil {
+		w.opts.OnError([]ErrorReport{r}, ErrReportQueueFull)
+	}
+	return ErrReportQueueFull
+}
+
+// Dropped returns the number of reports dropped because the queue was full
+func (w *WebhookReporter) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Close delivers queued reports and stops the reporter
+func (w *WebhookReporter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.reports)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+func (w *WebhookReporter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	var batch []ErrorReport
+	flush := func() {
+		if len(batch) > 0 {
+			w.deliver(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case r, ok := <-w.reports:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= w.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (w *WebhookReporter) deliver(batch []ErrorReport) {
+	body, err := json.Marshal(batch)
+	if err == nil {
+		err = Retry(context.Background(), w.opts.Retry, func(ctx context.Context) error {
+			return w.post(ctx, body)
+		})
+	}
+	if err != nil && w.opts.OnError != nil {
+		w.opts.OnError(batch, err)
+	}
+}
+
+func (w *WebhookReporter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetworkError, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &WebhookError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// SetErrorReporter forwards every TransactionError returned by the
+// processor's methods to r. Reporting failures are dropped; use
+// a sink that retries, such as WebhookReporter, where delivery matters. Nil
+// stops reporting.
+func (p *PaymentProcessor) SetErrorReporter(r ErrorReporter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reporter = r
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestErrorReportChainAndFingerprint(t *testing.T) {
+	reporter := &MemoryReporter{}
+	processor := NewPaymentProcessor()
+	processor.SetErrorReporter(reporter)
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"tx1", "tx2"} {
+		tx := &Transaction{ID: id, Amount: MustParseMoney("20.00", "USD"), From: "a", To: "b"}
+		processor.ProcessTransaction(tx)
+	}
+	tx := &Transaction{ID: "tx3", Amount: MustParseMoney("0.00", "USD"), From: "a", To: "b"}
+	processor.ProcessTransaction(tx)
+
+	reports := reporter.Reports()
+	if len(reports) != 3 {
+		t.Fatalf("Expected 3 reports, got %d", len(reports))
+	}
+	first := reports[0]
+	if first.TxID != "tx1" || first.From != "a" || first.Amount == nil || *first.Amount != MustParseMoney("20.00", "USD") {
+		t.Errorf("Expected transaction fields in the report, got %+v", first)
+	}
+	if first.Sentinel != "ErrInsufficientFunds" || len(first.Chain) != 2 ||
+		first.Chain[0].Type != "*main.TransactionError" || first.Chain[1].Message != ErrInsufficientFunds.Error() {
+		t.Errorf("Unexpected chain: %+v", first.Chain)
+	}
+	if first.Fingerprint != reports[1].Fingerprint {
+		t.Errorf("Same failure on different transactions should share a fingerprint")
+	}
+	if first.Fingerprint == reports[2].Fingerprint {
+		t.Errorf("Different failures should not share a fingerprint")
+	}
+}
+
+func TestUnwrapChainFollowsJoins(t *testing.T) {
+	err := newTransactionError(&Transaction{ID: "tx"}, &RetryError{
+		Attempts: 2,
+		Err:      errors.Join(&AttemptError{Attempt: 1, Err: ErrNetworkError}, &AttemptError{Attempt: 2, Err: ErrCircuitOpen}),
+	}, "payment network unavailable")
+	r := NewErrorReport(err, time.Now())
+	types := []string{}
+	for _, link := range r.Chain {
+		types = append(types, link.Type)
+	}
+	want := []string{"*main.TransactionError", "*main.RetryError", "*errors.joinError",
+		"*main.AttemptError", "*errors.errorString", "*main.AttemptError", "*errors.errorString"}
+	if len(types) != len(want) {
+		t.Fatalf("Chain types = %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("Chain[%d] = %s, want %s", i, types[i], want[i])
+		}
+	}
+	if r.Sentinel != "ErrCircuitOpen" {
+		t.Errorf("Expected ErrCircuitOpen, got %s", r.Sentinel)
+	}
+}
+
+func TestFingerprintIgnoresAttemptCount(t *testing.T) {
+	retried := func(attempts int) error {
+		errs := make([]error, attempts)
+		for i := range errs {
+			errs[i] = &AttemptError{Attempt: i + 1, Err: ErrNetworkError}
+		}
+		return newTransactionError(&Transaction{ID: "tx"}, &RetryError{Attempts: attempts, Err: errors.Join(errs...)}, "payment network call failed")
+	}
+	two, three := NewErrorReport(retried(2), time.Now()), NewErrorReport(retried(3), time.Now())
+	if two.Fingerprint != three.Fingerprint {
+		t.Errorf("Expected the same fingerprint for 2 and 3 attempts, got %s and %s", two.Fingerprint, three.Fingerprint)
+	}
+	if len(three.Chain) <= len(two.Chain) {
+		t.Errorf("Expected the chain to keep every attempt, got %d and %d links", len(two.Chain), len(three.Chain))
+	}
+}
+
+func TestFileReporterRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "errors.jsonl")
+	reporter, err := NewFileReporter(path, FileReporterOptions{MaxBytes: 600, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		report := NewErrorReport(newTransactionError(&Transaction{ID: "tx"}, ErrInvalidAmount, "amount validation failed"), time.Now())
+		if err := reporter.Report(report); err != nil {
+			t.Fatalf("Report failed: %v", err)
+		}
+	}
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.Report(ErrorReport{}); !errors.Is(err, ErrReporterClosed) {
+		t.Errorf("Expected ErrReporterClosed, got %v", err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		info, _ := file.Stat()
+		if info.Size() > 600 {
+			t.Errorf("%s is %d bytes, over the limit", name, info.Size())
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var r ErrorReport
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Sentinel != "ErrInvalidAmount" {
+				t.Errorf("Bad line in %s: %s", name, scanner.Text())
+			}
+		}
+		file.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 backups")
+	}
+}
+
+func TestWebhookReporterBatchesAndRetries(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]ErrorReport
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		var batch []ErrorReport
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, batch)
+	}))
+	defer server.Close()
+
+	reporter := NewWebhookReporter(server.URL, WebhookOptions{
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+		Retry:         RetryPolicy{InitialBackoff: time.Millisecond},
+	})
+	for _, id := range []string{"tx1", "tx2", "tx3", "tx4"} {
+		err := newTransactionError(&Transaction{ID: id}, ErrInsufficientFunds, "insufficient funds")
+		if err := reporter.Report(NewErrorReport(err, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reporter.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 3 || len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 {
+		t.Fatalf("Expected a retried batch of 3 and a final batch of 1, got %d requests and %v", requests, batches)
+	}
+	if batches[1][0].TxID != "tx4" {
+		t.Errorf("Expected tx4 in the last batch, got %+v", batches[1][0])
+	}
+}
+
+func TestWebhookReporterGivesUpOnClientErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "bad payload", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	var failed error
+	reporter := NewWebhookReporter(server.URL, WebhookOptions{
+		Retry:   RetryPolicy{InitialBackoff: time.Millisecond},
+		OnError: func(batch []ErrorReport, err error) { failed = err },
+	})
+	reporter.Report(NewErrorReport(ErrInvalidAmount, time.Now()))
+	reporter.Close()
+
+	var webhookErr *WebhookError
+	if !errors.As(failed, &webhookErr) || webhookErr.StatusCode != http.StatusBadRequest || requests != 1 {
+		t.Errorf("Expected one request and a 400 WebhookError, got %v after %d requests", failed, requests)
+	}
+}
+
+func TestWebhookReporterDoesNotBlockOnSlowServer(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	dropped := 0
+	reporter := NewWebhookReporter(server.URL, WebhookOptions{
+		BatchSize:     1,
+		QueueSize:     2,
+		FlushInterval: time.Hour,
+		OnError: func(batch []ErrorReport, err error) {
+			if errors.Is(err, ErrReportQueueFull) {
+				mu.Lock()
+				dropped += len(batch)
+				mu.Unlock()
+			}
+		},
+	})
+	start := time.Now()
+	var queueFull int
+	for i := 0; i < 10; i++ {
+		if err := reporter.Report(NewErrorReport(ErrInsufficientFunds, time.Now())); errors.Is(err, ErrReportQueueFull) {
+			queueFull++
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Report blocked for %s on a slow webhook", elapsed)
+	}
+	close(release)
+	reporter.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if queueFull == 0 || int64(queueFull) != reporter.Dropped() || dropped != queueFull {
+		t.Errorf("Expected dropped reports to be counted and passed to OnError, got %d returned, %d counted, %d to OnError",
+			queueFull, reporter.Dropped(), dropped)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// transientErrors are sentinels for failures that may succeed when retried
+var transientErrors = []error{ErrNetworkError}
+
+// temporary is implemented by errors that know whether a retry can help,
+// such as *net.OpError
+type temporary interface {
+	Temporary() bool
+}
+
+// IsTransient reports whether err is worth retrying. Errors that implement
+// Temporary() decide for themselves; otherwise err is transient if it wraps
+// one of the transient sentinels. Cancellation is never transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var t temporary
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	for _, target := range transientErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPolicy configures Retry. Zero fields take the DefaultRetryPolicy values.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes each delay by up to this fraction in either direction
+	Jitter float64
+	// MaxElapsed stops retrying once the next delay would pass this budget
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy is used by PaymentProcessor unless SetRetryPolicy is called
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	MaxElapsed:     5 * time.Second,
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if rp.InitialBackoff <= 0 {
+		rp.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if rp.Multiplier < 1 {
+		rp.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	return rp
+}
+
+// delay returns the jittered wait before the attempt after one that waited backoff
+func (rp RetryPolicy) delay(backoff time.Duration) time.Duration {
+	if rp.Jitter <= 0 {
+		return backoff
+	}
+	spread := float64(backoff) * rp.Jitter
+	return backoff + time.Duration(spread*(2*rand.Float64()-1))
+}
+
+// AttemptError records the failure of a single attempt
+type AttemptError struct {
+	Attempt int
+	Err     error
+}
+
+func (e *AttemptError) Error() string {
+	return fmt.Sprintf("attempt %d: %v", e.Attempt, e.Err)
+}
+
+func (e *AttemptError) Unwrap() error {
+	return e.Err
+}
+
+// RetryError is returned when Retry gives up. Err joins an *AttemptError for
+// every attempt, followed by the context error if the wait was cancelled.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("gave up after %d attempt(s): %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports false: the retries have already been spent
+func (e *RetryError) Temporary() bool {
+	return false
+}
+
+// Retry calls op until it succeeds, returns a permanent error, runs out of
+// attempts or time, or ctx is done. Waits between attempts grow
+// exponentially with jitter.
+func Retry(ctx context.Context, policy RetryPolicy, op func(context.Context) error) error {
+	policy = policy.withDefaults()
+	start := time.Now()
+	backoff := policy.InitialBackoff
+	var attempts []error
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+		attempts = append(attempts, &AttemptError{Attempt: attempt, Err: err})
+		if !IsTransient(err) || attempt >= policy.MaxAttempts {
+			break
+		}
+		wait := policy.delay(backoff)
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			break
+		}
+		if err := sleep(ctx, wait); err != nil {
+			attempts = append(attempts, err)
+			break
+		}
+		backoff = min(time.Duration(float64(backoff)*policy.Multiplier), policy.MaxBackoff)
+	}
+	return &RetryError{Attempts: len(attempts), Err: errors.Join(attempts...)}
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetGateway sets the external payment network call made when a transaction
+// is captured. A nil gateway, the default, settles transactions internally.
+func (p *PaymentProcessor) SetGateway(gateway func(context.Context) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gateway = gateway
+}
+
+// SetRetryPolicy configures how gateway calls are retried
+func (p *PaymentProcessor) SetRetryPolicy(policy RetryPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retry = policy
+}
+
+// callGateway submits a capture to the payment network, retrying transient
+// failures. Each attempt goes through the circuit breaker, if any; an open
+// circuit is permanent so retries stop at once.
+func (p *PaymentProcessor) callGateway(ctx context.Context) error {
+	p.mu.RLock()
+	gateway, policy, breaker := p.gateway, p.retry, p.breaker
+	p.mu.RUnlock()
+	if gateway == nil {
+		return nil
+	}
+	if breaker != nil {
+		call := gateway
+		gateway = func(ctx context.Context) error { return breaker.Execute(ctx, call) }
+	}
+	return Retry(ctx, policy, gateway)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type tempErr struct{ temporary bool }
+
+func (e tempErr) Error() string   { return fmt.Sprintf("temporary=%v", e.temporary) }
+func (e tempErr) Temporary() bool { return e.temporary }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ErrNetworkError, true},
+		{fmt.Errorf("submit: %w", ErrNetworkError), true},
+		{ErrInsufficientFunds, false},
+		{tempErr{true}, true},
+		{tempErr{false}, false},
+		{fmt.Errorf("%w: %w", ErrNetworkError, context.Canceled), false},
+		{&RetryError{Attempts: 3, Err: ErrNetworkError}, false},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+var fastRetry = RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+func TestRetryRecoversFromTransientErrors(t *testing.T) {
+	calls := 0
+	err := Retry(context.Background(), fastRetry, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return ErrNetworkError
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third call, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryReportsEveryAttempt(t *testing.T) {
+	calls := 0
+	err := Retry(context.Background(), fastRetry, func(context.Context) error {
+		calls++
+		return fmt.Errorf("call %d: %w", calls, ErrNetworkError)
+	})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 4 || calls != 4 {
+		t.Fatalf("Expected a RetryError after 4 attempts, got %v (%d calls)", err, calls)
+	}
+	var attempt *AttemptError
+	if !errors.As(err, &attempt) || attempt.Attempt != 1 {
+		t.Errorf("Expected the first AttemptError to be reachable, got %v", attempt)
+	}
+	if !errors.Is(err, ErrNetworkError) {
+		t.Errorf("Expected the cause to be preserved, got %v", err)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), fastRetry, func(context.Context) error {
+		calls++
+		return ErrInsufficientFunds
+	})
+	if calls != 1 || !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Permanent errors should not be retried, got %v after %d calls", err, calls)
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour}
+	err := Retry(ctx, policy, func(context.Context) error {
+		cancel()
+		return ErrNetworkError
+	})
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrNetworkError) {
+		t.Errorf("Expected both the attempt and cancellation in the error, got %v", err)
+	}
+
+	start := time.Now()
+	policy = RetryPolicy{MaxAttempts: 100, InitialBackoff: 20 * time.Millisecond, MaxElapsed: 50 * time.Millisecond}
+	err = Retry(context.Background(), policy, func(context.Context) error { return ErrNetworkError })
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond || err == nil {
+		t.Errorf("Expected to give up within the elapsed budget, took %s (err %v)", elapsed, err)
+	}
+}
+
+func TestCaptureRetriesGateway(t *testing.T) {
+	processor := NewPaymentProcessor()
+	processor.SetRetryPolicy(fastRetry)
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	failures := 2
+	processor.SetGateway(func(context.Context) error {
+		if failures > 0 {
+			failures--
+			return ErrNetworkError
+		}
+		return nil
+	})
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("4.00", "USD"), From: "a", To: "b"}
+	if err := processor.ProcessTransaction(tx); err != nil {
+		t.Fatalf("Expected retries to absorb two network errors, got %v", err)
+	}
+
+	processor.SetGateway(func(context.Context) error { return ErrNetworkError })
+	tx = &Transaction{ID: "tx2", Amount: MustParseMoney("4.00", "USD"), From: "a", To: "b"}
+	err := processor.ProcessTransaction(tx)
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || !errors.Is(err, ErrNetworkError) {
+		t.Errorf("Expected a TransactionError wrapping ErrNetworkError, got %v", err)
+	}
+	if tx.Status != StatusCancelled {
+		t.Errorf("Expected the authorization to be voided, got %q", tx.Status)
+	}
+	if balance, _ := processor.GetBalance("a"); balance != MustParseMoney("6.00", "USD") {
+		t.Errorf("Expected only tx1 to move money, got %s", balance)
+	}
+}
+
+func TestCaptureDoesNotBlockReaders(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	tx := &Transaction{ID: "tx1", Amount: MustParseMoney("4.00", "USD"), From: "a", To: "b"}
+	if err := processor.Authorize(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	calling, release := make(chan struct{}), make(chan struct{})
+	processor.SetGateway(func(context.Context) error {
+		close(calling)
+		<-release
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() { done <- processor.Capture("tx1") }()
+	<-calling
+
+	// The transaction can be read while the network call is in flight, but
+	// not captured or voided a second time
+	got, err := processor.GetTransaction("tx1")
+	if err != nil || got.Status != StatusAuthorized {
+		t.Errorf("Expected an authorized transaction, got %+v (%v)", got, err)
+	}
+	if err := processor.Capture("tx1"); !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Expected ErrIllegalTransition for a second capture, got %v", err)
+	}
+	if err := processor.Void("tx1"); !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Expected ErrIllegalTransition voiding during capture, got %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Capture failed: %v", err)
+	}
+	if balance, _ := processor.GetBalance("b"); balance != MustParseMoney("4.00", "USD") {
+		t.Errorf("Expected 4.00 USD captured, got %s", balance)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Rule errors
+var (
+	ErrTransactionDenied = errors.New("transaction denied")
+	ErrReviewRequired    = errors.New("transaction held for review")
+)
+
+// Decision is the outcome of evaluating a rule
+type Decision string
+
+const (
+	DecisionAllow  Decision = "allow"
+	DecisionReview Decision = "review"
+	DecisionDeny   Decision = "deny"
+)
+
+// severity orders decisions from most to least permissive
+func (d Decision) severity() int {
+	switch d {
+	case DecisionDeny:
+		return 2
+	case DecisionReview:
+		return 1
+	}
+	return 0
+}
+
+// RuleContext is what a rule may know besides the transaction itself
+type RuleContext struct {
+	Now time.Time
+	// History holds the source account's earlier outgoing transactions that
+	// were not failed or cancelled
+	History []Transaction
+}
+
+// Rule checks a transaction before any money is held. Rules compare amounts
+// in their own currency and ignore transactions in other currencies.
+type Rule interface {
+	ID() string
+	// Evaluate returns DecisionAllow or the rule's decision with a reason
+	Evaluate(tx *Transaction, ctx RuleContext) (Decision, string)
+}
+
+// MaxAmountRule flags transactions above Limit
+type MaxAmountRule struct {
+	RuleID   string
+	Limit    Money
+	Decision Decision
+}
+
+func (r *MaxAmountRule) ID() string { return r.RuleID }
+
+func (r *MaxAmountRule) Evaluate(tx *Transaction, ctx RuleContext) (Decision, string) {
+	if cmp, err := tx.Amount.Cmp(r.Limit); err == nil && cmp > 0 {
+		return r.Decision, fmt.Sprintf("amount %s exceeds the %s limit", tx.Amount, r.Limit)
+	}
+	return DecisionAllow, ""
+}
+
+// VelocityRule flags accounts that send more than MaxAmount in total, or
+// more than MaxCount transactions, within Window. Zero limits are not checked.
+type VelocityRule struct {
+	RuleID    string
+	MaxAmount Money
+	MaxCount  int
+	Window    time.Duration // default 24h
+	Decision  Decision
+}
+
+func (r *VelocityRule) ID() string { return r.RuleID }
+
+func (r *VelocityRule) Evaluate(tx *Transaction, ctx RuleContext) (Decision, string) {
+	window := r.Window
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	cutoff := ctx.Now.Add(-window)
+	total, count := tx.Amount, 1
+	for _, past := range ctx.History {
+		if past.Timestamp.Before(cutoff) {
+			continue
+		}
+		count++
+		if past.Amount.Currency == tx.Amount.Currency {
+			if sum, err := total.Add(past.Amount); err == nil {
+				total = sum
+			}
+		}
+	}
+	if r.MaxCount > 0 && count > r.MaxCount {
+		return r.Decision, fmt.Sprintf("%d transactions within %s exceeds %d", count, window, r.MaxCount)
+	}
+	if r.MaxAmount.IsPositive() && r.MaxAmount.Currency == tx.Amount.Currency {
+		if cmp, _ := total.Cmp(r.MaxAmount); cmp > 0 {
+			return r.Decision, fmt.Sprintf("%s sent within %s exceeds %s", total, window, r.MaxAmount)
+		}
+	}
+	return DecisionAllow, ""
+}
+
+// BlockedCounterpartyRule flags transactions to or from listed accounts
+type BlockedCounterpartyRule struct {
+	RuleID   string
+	Accounts map[string]bool
+	Decision Decision
+}
+
+func (r *BlockedCounterpartyRule) ID() string { return r.RuleID }
+
+func (r *BlockedCounterpartyRule) Evaluate(tx *Transaction, ctx RuleContext) (Decision, string) {
+	for _, acct := range []string{tx.From, tx.To} {
+		if r.Accounts[acct] {
+			return r.Decision, fmt.Sprintf("counterparty %s is blocked", acct)
+		}
+	}
+	return DecisionAllow, ""
+}
+
+// UnusualAmountRule flags transactions more than Multiplier times the mean
+// of the account's earlier transactions, once it has MinHistory of them
+type UnusualAmountRule struct {
+	RuleID     string
+	Multiplier *big.Rat
+	MinHistory int
+	Decision   Decision
+}
+
+func (r *UnusualAmountRule) ID() string { return r.RuleID }
+
+func (r *UnusualAmountRule) Evaluate(tx *Transaction, ctx RuleContext) (Decision, string) {
+	sum, n := new(big.Rat), 0
+	for _, past := range ctx.History {
+		if past.Amount.Currency == tx.Amount.Currency {
+			sum.Add(sum, past.Amount.Rat())
+			n++
+		}
+	}
+	if n == 0 || n < r.MinHistory {
+		return DecisionAllow, ""
+	}
+	mean := sum.Quo(sum, big.NewRat(int64(n), 1))
+	if tx.Amount.Rat().Cmp(new(big.Rat).Mul(mean, r.Multiplier)) > 0 {
+		return r.Decision, fmt.Sprintf("amount %s is over %s times the average of %s",
+			tx.Amount, r.Multiplier.RatString(), mean.FloatString(2))
+	}
+	return DecisionAllow, ""
+}
+
+// RuleResult is the decision of a RulesEngine
+type RuleResult struct {
+	Decision Decision
+	RuleID   string // the rule that decided, empty on allow
+	Reason   string
+}
+
+// RulesEngine evaluates rules in order. The strictest decision wins, and
+// among equally strict ones the first rule.
+type RulesEngine struct {
+	rules []Rule
+}
+
+// NewRulesEngine creates an engine from rules
+func NewRulesEngine(rules ...Rule) *RulesEngine {
+	return &RulesEngine{rules: rules}
+}
+
+// Evaluate returns the combined decision for tx
+func (e *RulesEngine) Evaluate(tx *Transaction, ctx RuleContext) RuleResult {
+	result := RuleResult{Decision: DecisionAllow}
+	for _, rule := range e.rules {
+		decision, reason := rule.Evaluate(tx, ctx)
+		if decision.severity() > result.Decision.severity() {
+			result = RuleResult{Decision: decision, RuleID: rule.ID(), Reason: reason}
+		}
+	}
+	return result
+}
+
+// ruleConfig is one rule in a rules file
+type ruleConfig struct {
+	ID         string   `json:"id"`
+	Type       string   `json:"type"`
+	Decision   Decision `json:"decision"`
+	Amount     string   `json:"amount"`
+	Currency   string   `json:"currency"`
+	Count      int      `json:"count"`
+	Window     string   `json:"window"`
+	Accounts   []string `json:"accounts"`
+	Multiplier string   `json:"multiplier"`
+	MinHistory int      `json:"min_history"`
+}
+
+// ParseRules builds an engine from a JSON rules file of the form
+//
+//	{"rules": [{"id": "max-single", "type": "max_amount", "decision": "deny",
+//	            "amount": "10000.00", "currency": "USD"}, ...]}
+//
+// Types are max_amount, daily_velocity (amount and/or count, optional window
+// such as "24h"), blocked_counterparty (accounts) and unusual_amount
+// (multiplier, min_history).
+func ParseRules(data []byte) (*RulesEngine, error) {
+	var file struct {
+		Rules []ruleConfig `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode rules: %w", err)
+	}
+	engine := &RulesEngine{}
+	seen := make(map[string]bool)
+	for i, c := range file.Rules {
+		rule, err := c.build()
+		if err == nil && seen[c.ID] {
+			err = fmt.Errorf("duplicate rule id %q", c.ID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		seen[c.ID] = true
+		engine.rules = append(engine.rules, rule)
+	}
+	return engine, nil
+}
+
+// LoadRules reads a rules file; see ParseRules for the format
+func LoadRules(path string) (*RulesEngine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	return ParseRules(data)
+}
+
+func (c ruleConfig) build() (Rule, error) {
+	if c.ID == "" {
+		return nil, errors.New("missing id")
+	}
+	if c.Decision != DecisionDeny && c.Decision != DecisionReview {
+		return nil, fmt.Errorf("decision must be deny or review, got %q", c.Decision)
+	}
+	var amount Money
+	if c.Amount != "" {
+		var err error
+		if amount, err = ParseMoney(c.Amount, c.Currency); err != nil {
+			return nil, err
+		}
+	}
+	switch c.Type {
+	case "max_amount":
+		if !amount.IsPositive() {
+			return nil, errors.New("max_amount needs a positive amount")
+		}
+		return &MaxAmountRule{RuleID: c.ID, Limit: amount, Decision: c.Decision}, nil
+	case "daily_velocity":
+		if !amount.IsPositive() && c.Count <= 0 {
+			return nil, errors.New("daily_velocity needs an amount or a count")
+		}
+		var window time.Duration
+		if c.Window != "" {
+			var err error
+			if window, err = time.ParseDuration(c.Window); err != nil {
+				return nil, err
+			}
+		}
+		return &VelocityRule{RuleID: c.ID, MaxAmount: amount, MaxCount: c.Count, Window: window, Decision: c.Decision}, nil
+	case "blocked_counterparty":
+		accounts := make(map[string]bool, len(c.Accounts))
+		for _, a := range c.Accounts {
+			accounts[a] = true
+		}
+		return &BlockedCounterpartyRule{RuleID: c.ID, Accounts: accounts, Decision: c.Decision}, nil
+	case "unusual_amount":
+		multiplier, ok := new(big.Rat).SetString(c.Multiplier)
+		if !ok || multiplier.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid multiplier %q", c.Multiplier)
+		}
+		return &UnusualAmountRule{RuleID: c.ID, Multiplier: multiplier, MinHistory: c.MinHistory, Decision: c.Decision}, nil
+	}
+	return nil, fmt.Errorf("unknown rule type %q", c.Type)
+}
+
+// SetRulesEngine checks every new transaction against e before holding
+// funds. Nil removes the checks.
+func (p *PaymentProcessor) SetRulesEngine(e *RulesEngine) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = e
+}
+
+// checkRules evaluates the rules engine, if any, against tx. Concurrent
+// transactions from one account may each pass a velocity limit they
+// exceed together.
+func (p *PaymentProcessor) checkRules(tx *Transaction) (RuleResult, error) {
+	p.mu.RLock()
+	engine := p.rules
+	states := make([]*txState, 0)
+	if engine != nil {
+		for _, s := range p.transactions {
+			if s.from.id == tx.From {
+				states = append(states, s)
+			}
+		}
+	}
+	p.mu.RUnlock()
+	if engine == nil {
+		return RuleResult{Decision: DecisionAllow}, nil
+	}
+
+	ctx := RuleContext{Now: p.now()}
+	for _, s := range states {
+		s.mu.Lock()
+		past := *s.tx
+		s.mu.Unlock()
+		if past.Status != StatusFailed && past.Status != StatusCancelled {
+			ctx.History = append(ctx.History, past)
+		}
+	}
+	result := engine.Evaluate(tx, ctx)
+	if result.Decision == DecisionDeny {
+		err := newTransactionError(tx, fmt.Errorf("%w: %s", ErrTransactionDenied, result.Reason), "rule check failed")
+		err.RuleID = result.RuleID
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRules = `{"rules": [
+	{"id": "max-single", "type": "max_amount", "decision": "deny", "amount": "1000.00", "currency": "USD"},
+	{"id": "daily", "type": "daily_velocity", "decision": "review", "amount": "150.00", "currency": "USD", "count": 5},
+	{"id": "sanctions", "type": "blocked_counterparty", "decision": "deny", "accounts": ["mallory"]},
+	{"id": "unusual", "type": "unusual_amount", "decision": "review", "multiplier": "3", "min_history": 2}
+]}`
+
+func newRulesProcessor(t *testing.T) (*PaymentProcessor, *time.Time) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(testRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	p := NewPaymentProcessor()
+	p.now = func() time.Time { return now }
+	p.SetRulesEngine(engine)
+	openAccounts(t, p, "USD", "a", "b", "mallory")
+	if err := p.Deposit("a", MustParseMoney("5000.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	return p, &now
+}
+
+func TestRulesDeny(t *testing.T) {
+	p, _ := newRulesProcessor(t)
+	tests := []struct {
+		tx   *Transaction
+		rule string
+	}{
+		{&Transaction{ID: "big", Amount: MustParseMoney("1000.01", "USD"), From: "a", To: "b"}, "max-single"},
+		{&Transaction{ID: "blocked", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "mallory"}, "sanctions"},
+	}
+	for _, tt := range tests {
+		err := p.ProcessTransaction(tt.tx)
+		var txErr *TransactionError
+		if !errors.As(err, &txErr) || !errors.Is(err, ErrTransactionDenied) || txErr.RuleID != tt.rule {
+			t.Errorf("%s: expected denial by %s, got %v", tt.tx.ID, tt.rule, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), "rule: "+tt.rule) || txErr.Code() != "PAY_TRANSACTION_DENIED" {
+			t.Errorf("%s: expected the rule in the message and code, got %v (%s)", tt.tx.ID, err, txErr.Code())
+		}
+	}
+	if balance, _ := p.GetBalance("a"); balance != MustParseMoney("5000.00", "USD") {
+		t.Errorf("Denied transactions must not move money, got %s", balance)
+	}
+}
+
+func TestRulesReviewHoldsFunds(t *testing.T) {
+	p, now := newRulesProcessor(t)
+	for _, id := range []string{"t1", "t2"} {
+		if err := p.ProcessTransaction(&Transaction{ID: id, Amount: MustParseMoney("20.00", "USD"), From: "a", To: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 100.00 is over three times the 20.00 average
+	tx := &Transaction{ID: "t3", Amount: MustParseMoney("100.00", "USD"), From: "a", To: "b"}
+	err := p.ProcessTransaction(tx)
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || !errors.Is(err, ErrReviewRequired) || txErr.RuleID != "unusual" {
+		t.Fatalf("Expected review by unusual, got %v", err)
+	}
+	if tx.Status != StatusAuthorized || tx.ReviewRule != "unusual" {
+		t.Errorf("Expected an authorized transaction awaiting review, got %q %q", tx.Status, tx.ReviewRule)
+	}
+	if err := p.Capture("t3"); err != nil {
+		t.Fatalf("Approving the review failed: %v", err)
+	}
+
+	// 140.00 sent today; another 20.00 crosses the 150.00 daily limit
+	err = p.ProcessTransaction(&Transaction{ID: "t4", Amount: MustParseMoney("20.00", "USD"), From: "a", To: "b"})
+	if !errors.As(err, &txErr) || txErr.RuleID != "daily" {
+		t.Errorf("Expected review by daily, got %v", err)
+	}
+	p.Void("t4")
+
+	*now = now.Add(25 * time.Hour)
+	if err := p.ProcessTransaction(&Transaction{ID: "t5", Amount: MustParseMoney("20.00", "USD"), From: "a", To: "b"}); err != nil {
+		t.Errorf("Expected the velocity window to have passed, got %v", err)
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"rules": [{"type": "max_amount", "decision": "deny", "amount": "1", "currency": "USD"}]}`:                                                     "missing id",
+		`{"rules": [{"id": "x", "type": "max_amount", "decision": "allow", "amount": "1", "currency": "USD"}]}`:                                         "decision",
+		`{"rules": [{"id": "x", "type": "teleport", "decision": "deny"}]}`:                                                                              "unknown rule type",
+		`{"rules": [{"id": "x", "type": "unusual_amount", "decision": "deny", "multiplier": "-1"}]}`:                                                    "multiplier",
+		`{"rules": [{"id": "x", "type": "daily_velocity", "decision": "deny", "window": "1d", "count": 1}]}`:                                            "duration",
+		`{"rules": [{"id": "x", "type": "blocked_counterparty", "decision": "deny"}, {"id": "x", "type": "blocked_counterparty", "decision": "deny"}]}`: "duplicate",
+	}
+	for config, want := range tests {
+		if _, err := ParseRules([]byte(config)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error mentioning %q, got %v", want, err)
+		}
+	}
+}
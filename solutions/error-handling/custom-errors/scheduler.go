@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduler errors
+var (
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+	ErrScheduleExists   = errors.New("schedule already exists")
+	ErrScheduleNotFound = errors.New("schedule not found")
+)
+
+// ScheduleError reports a failed scheduler operation
+type ScheduleError struct {
+	ScheduleID string
+	Err        error
+}
+
+func (e *ScheduleError) Error() string {
+	return fmt.Sprintf("schedule %s: %v", e.ScheduleID, e.Err)
+}
+
+func (e *ScheduleError) Unwrap() error {
+	return e.Err
+}
+
+// Frequency is how often a scheduled transfer repeats
+type Frequency string
+
+const (
+	Once    Frequency = "once"
+	Daily   Frequency = "daily"
+	Weekly  Frequency = "weekly"
+	Monthly Frequency = "monthly"
+)
+
+// Recurrence describes when a scheduled transfer runs after its start.
+// The zero value runs once.
+type Recurrence struct {
+	Frequency Frequency
+	// Interval repeats every N days, weeks or months (default 1)
+	Interval int
+	// DayOfMonth is the day monthly transfers run on (default the start's
+	// day). Months without that day run on their last day.
+	DayOfMonth int
+	// Until, if set, is the time after which no more transfers run
+	Until time.Time
+}
+
+// occurrence returns the time of the nth run, counting from zero, or false
+// if there is none
+func (r Recurrence) occurrence(start time.Time, n int) (time.Time, bool) {
+	interval := max(r.Interval, 1)
+	var at time.Time
+	switch r.Frequency {
+	case Daily:
+		at = start.AddDate(0, 0, n*interval)
+	case Weekly:
+		at = start.AddDate(0, 0, 7*n*interval)
+	case Monthly:
+		// Count months from the start so short months do not shift later
+		// runs, beginning with the first matching day on or after the start
+		offset := 0
+		if r.monthDay(start, 0).Before(start) {
+			offset = 1
+		}
+		at = r.monthDay(start, offset+n*interval)
+	default:
+		if n > 0 {
+			return time.Time{}, false
+		}
+		at = start
+	}
+	if !r.Until.IsZero() && at.After(r.Until) {
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// monthDay returns the run day in the month months after start's, at
+// start's time of day
+func (r Recurrence) monthDay(start time.Time, months int) time.Time {
+	day := r.DayOfMonth
+	if day == 0 {
+		day = start.Day()
+	}
+	first := time.Date(start.Year(), start.Month()+time.Month(months), 1,
+		start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(day, last)-1)
+}
+
+// validate records every problem with the recurrence in v
+func (r Recurrence) validate(start time.Time, v *ValidationError) {
+	switch r.Frequency {
+	case "", Once, Daily, Weekly, Monthly:
+	default:
+		v.add("recurrence.frequency", ErrInvalidSchedule)
+	}
+	if r.Interval < 0 {
+		v.add("recurrence.interval", ErrInvalidSchedule)
+	}
+	if r.DayOfMonth < 0 || r.DayOfMonth > 31 || (r.DayOfMonth != 0 && r.Frequency != Monthly) {
+		v.add("recurrence.day_of_month", ErrInvalidSchedule)
+	}
+	if !r.Until.IsZero() && r.Until.Before(start) {
+		v.add("recurrence.until", ErrInvalidSchedule)
+	}
+}
+
+// ScheduleStatus is the state of a scheduled transfer
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	ScheduleCompleted ScheduleStatus = "completed"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+)
+
+// Run is the outcome of one attempt at a scheduled transfer
+type Run struct {
+	// Occurrence is when the transfer was due; retries share it
+	Occurrence time.Time
+	Attempt    int
+	TxID       string
+	At         time.Time
+	Status     TransactionStatus
+	Err        error
+	// RetryAt is when the failed transfer will be tried again, if it will
+	RetryAt time.Time
+}
+
+// ScheduledTransfer describes a transfer and its runs so far
+type ScheduledTransfer struct {
+	ID string
+	// Transaction is the template of each run. Only Amount, From and To are used.
+	Transaction Transaction
+	Start       time.Time
+	Recurrence  Recurrence
+	Status      ScheduleStatus
+	// NextRun is when the transfer will next run, zero if it will not
+	NextRun time.Time
+	// Runs are the latest runs, oldest first, up to SchedulerOptions.MaxRuns
+	Runs []Run
+}
+
+// RunRetryPolicy decides whether a failed run is tried again before the
+// transfer moves on to its next occurrence
+type RunRetryPolicy struct {
+	// MaxRetries is how many times a failed run is retried; zero disables retries
+	MaxRetries int
+	// Delay is the wait before the first retry, doubling after each one (default 5m)
+	Delay time.Duration
+	// MaxDelay caps the wait before any retry (default 24h)
+	MaxDelay time.Duration
+	// Retryable picks the failures worth retrying (default IsRetryableRun)
+	Retryable func(error) bool
+}
+
+// delay returns the wait before the given retry, counting from one
+func (rp RunRetryPolicy) delay(retry int) time.Duration {
+	d := rp.Delay
+	for i := 1; i < retry; i++ {
+		if d >= rp.MaxDelay/2 {
+			return rp.MaxDelay
+		}
+		d *= 2
+	}
+	return min(d, rp.MaxDelay)
+}
+
+// retryableRunErrors are failures that may clear up later, such as a
+// deposit arriving or the payment network recovering
+var retryableRunErrors = []error{ErrInsufficientFunds, ErrAccountFrozen, ErrCircuitOpen, ErrNetworkError}
+
+// IsRetryableRun reports whether a failed scheduled run may succeed later
+func IsRetryableRun(err error) bool {
+	if IsTransient(err) {
+		return true
+	}
+	for _, target := range retryableRunErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// SchedulerOptions configures a Scheduler
+type SchedulerOptions struct {
+	// Clock decides when transfers are due (default the system clock)
+	Clock Clock
+	Retry RunRetryPolicy
+	// MaxRuns is how many of its latest runs each schedule keeps (default 100)
+	MaxRuns int
+}
+
+// schedule is the scheduler's own record of a transfer
+type schedule struct {
+	ScheduledTransfer
+	n       int       // index of the current occurrence
+	attempt int       // attempts made at the current occurrence
+	retryAt time.Time // set while a failed run waits to be retried
+	seq     int       // runs started, used to name transactions
+}
+
+// due returns when the schedule next runs and the occurrence it runs for
+func (s *schedule) due() (at, occurrence time.Time, ok bool) {
+	if s.Status != ScheduleActive {
+		return time.Time{}, time.Time{}, false
+	}
+	occurrence, ok = s.Recurrence.occurrence(s.Start, s.n)
+	if !s.retryAt.IsZero() {
+		return s.retryAt, occurrence, ok
+	}
+	return occurrence, occurrence, ok
+}
+
+// Scheduler runs transfers at set times through a PaymentProcessor. Call
+// RunDue periodically, or Run to do so in the background. Schedules are kept
+// in memory only. It is safe for concurrent use.
+type Scheduler struct {
+	processor *PaymentProcessor
+	clock     Clock
+	retry     RunRetryPolicy
+	maxRuns   int
+
+	running   sync.Mutex // held by RunDue so no run starts twice
+	mu        sync.Mutex
+	schedules map[string]*schedule
+	nextID    int
+}
+
+// NewScheduler creates a scheduler for p
+func NewScheduler(p *PaymentProcessor, opts SchedulerOptions) *Scheduler {
+	if opts.Clock == nil {
+		opts.Clock = ClockFunc(time.Now)
+	}
+	if opts.Retry.Delay <= 0 {
+		opts.Retry.Delay = 5 * time.Minute
+	}
+	if opts.Retry.MaxDelay <= 0 {
+		opts.Retry.MaxDelay = 24 * time.Hour
+	}
+	if opts.Retry.Retryable == nil {
+		opts.Retry.Retryable = IsRetryableRun
+	}
+	if opts.MaxRuns <= 0 {
+		opts.MaxRuns = 100
+	}
+	return &Scheduler{processor: p, clock: opts.Clock, retry: opts.Retry, maxRuns: opts.MaxRuns, schedules: make(map[string]*schedule)}
+}
+
+// Schedule adds a transfer of tx's Amount from From to To, first at start
+// (or now, if zero) and then as rec says. An empty id is generated. Every
+// invalid field is reported at once in a *ValidationError.
+func (s *Scheduler) Schedule(id string, tx Transaction, start time.Time, rec Recurrence) (*ScheduledTransfer, error) {
+	if start.IsZero() {
+		start = s.clock.Now()
+	}
+	v := &ValidationError{}
+	errors.As(tx.Validate(), &v)
+	rec.validate(start, v)
+	if _, ok := rec.occurrence(start, 0); len(v.Errors) == 0 && !ok {
+		v.add("recurrence.until", ErrInvalidSchedule)
+	}
+	if err := v.errOrNil(); err != nil {
+		return nil, &ScheduleError{ScheduleID: id, Err: err}
+	}
+	if rec.Frequency == "" {
+		rec.Frequency = Once
+	}
+	template := Transaction{Amount: tx.Amount, From: tx.From, To: tx.To}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id == "" {
+		for id == "" || s.schedules[id] != nil {
+			s.nextID++
+			id = fmt.Sprintf("sched-%d", s.nextID)
+		}
+	}
+	if _, exists := s.schedules[id]; exists {
+		return nil, &ScheduleError{ScheduleID: id, Err: ErrScheduleExists}
+	}
+	sched := &schedule{ScheduledTransfer: ScheduledTransfer{
+		ID:          id,
+		Transaction: template,
+		Start:       start,
+		Recurrence:  rec,
+		Status:      ScheduleActive,
+	}}
+	s.schedules[id] = sched
+	return sched.snapshot(), nil
+}
+
+// snapshot copies the schedule. The caller must hold the scheduler's lock.
+func (s *schedule) snapshot() *ScheduledTransfer {
+	t := s.ScheduledTransfer
+	t.Runs = append([]Run(nil), s.Runs...)
+	if at, _, ok := s.due(); ok {
+		t.NextRun = at
+	}
+	return &t
+}
+
+// Get returns a scheduled transfer with its runs
+func (s *Scheduler) Get(id string) (*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sched, exists := s.schedules[id]
+	if !exists {
+		return nil, &ScheduleError{ScheduleID: id, Err: ErrScheduleNotFound}
+	}
+	return sched.snapshot(), nil
+}
+
+// List returns every scheduled transfer, including finished ones, by ID
+func (s *Scheduler) List() []*ScheduledTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*ScheduledTransfer, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		list = append(list, sched.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Cancel stops a transfer from running again, including pending retries. A
+// run already in progress completes. Cancelling a finished transfer has no
+// effect.
+func (s *Scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sched, exists := s.schedules[id]
+	if !exists {
+		return &ScheduleError{ScheduleID: id, Err: ErrScheduleNotFound}
+	}
+	if sched.Status == ScheduleActive {
+		sched.Status = ScheduleCancelled
+		sched.retryAt = time.Time{}
+	}
+	return nil
+}
+
+// nextDue returns the active schedule that has been due the longest, if any.
+// The caller must hold s.mu.
+func (s *Scheduler) nextDue(now time.Time) *schedule {
+	var next *schedule
+	var nextAt time.Time
+	for _, sched := range s.schedules {
+		at, _, ok := sched.due()
+		if !ok || at.After(now) {
+			continue
+		}
+		if next == nil || at.Before(nextAt) || (at.Equal(nextAt) && sched.ID < next.ID) {
+			next, nextAt = sched, at
+		}
+	}
+	return next
+}
+
+// RunDue executes every transfer that is due, oldest first, and returns
+// the runs. Occurrences missed while nothing called RunDue are run in turn,
+// so no payment is skipped. It stops early if ctx is done.
+func (s *Scheduler) RunDue(ctx context.Context) []Run {
+	s.running.Lock()
+	defer s.running.Unlock()
+	var runs []Run
+	for ctx.Err() == nil {
+		now := s.clock.Now()
+		s.mu.Lock()
+		sched := s.nextDue(now)
+		if sched == nil {
+			s.mu.Unlock()
+			break
+		}
+		_, occurrence, _ := sched.due()
+		sched.seq++
+		tx := &Transaction{
+			ID:        fmt.Sprintf("%s-%d", sched.ID, sched.seq),
+			Amount:    sched.Transaction.Amount,
+			From:      sched.Transaction.From,
+			To:        sched.Transaction.To,
+			Timestamp: now,
+		}
+		s.mu.Unlock()
+
+		err := s.processor.ProcessTransactionContext(ctx, tx)
+
+		s.mu.Lock()
+		sched.attempt++
+		run := Run{Occurrence: occurrence, Attempt: sched.attempt, TxID: tx.ID, At: now, Status: tx.Status, Err: err}
+		if err != nil && sched.Status == ScheduleActive && sched.attempt <= s.retry.MaxRetries && s.retry.Retryable(err) {
+			sched.retryAt = now.Add(s.retry.delay(sched.attempt))
+			run.RetryAt = sched.retryAt
+		} else {
+			sched.n, sched.attempt, sched.retryAt = sched.n+1, 0, time.Time{}
+			if _, _, ok := sched.due(); !ok && sched.Status == ScheduleActive {
+				sched.Status = ScheduleCompleted
+			}
+		}
+		sched.Runs = append(sched.Runs, run)
+		if len(sched.Runs) > s.maxRuns {
+			// Copy so the dropped runs do not pin a growing array
+			sched.Runs = append([]Run(nil), sched.Runs[len(sched.Runs)-s.maxRuns:]...)
+		}
+		s.mu.Unlock()
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Run calls RunDue every interval until ctx is done
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.RunDue(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduledMonthlyCatchesUp(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)}
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "tenant", "landlord")
+	if err := p.Deposit("tenant", MustParseMoney("1000.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	s := NewScheduler(p, SchedulerOptions{Clock: clock})
+
+	rent := Transaction{Amount: MustParseMoney("100.00", "USD"), From: "tenant", To: "landlord"}
+	until := time.Date(2024, 4, 30, 23, 0, 0, 0, time.UTC)
+	sched, err := s.Schedule("rent", rent, time.Time{}, Recurrence{Frequency: Monthly, DayOfMonth: 31, Until: until})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC); !sched.NextRun.Equal(want) {
+		t.Errorf("Expected the first run on %s, got %s", want, sched.NextRun)
+	}
+	if runs := s.RunDue(context.Background()); len(runs) != 0 {
+		t.Errorf("Nothing should be due yet, got %v", runs)
+	}
+
+	// Missed months are paid in order, on the last day of short months
+	clock.Advance(120 * 24 * time.Hour)
+	runs := s.RunDue(context.Background())
+	wantDays := []string{"2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30"}
+	if len(runs) != len(wantDays) {
+		t.Fatalf("Expected %d runs, got %+v", len(wantDays), runs)
+	}
+	for i, run := range runs {
+		if day := run.Occurrence.Format(time.DateOnly); day != wantDays[i] || run.Err != nil || run.Status != StatusCaptured {
+			t.Errorf("Run %d: expected a capture on %s, got %+v", i, wantDays[i], run)
+		}
+	}
+	if balance, _ := p.GetBalance("landlord"); balance != MustParseMoney("400.00", "USD") {
+		t.Errorf("Expected 400.00 paid, got %s", balance)
+	}
+	if sched, _ := s.Get("rent"); sched.Status != ScheduleCompleted || !sched.NextRun.IsZero() || len(sched.Runs) != 4 {
+		t.Errorf("Expected a completed schedule with 4 runs, got %+v", sched)
+	}
+}
+
+func TestScheduledRunRetries(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)}
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "payer", "payee")
+	s := NewScheduler(p, SchedulerOptions{Clock: clock, Retry: RunRetryPolicy{MaxRetries: 2, Delay: time.Hour}})
+	pay := Transaction{Amount: MustParseMoney("5.00", "USD"), From: "payer", To: "payee"}
+	if _, err := s.Schedule("daily", pay, time.Time{}, Recurrence{Frequency: Daily}); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := s.RunDue(context.Background())
+	if len(runs) != 1 || !errors.Is(runs[0].Err, ErrInsufficientFunds) || !runs[0].RetryAt.Equal(clock.now.Add(time.Hour)) {
+		t.Fatalf("Expected a failed run retried in an hour, got %+v", runs)
+	}
+	clock.Advance(time.Hour)
+	if runs := s.RunDue(context.Background()); len(runs) != 1 || !runs[0].RetryAt.Equal(clock.now.Add(2*time.Hour)) {
+		t.Fatalf("Expected the retry delay to double, got %+v", runs)
+	}
+	if err := p.Deposit("payer", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	runs = s.RunDue(context.Background())
+	if len(runs) != 1 || runs[0].Err != nil || runs[0].Attempt != 3 || runs[0].TxID != "daily-3" {
+		t.Fatalf("Expected the third attempt to succeed, got %+v", runs)
+	}
+
+	// Retries are used up on the next day's occurrence, which then moves on
+	if err := p.FreezeAccount("payer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, wait := range []time.Duration{21 * time.Hour, time.Hour, 2 * time.Hour} {
+		clock.Advance(wait)
+		if runs := s.RunDue(context.Background()); len(runs) != 1 {
+			t.Fatalf("Expected one run, got %+v", runs)
+		}
+	}
+	sched, _ := s.Get("daily")
+	last := sched.Runs[len(sched.Runs)-1]
+	if !errors.Is(last.Err, ErrAccountFrozen) || !last.RetryAt.IsZero() || last.Attempt != 3 {
+		t.Errorf("Expected the last retry to give up, got %+v", last)
+	}
+	if want := time.Date(2024, 1, 3, 8, 0, 0, 0, time.UTC); !sched.NextRun.Equal(want) {
+		t.Errorf("Expected the next occurrence on %s, got %s", want, sched.NextRun)
+	}
+
+	if err := s.Cancel("daily"); err != nil {
+		t.Fatal(err)
+	}
+	if runs := s.RunDue(context.Background()); len(runs) != 0 {
+		t.Errorf("A cancelled schedule should not run, got %+v", runs)
+	}
+	if list := s.List(); len(list) != 1 || list[0].Status != ScheduleCancelled {
+		t.Errorf("Expected the cancelled schedule to be listed, got %+v", list)
+	}
+}
+
+func TestScheduledRunLimits(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)}
+	p := NewPaymentProcessor()
+	openAccounts(t, p, "USD", "payer", "payee")
+	s := NewScheduler(p, SchedulerOptions{Clock: clock, MaxRuns: 3, Retry: RunRetryPolicy{MaxRetries: 1000, Delay: time.Hour, MaxDelay: 6 * time.Hour}})
+	if _, err := s.Schedule("stuck", Transaction{Amount: MustParseMoney("1.00", "USD"), From: "payer", To: "payee"}, clock.now, Recurrence{Frequency: Daily}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The doubling delay stops at MaxDelay instead of overflowing
+	var last Run
+	for i := 0; i < 100; i++ {
+		runs := s.RunDue(context.Background())
+		if len(runs) != 1 {
+			t.Fatalf("Expected one run, got %+v", runs)
+		}
+		last = runs[0]
+		clock.Advance(last.RetryAt.Sub(clock.now))
+	}
+	if wait := last.RetryAt.Sub(last.At); wait != 6*time.Hour {
+		t.Errorf("Expected the delay to be capped at 6h, got %s", wait)
+	}
+	sched, _ := s.Get("stuck")
+	if len(sched.Runs) != 3 || sched.Runs[2].Attempt != 100 || sched.Runs[0].Attempt != 98 {
+		t.Errorf("Expected the last 3 runs to be kept, got %+v", sched.Runs)
+	}
+
+	if d := (RunRetryPolicy{Delay: time.Hour, MaxDelay: time.Duration(1<<63 - 1)}).delay(200); d != time.Duration(1<<63-1) {
+		t.Errorf("Expected a huge retry count to reach MaxDelay, got %s", d)
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	s := NewScheduler(NewPaymentProcessor(), SchedulerOptions{})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := s.Schedule("bad", Transaction{Amount: MustParseMoney("1.00", "USD")}, start,
+		Recurrence{Frequency: Weekly, Interval: -1, DayOfMonth: 3, Until: start.Add(-time.Hour)})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || !errors.Is(err, ErrInvalidSchedule) || len(validationErr.Errors) != 5 {
+		t.Errorf("Expected 5 field errors, got %v", err)
+	}
+
+	if _, err := s.Schedule("", Transaction{Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}, start, Recurrence{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule("sched-1", Transaction{Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}, start, Recurrence{}); !errors.Is(err, ErrScheduleExists) {
+		t.Errorf("Expected ErrScheduleExists, got %v", err)
+	}
+	if err := s.Cancel("missing"); !errors.Is(err, ErrScheduleNotFound) {
+		t.Errorf("Expected ErrScheduleNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ErrInvalidQuery is the cause of every field error in a bad TransactionQuery
+var ErrInvalidQuery = errors.New("invalid query")
+
+// SortField is what SearchTransactions orders results by
+type SortField string
+
+const (
+	SortByTimestamp SortField = "timestamp"
+	// SortByAmount orders by currency, then amount
+	SortByAmount SortField = "amount"
+	SortByID     SortField = "id"
+)
+
+// Query limits
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 1000
+)
+
+// TransactionQuery selects transactions. Zero fields match everything.
+type TransactionQuery struct {
+	// Account matches transactions to or from the account
+	Account string
+	// Since and Until bound the timestamp to [Since, Until)
+	Since    time.Time
+	Until    time.Time
+	Statuses []TransactionStatus
+	Currency string
+	// MinAmount and MaxAmount bound the amount, inclusive. A bound is set
+	// when it has a currency, and then only matches that currency.
+	MinAmount Money
+	MaxAmount Money
+
+	SortBy     SortField // default SortByTimestamp; ties are ordered by ID
+	Descending bool
+	Offset     int
+	Limit      int // default DefaultQueryLimit, at most MaxQueryLimit
+}
+
+// validate reports every invalid field at once
+func (q TransactionQuery) validate() error {
+	v := &ValidationError{}
+	if !q.Since.IsZero() && !q.Until.IsZero() && q.Until.Before(q.Since) {
+		v.add("until", ErrInvalidQuery)
+	}
+	if q.Currency != "" {
+		if _, err := MinorUnits(q.Currency); err != nil {
+			v.add("currency", ErrUnsupportedCurrency)
+		}
+	}
+	for _, bound := range []struct {
+		field string
+		m     Money
+	}{{"min_amount", q.MinAmount}, {"max_amount", q.MaxAmount}} {
+		if bound.m.Currency != "" && q.Currency != "" && bound.m.Currency != q.Currency {
+			v.add(bound.field, ErrCurrencyMismatch)
+		}
+	}
+	if q.MinAmount.Currency != "" && q.MaxAmount.Currency != "" {
+		if cmp, err := q.MinAmount.Cmp(q.MaxAmount); err != nil {
+			v.add("max_amount", ErrCurrencyMismatch)
+		} else if cmp > 0 {
+			v.add("max_amount", ErrInvalidQuery)
+		}
+	}
+	switch q.SortBy {
+	case "", SortByTimestamp, SortByAmount, SortByID:
+	default:
+		v.add("sort_by", ErrInvalidQuery)
+	}
+	if q.Offset < 0 {
+		v.add("offset", ErrInvalidQuery)
+	}
+	if q.Limit < 0 || q.Limit > MaxQueryLimit {
+		v.add("limit", ErrInvalidQuery)
+	}
+	return v.errOrNil()
+}
+
+// matches reports whether tx satisfies the filters of q
+func (q TransactionQuery) matches(tx *Transaction) bool {
+	if q.Account != "" && tx.From != q.Account && tx.To != q.Account {
+		return false
+	}
+	if !q.Since.IsZero() && tx.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !tx.Timestamp.Before(q.Until) {
+		return false
+	}
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, s := range q.Statuses {
+			found = found || tx.Status == s
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Currency != "" && tx.Amount.Currency != q.Currency {
+		return false
+	}
+	if q.MinAmount.Currency != "" {
+		if cmp, err := tx.Amount.Cmp(q.MinAmount); err != nil || cmp < 0 {
+			return false
+		}
+	}
+	if q.MaxAmount.Currency != "" {
+		if cmp, err := tx.Amount.Cmp(q.MaxAmount); err != nil || cmp > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// less orders a before b as q asks
+func (q TransactionQuery) less(a, b *Transaction) bool {
+	if q.Descending {
+		a, b = b, a
+	}
+	switch q.SortBy {
+	case SortByAmount:
+		if a.Amount.Currency != b.Amount.Currency {
+			return a.Amount.Currency < b.Amount.Currency
+		}
+		if a.Amount.Amount != b.Amount.Amount {
+			return a.Amount.Amount < b.Amount.Amount
+		}
+	case SortByID:
+	default:
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+	}
+	return a.ID < b.ID
+}
+
+// TransactionPage is one page of search results
+type TransactionPage struct {
+	Transactions []Transaction
+	// Total is the number of matches across all pages
+	Total int
+	// NextOffset is the Offset of the next page, or zero on the last page
+	NextOffset int
+}
+
+// SearchTransactions returns the page of transactions matching q. An invalid
+// query fails with a *ValidationError listing every bad field.
+func (p *PaymentProcessor) SearchTransactions(q TransactionQuery) (*TransactionPage, error) {
+	if err := q.validate(); err != nil {
+		return nil, p.observe(&TransactionError{Err: err, From: q.Account, Context: "transaction search failed"})
+	}
+	matches := p.findTransactions(q)
+	limit := q.Limit
+	if limit == 0 {
+		limit = DefaultQueryLimit
+	}
+	page := &TransactionPage{Total: len(matches), Transactions: []Transaction{}}
+	if q.Offset < len(matches) {
+		end := min(q.Offset+limit, len(matches))
+		page.Transactions = matches[q.Offset:end]
+		if end < len(matches) {
+			page.NextOffset = end
+		}
+	}
+	return page, nil
+}
+
+// findTransactions returns snapshots of every transaction matching q, sorted
+func (p *PaymentProcessor) findTransactions(q TransactionQuery) []Transaction {
+	p.mu.RLock()
+	states := make([]*txState, 0, len(p.transactions))
+	for _, s := range p.transactions {
+		states = append(states, s)
+	}
+	p.mu.RUnlock()
+
+	var matches []Transaction
+	for _, s := range states {
+		s.mu.Lock()
+		tx := *s.tx
+		s.mu.Unlock()
+		if q.matches(&tx) {
+			matches = append(matches, tx)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return q.less(&matches[i], &matches[j]) })
+	return matches
+}
+
+// ExportFormat is a file format for ExportTransactions
+type ExportFormat string
+
+const (
+	ExportCSV  ExportFormat = "csv"
+	ExportJSON ExportFormat = "json"
+)
+
+// ExportTransactions writes every transaction matching q, ignoring its
+// Offset and Limit, to w
+func (p *PaymentProcessor) ExportTransactions(w io.Writer, q TransactionQuery, format ExportFormat) error {
+	return p.observe(p.exportTransactions(w, q, format))
+}
+
+func (p *PaymentProcessor) exportTransactions(w io.Writer, q TransactionQuery, format ExportFormat) error {
+	q.Offset, q.Limit = 0, 0
+	err := q.validate()
+	if err == nil && format != ExportCSV && format != ExportJSON {
+		err = &ValidationError{Errors: []*FieldError{{Field: "format", Err: ErrInvalidQuery}}}
+	}
+	if err != nil {
+		return &TransactionError{Err: err, From: q.Account, Context: "transaction export failed"}
+	}
+	txs := p.findTransactions(q)
+	if format == ExportJSON {
+		err = WriteTransactionsJSON(w, txs)
+	} else {
+		err = WriteTransactionsCSV(w, txs)
+	}
+	if err != nil {
+		return &TransactionError{Err: err, From: q.Account, Context: "transaction export failed"}
+	}
+	return nil
+}
+
+// csvHeader names the columns written by WriteTransactionsCSV
+var csvHeader = []string{
+	"id", "timestamp", "status", "amount", "currency", "from", "to", "refunded",
+	"debited", "debited_currency", "credited", "credited_currency", "fee", "rate", "review_rule",
+}
+
+// WriteTransactionsCSV writes txs as CSV with a header row. Amounts are
+// decimal strings; conversion columns are empty for same-currency transactions.
+func WriteTransactionsCSV(w io.Writer, txs []Transaction) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		row := []string{
+			tx.ID,
+			tx.Timestamp.UTC().Format(time.RFC3339Nano),
+			string(tx.Status),
+			tx.Amount.Decimal(),
+			tx.Amount.Currency,
+			tx.From,
+			tx.To,
+			tx.Refunded.Decimal(),
+			"", "", "", "", "", "",
+			tx.ReviewRule,
+		}
+		if c := tx.Conversion; c != nil {
+			copy(row[8:14], []string{
+				c.Debited.Decimal(), c.Debited.Currency,
+				c.Credited.Decimal(), c.Credited.Currency,
+				c.Fee.Decimal(), c.Rate,
+			})
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadTransactionsCSV reads transactions written by WriteTransactionsCSV.
+// Conversion rate timestamps are not exported, so they read as zero.
+func ReadTransactionsCSV(r io.Reader) ([]Transaction, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transactions: %w", err)
+	}
+	if len(rows) == 0 || !slices.Equal(rows[0], csvHeader) {
+		return nil, errors.New("failed to read transactions: missing or unknown header")
+	}
+	txs := make([]Transaction, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		tx, err := parseTransactionRow(row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read transactions: line %d: %w", i+2, err)
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+// parseTransactionRow parses one row in the csvHeader layout
+func parseTransactionRow(row []string) (Transaction, error) {
+	tx := Transaction{ID: row[0], Status: TransactionStatus(row[2]), From: row[5], To: row[6], ReviewRule: row[14]}
+	var err error
+	if tx.Timestamp, err = time.Parse(time.RFC3339Nano, row[1]); err != nil {
+		return tx, err
+	}
+	if tx.Amount, err = ParseMoney(row[3], row[4]); err != nil {
+		return tx, err
+	}
+	if tx.Refunded, err = ParseMoney(row[7], row[4]); err != nil {
+		return tx, err
+	}
+	if row[8] == "" {
+		return tx, nil
+	}
+	c := &Conversion{Rate: row[13]}
+	if c.Debited, err = ParseMoney(row[8], row[9]); err != nil {
+		return tx, err
+	}
+	if c.Credited, err = ParseMoney(row[10], row[11]); err != nil {
+		return tx, err
+	}
+	if c.Fee, err = ParseMoney(row[12], row[9]); err != nil {
+		return tx, err
+	}
+	tx.Conversion = c
+	return tx, nil
+}
+
+// transactionJSON is the exported form of a Transaction
+type transactionJSON struct {
+	ID         string            `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Status     TransactionStatus `json:"status"`
+	Amount     Money             `json:"amount"`
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Refunded   Money             `json:"refunded"`
+	Conversion *conversionJSON   `json:"conversion,omitempty"`
+	ReviewRule string            `json:"review_rule,omitempty"`
+}
+
+type conversionJSON struct {
+	Rate          string    `json:"rate"`
+	RateTimestamp time.Time `json:"rate_timestamp"`
+	Debited       Money     `json:"debited"`
+	Credited      Money     `json:"credited"`
+	Fee           Money     `json:"fee"`
+}
+
+// newTransactionJSON converts tx to its exported form
+func newTransactionJSON(tx Transaction) transactionJSON {
+	out := transactionJSON{
+		ID:         tx.ID,
+		Timestamp:  tx.Timestamp.UTC(),
+		Status:     tx.Status,
+		Amount:     tx.Amount,
+		From:       tx.From,
+		To:         tx.To,
+		Refunded:   tx.Refunded,
+		ReviewRule: tx.ReviewRule,
+	}
+	if c := tx.Conversion; c != nil {
+		out.Conversion = &conversionJSON{
+			Rate:          c.Rate,
+			RateTimestamp: c.RateTimestamp.UTC(),
+			Debited:       c.Debited,
+			Credited:      c.Credited,
+			Fee:           c.Fee,
+		}
+	}
+	return out
+}
+
+// WriteTransactionsJSON writes txs as a JSON array
+func WriteTransactionsJSON(w io.Writer, txs []Transaction) error {
+	out := make([]transactionJSON, len(txs))
+	for i, tx := range txs {
+		out[i] = newTransactionJSON(tx)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("failed to encode transactions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSearchProcessor records five transactions an hour apart from start
+func newSearchProcessor(t *testing.T, start time.Time) *PaymentProcessor {
+	t.Helper()
+	now := start
+	p := NewPaymentProcessor()
+	p.now = func() time.Time { return now }
+	if err := p.OpenAccount(&Account{ID: "alice", Owner: "Alice", Currency: "USD"}); err != nil {
+		t.Fatal(err)
+	}
+	openAccounts(t, p, "USD", "bob", "carol")
+	if err := p.Deposit("alice", MustParseMoney("100.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct{ id, amount, to string }{
+		{"t1", "10.00", "bob"},
+		{"t2", "25.00", "carol"},
+		{"t3", "5.00", "bob"},
+		{"t4", "25.00", "bob"},
+		{"t5", "500.00", "carol"},
+	}
+	for _, step := range steps {
+		now = now.Add(time.Hour)
+		p.ProcessTransaction(&Transaction{ID: step.id, Amount: MustParseMoney(step.amount, "USD"), From: "alice", To: step.to})
+	}
+	return p
+}
+
+func txIDs(txs []Transaction) string {
+	ids := make([]string, len(txs))
+	for i, tx := range txs {
+		ids[i] = tx.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestSearchTransactions(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	p := newSearchProcessor(t, start)
+	if err := p.Refund("t4", MustParseMoney("5.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    TransactionQuery
+		want string
+	}{
+		{"all by time", TransactionQuery{}, "t1,t2,t3,t4"},
+		{"account", TransactionQuery{Account: "carol"}, "t2"},
+		{"date range", TransactionQuery{Since: start.Add(2 * time.Hour), Until: start.Add(4 * time.Hour)}, "t2,t3"},
+		{"status", TransactionQuery{Statuses: []TransactionStatus{StatusPartiallyRefunded, StatusRefunded}}, "t4"},
+		{"amount range", TransactionQuery{MinAmount: MustParseMoney("10.00", "USD"), MaxAmount: MustParseMoney("25.00", "USD")}, "t1,t2,t4"},
+		{"other currency", TransactionQuery{Currency: "EUR"}, ""},
+		{"by amount descending", TransactionQuery{SortBy: SortByAmount, Descending: true}, "t4,t2,t1,t3"},
+	}
+	for _, tt := range tests {
+		page, err := p.SearchTransactions(tt.q)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := txIDs(page.Transactions); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	// Pages follow one another until NextOffset is zero
+	var seen []string
+	q := TransactionQuery{SortBy: SortByID, Limit: 3}
+	for {
+		page, err := p.SearchTransactions(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 4 {
+			t.Errorf("Expected 4 matches in total, got %d", page.Total)
+		}
+		seen = append(seen, txIDs(page.Transactions))
+		if page.NextOffset == 0 {
+			break
+		}
+		q.Offset = page.NextOffset
+	}
+	if got := strings.Join(seen, "|"); got != "t1,t2,t3|t4" {
+		t.Errorf("Unexpected pages %q", got)
+	}
+}
+
+func TestSearchTransactionsValidation(t *testing.T) {
+	p := NewPaymentProcessor()
+	_, err := p.SearchTransactions(TransactionQuery{
+		Since:     time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		Until:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Currency:  "USD",
+		MinAmount: MustParseMoney("1.00", "EUR"),
+		SortBy:    "colour",
+		Limit:     MaxQueryLimit + 1,
+	})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Errors) != 4 || !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Expected 4 field errors, got %v", err)
+	}
+}
+
+func TestExportTransactions(t *testing.T) {
+	p := newSearchProcessor(t, time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+
+	var buf bytes.Buffer
+	if err := p.ExportTransactions(&buf, TransactionQuery{Account: "bob", Limit: 1}, ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[1][0] != "t1" || rows[1][1] != "2024-03-01T10:00:00Z" || rows[1][3] != "10.00" {
+		t.Errorf("Unexpected CSV export %q", rows)
+	}
+
+	buf.Reset()
+	if err := p.ExportTransactions(&buf, TransactionQuery{Account: "carol"}, ExportJSON); err != nil {
+		t.Fatal(err)
+	}
+	var exported []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 1 || exported[0]["id"] != "t2" || exported[0]["status"] != "captured" {
+		t.Errorf("Unexpected JSON export %s", buf.String())
+	}
+
+	if err := p.ExportTransactions(&buf, TransactionQuery{}, "xml"); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Expected an unknown format to be rejected, got %v", err)
+	}
+}
+
+func TestReadTransactionsCSV(t *testing.T) {
+	p := newSearchProcessor(t, time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	if err := p.Refund("t1", MustParseMoney("4.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	want := p.findTransactions(TransactionQuery{})
+
+	var buf bytes.Buffer
+	if err := WriteTransactionsCSV(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTransactionsCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip changed the transactions:\n got %+v\nwant %+v", got, want)
+	}
+
+	if _, err := ReadTransactionsCSV(strings.NewReader("id,amount\nt1,1.00\n")); err == nil {
+		t.Error("Expected an unknown header to be rejected")
+	}
+}
+
+func TestMonthlyStatement(t *testing.T) {
+	p := newSearchProcessor(t, time.Date(2024, 2, 29, 21, 0, 0, 0, time.UTC))
+
+	// t1 and t2 fall in February, the rest in March
+	st, err := p.MonthlyStatement("alice", 2024, time.March, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Opening != MustParseMoney("65.00", "USD") || st.Closing != MustParseMoney("35.00", "USD") {
+		t.Errorf("Expected opening 65.00 and closing 35.00, got %s and %s", st.Opening, st.Closing)
+	}
+	if len(st.Lines) != 2 || st.Lines[0].TxID != "t3" || st.Lines[0].Counterparty != "bob" {
+		t.Errorf("Unexpected lines %+v", st.Lines)
+	}
+
+	var buf bytes.Buffer
+	if err := st.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Statement for alice (Alice)", "Period 2024-03-01 to 2024-03-31", "-25.00", "Closing balance"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected the statement to contain %q:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is a rule violation on one field of a request. Field is a
+// dotted path such as "amount.currency".
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError collects every FieldError found in a request. errors.Is
+// matches the sentinel of any of them.
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, fe := range e.Errors {
+		errs[i] = fe
+	}
+	return errs
+}
+
+// add records a violation of field
+func (e *ValidationError) add(field string, err error) {
+	e.Errors = append(e.Errors, &FieldError{Field: field, Err: err})
+}
+
+// errOrNil returns e if any violation was recorded, avoiding a non-nil
+// error interface holding a nil pointer
+func (e *ValidationError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate checks the rules that need nothing but the transaction itself and
+// reports every violation at once as a *ValidationError. Checks that depend
+// on processor state, such as balances and duplicate IDs, happen later.
+func (tx *Transaction) Validate() error {
+	v := &ValidationError{}
+	if !tx.Amount.IsPositive() {
+		v.add("amount.amount", ErrInvalidAmount)
+	}
+	if _, err := MinorUnits(tx.Amount.Currency); err != nil {
+		v.add("amount.currency", ErrUnsupportedCurrency)
+	}
+	if tx.From == "" {
+		v.add("from", ErrInvalidAccount)
+	}
+	if tx.To == "" {
+		v.add("to", ErrInvalidAccount)
+	}
+	return v.errOrNil()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateCollectsEveryViolation(t *testing.T) {
+	tx := &Transaction{ID: "tx1", Amount: Money{Amount: -100, Currency: "XXX"}}
+	err := tx.Validate()
+
+	var v *ValidationError
+	if !errors.As(err, &v) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	want := map[string]error{
+		"amount.amount":   ErrInvalidAmount,
+		"amount.currency": ErrUnsupportedCurrency,
+		"from":            ErrInvalidAccount,
+		"to":              ErrInvalidAccount,
+	}
+	if len(v.Errors) != len(want) {
+		t.Fatalf("Expected %d violations, got %v", len(want), v.Errors)
+	}
+	for _, fe := range v.Errors {
+		if !errors.Is(fe, want[fe.Field]) {
+			t.Errorf("Field %s: expected %v, got %v", fe.Field, want[fe.Field], fe.Err)
+		}
+	}
+	for _, sentinel := range []error{ErrInvalidAmount, ErrUnsupportedCurrency, ErrInvalidAccount} {
+		if !errors.Is(err, sentinel) {
+			t.Errorf("Expected errors.Is to match %v", sentinel)
+		}
+	}
+
+	valid := &Transaction{ID: "tx2", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected a valid transaction, got %v", err)
+	}
+}
+
+func TestValidationRunsBeforeStatefulChecks(t *testing.T) {
+	processor := NewPaymentProcessor()
+	openAccounts(t, processor, "USD", "a", "b")
+	if err := processor.Deposit("a", MustParseMoney("10.00", "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if err := processor.ProcessTransaction(&Transaction{ID: "tx1", Amount: MustParseMoney("1.00", "USD"), From: "a", To: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reused ID with bad fields reports the field problems, not the duplicate
+	err := processor.ProcessTransaction(&Transaction{ID: "tx1", Amount: MustParseMoney("0.00", "USD"), From: "a"})
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || !errors.Is(err, ErrInvalidAmount) || !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Expected a TransactionError with both violations, got %v", err)
+	}
+	if errors.Is(err, ErrDuplicateTransaction) {
+		t.Errorf("Stateful checks should not run on an invalid transaction, got %v", err)
+	}
+}